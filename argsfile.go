@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"unicode"
+)
+
+// Replace a response file argument, "@file" right after the command in args,
+// with the arguments read from file. Other arguments are returned unchanged.
+func expandResponseFile(args []string) ([]string, error) {
+	for i, arg := range args {
+		if !isCommand(arg) {
+			continue
+		}
+		if i+1 == len(args) || !strings.HasPrefix(args[i+1], "@") {
+			return args, nil
+		}
+		fileName := args[i+1][1:]
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading response file: %s", err)
+		}
+		fileArgs, err := splitResponseFile(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fileName, err)
+		}
+		expanded := append(append(append([]string{}, args[:i+1]...), fileArgs...), args[i+2:]...)
+		return expanded, nil
+	}
+	return args, nil
+}
+
+// Whether arg is one of the commands in the usage string
+func isCommand(arg string) bool {
+	for _, command := range commands {
+		if arg == command {
+			return true
+		}
+	}
+	return false
+}
+
+// Split the contents of a response file into arguments separated by
+// whitespace. Single or double quotes keep whitespace in an argument, and
+// backslashes are literal so that no escaping is needed in paths.
+func splitResponseFile(data string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	for _, c := range data {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(c)
+		case c == '\'' || c == '"':
+			quote, inArg = c, true
+		case unicode.IsSpace(c):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("Unterminated %c quote", quote)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitResponseFile(t *testing.T) {
+	tests := []struct {
+		data    string
+		want    []string
+		wantErr bool
+	}{
+		{"mysrv mysrv_dsk0\nmysrv_dsk0_attch\t/dev/sdg\n", []string{"mysrv", "mysrv_dsk0", "mysrv_dsk0_attch", "/dev/sdg"}, false},
+		{`--attribute 'tags.Name=my disk' "/dev/sdg"`, []string{"--attribute", "tags.Name=my disk", "/dev/sdg"}, false},
+		{`-i C:\state\terraform.tfstate ''`, []string{"-i", `C:\state\terraform.tfstate`, ""}, false},
+		{"  \n", nil, false},
+		{`"/dev/sdg`, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := splitResponseFile(tt.data)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", tt.data)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, %v, want %q", tt.data, got, err, tt.want)
+		}
+	}
+}
+
+func TestExpandResponseFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-ebs-attach-args")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "import.args")
+	if err := ioutil.WriteFile(fileName, []byte("mysrv mysrv_dsk0 mysrv_dsk0_attch /dev/sdg\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"import", "@" + fileName, "--yes"},
+			[]string{"import", "mysrv", "mysrv_dsk0", "mysrv_dsk0_attch", "/dev/sdg", "--yes"}},
+		{[]string{"--verbose", "import", "@" + fileName},
+			[]string{"--verbose", "import", "mysrv", "mysrv_dsk0", "mysrv_dsk0_attch", "/dev/sdg"}},
+		// Only right after the command
+		{[]string{"import", "--yes", "@" + fileName}, []string{"import", "--yes", "@" + fileName}},
+		{[]string{"import"}, []string{"import"}},
+	}
+	for _, tt := range tests {
+		got, err := expandResponseFile(tt.args)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, %v, want %q", tt.args, got, err, tt.want)
+		}
+	}
+
+	if _, err := expandResponseFile([]string{"import", "@" + filepath.Join(dir, "missing")}); err == nil {
+		t.Error("expected an error for a missing response file")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Replace the contents of fileName with data by writing a temporary file next
+// to it and renaming that over it, so a crash can't leave a truncated state.
+// If fileName is a symlink, the file it points to is replaced instead and the
+// link is kept. An existing file keeps its permissions, a new one gets perm.
+// A named pipe or character device is written to directly instead, as
+// another process is reading from it and there's nothing to replace. If ctx
+// is cancelled before the rename, the temporary file is removed and fileName
+// is left as it was.
+func writeFileAtomic(ctx context.Context, fileName string, data []byte, perm os.FileMode) error {
+	return writeFileAtomicFunc(ctx, fileName, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// Replace the contents of fileName as writeFileAtomic does, with whatever
+// write writes to the temporary file
+func writeFileAtomicFunc(ctx context.Context, fileName string, perm os.FileMode, write func(io.Writer) error) error {
+	target, err := resolveSymlink(fileName)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(target); err == nil {
+		if info.Mode()&(os.ModeNamedPipe|os.ModeCharDevice) != 0 {
+			return writeStream(target, write)
+		}
+		perm = info.Mode().Perm()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(target), "."+filepath.Base(target)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// Write to the named pipe or device fileName as it is, without truncating it
+func writeStream(fileName string, write func(io.Writer) error) error {
+	output, err := os.OpenFile(fileName, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := write(output); err != nil {
+		output.Close()
+		return err
+	}
+	return output.Close()
+}
+
+// Follow fileName through any symlinks to the path of the file they lead to,
+// which needn't exist yet. Returns fileName itself if it isn't a symlink.
+func resolveSymlink(fileName string) (string, error) {
+	// The same limit as Linux
+	for i := 0; i < 40; i++ {
+		info, err := os.Lstat(fileName)
+		if os.IsNotExist(err) {
+			return fileName, nil
+		} else if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return fileName, nil
+		}
+		link, err := os.Readlink(fileName)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(fileName), link)
+		}
+		fileName = link
+	}
+	return "", fmt.Errorf("Too many levels of symbolic links resolving %s", fileName)
+}
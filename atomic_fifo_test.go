@@ -0,0 +1,63 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestWriteFileAtomicFIFO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-ebs-attach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fifoName := filepath.Join(dir, "state.fifo")
+	if err := syscall.Mkfifo(fifoName, 0600); err != nil {
+		t.Skipf("can't create a named pipe: %s", err)
+	}
+	received := make(chan []byte)
+	go func() {
+		reader, err := os.Open(fifoName)
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer reader.Close()
+		data, _ := ioutil.ReadAll(reader)
+		received <- data
+	}()
+
+	if err := backupFile(fifoName); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(context.Background(), fifoName, []byte("streamed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data := <-received; string(data) != "streamed" {
+		t.Errorf("read %q from the pipe, want \"streamed\"", data)
+	}
+
+	// The pipe is still there, with nothing left beside it
+	if info, err := os.Lstat(fifoName); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("%s is no longer a named pipe: %v", fifoName, err)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("directory has %v, want just the pipe", names)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-ebs-attach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "terraform.tfstate")
+	if err := writeFileAtomic(context.Background(), fileName, []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(context.Background(), fileName, []byte("replaced"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "replaced" {
+		t.Errorf("contents %q, want \"replaced\"", data)
+	}
+	info, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode %v, want the original 0600", info.Mode().Perm())
+	}
+
+	// No temporary files are left behind
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files in %s, want 1", len(entries), dir)
+	}
+}
+
+// Writing through a symlink replaces the file it points to and keeps the link
+func TestWriteFileAtomicSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-ebs-attach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	shared := filepath.Join(dir, "shared")
+	if err := os.Mkdir(shared, 0755); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(shared, "prod.tfstate")
+	if err := ioutil.WriteFile(target, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "terraform.tfstate")
+	if err := os.Symlink("shared/prod.tfstate", link); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeFileAtomic(context.Background(), link, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if dest, err := os.Readlink(link); err != nil || dest != "shared/prod.tfstate" {
+		t.Errorf("link points to %q (%v), want \"shared/prod.tfstate\"", dest, err)
+	}
+	data, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "new" {
+		t.Errorf("target contents %q, want \"new\"", data)
+	}
+}
+
+// An interruption while the temporary file is written leaves the original
+func TestWriteFileAtomicCancelled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-ebs-attach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "terraform.tfstate")
+	if err := ioutil.WriteFile(fileName, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err = writeFileAtomicFunc(ctx, fileName, 0644, func(w io.Writer) error {
+		if _, err := w.Write([]byte("half-")); err != nil {
+			return err
+		}
+		cancel() // as the SIGINT handler does
+		_, err := w.Write([]byte("written"))
+		return err
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want context.Canceled", err)
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "original" {
+		t.Errorf("contents %q, want the original", data)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files in the directory, want just the original", len(entries))
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"github.com/docopt/docopt-go"
+	"github.com/hashicorp/terraform/terraform"
+	"sort"
+	"strings"
+)
+
+// Parse "--attribute" values of the form "key=value". The value may be empty
+// and may itself contain "=".
+func parseAttributes(pairs []string) (map[string]string, error) {
+	attributes := make(map[string]string)
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid --attribute \"%s\", expected \"key=value\"", pair)
+		}
+		attributes[parts[0]] = parts[1]
+	}
+	return attributes, nil
+}
+
+// Merge attributes into the primary instance of resourceState, replacing any
+// existing values with a warning as those were calculated by this tool
+func applyAttributes(resourceID string, resourceState *terraform.ResourceState, attributes map[string]string) {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if old, found := resourceState.Primary.Attributes[key]; found && old != attributes[key] {
+			warnf("overriding \"%s\" of %s: \"%s\" -> \"%s\"", key, resourceID, old, attributes[key])
+		}
+		resourceState.Primary.Attributes[key] = attributes[key]
+	}
+}
+
+// Set the ID of resourceState and its "id" attribute to attachmentID, as given
+// by "--attachment-id", instead of the calculated one. A different calculated
+// ID is reported, as it usually means the inputs don't match the state.
+func applyAttachmentID(resourceID string, resourceState *terraform.ResourceState, attachmentID string) {
+	if calculated := resourceState.Primary.ID; calculated != attachmentID {
+		warnf("using ID %s for %s instead of the calculated %s, check the instance ID, volume ID "+
+			"and device name", attachmentID, resourceID, calculated)
+	}
+	resourceState.Primary.ID = attachmentID
+	resourceState.Primary.Attributes["id"] = attachmentID
+}
+
+// Boolean attachment arguments that have a flag of their own
+var attributeFlags = map[string]string{
+	"--force-detach": "force_detach",
+	"--skip-destroy": "skip_destroy",
+}
+
+// Collect the "--attribute" values from opts, along with those set by the
+// flags in attributeFlags. An explicit "--attribute" takes precedence.
+func attributesFromOpts(opts docopt.Opts) map[string]string {
+	pairs, _ := opts["--attribute"].([]string)
+	attributes, err := parseAttributes(pairs)
+	if err != nil {
+		die("%s", err)
+	}
+	for flag, key := range attributeFlags {
+		if set, _ := opts.Bool(flag); set {
+			if _, found := attributes[key]; !found {
+				attributes[key] = "true"
+			}
+		}
+	}
+	return attributes
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAttributes(t *testing.T) {
+	attributes, err := parseAttributes([]string{"force_detach=true", "tags.Name=a=b", "empty="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"force_detach": "true", "tags.Name": "a=b", "empty": ""}
+	if !reflect.DeepEqual(attributes, want) {
+		t.Errorf("got %v, want %v", attributes, want)
+	}
+
+	for _, pair := range []string{"novalue", "=value"} {
+		if _, err := parseAttributes([]string{pair}); err == nil {
+			t.Errorf("expected an error for %q", pair)
+		}
+	}
+}
+
+func TestApplyAttributes(t *testing.T) {
+	var warnings bytes.Buffer
+	verboseOutput = &warnings
+	defer func() { verboseOutput = os.Stderr }()
+
+	attachmentState, err := newAwsVolumeAttachmentState("i-abc123", "dsk", "vol-123abc", "/dev/sdg", "provider.aws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyAttributes("aws_volume_attachment.att", attachmentState,
+		map[string]string{"skip_destroy": "true", "id": "vai-1"})
+
+	attributes := attachmentState.Primary.Attributes
+	if attributes["skip_destroy"] != "true" || attributes["id"] != "vai-1" {
+		t.Errorf("attributes not applied: %v", attributes)
+	}
+	if !strings.Contains(warnings.String(), "overriding \"id\"") {
+		t.Errorf("missing warning for overriding id, got %q", warnings.String())
+	}
+	if strings.Contains(warnings.String(), "skip_destroy") {
+		t.Errorf("unexpected warning for a new attribute: %q", warnings.String())
+	}
+}
+
+func TestApplyAttachmentID(t *testing.T) {
+	var warnings bytes.Buffer
+	verboseOutput = &warnings
+	defer func() { verboseOutput = os.Stderr }()
+
+	attachmentState, err := newAwsVolumeAttachmentState("i-abc123", "dsk", "vol-123abc", "/dev/sdg", "provider.aws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	calculated := attachmentState.Primary.ID
+	applyAttachmentID("aws_volume_attachment.att", attachmentState, calculated)
+	if warnings.Len() != 0 {
+		t.Errorf("unexpected warning for the calculated ID: %q", warnings.String())
+	}
+
+	applyAttachmentID("aws_volume_attachment.att", attachmentState, "vai-1")
+	if attachmentState.Primary.ID != "vai-1" || attachmentState.Primary.Attributes["id"] != "vai-1" {
+		t.Errorf("ID not applied: %q, %v", attachmentState.Primary.ID, attachmentState.Primary.Attributes)
+	}
+	if !strings.Contains(warnings.String(), "instead of the calculated "+calculated) {
+		t.Errorf("missing warning for a differing ID, got %q", warnings.String())
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/docopt/docopt-go"
+	"github.com/hashicorp/terraform/terraform"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Exit status of audit mode when orphaned attachments were found
+const auditOrphansExitCode = 2
+
+// An attachment referring to an instance or volume that isn't in the state
+type orphanedAttachment struct {
+	modulePath string
+	resourceID string
+	missing    []string // e.g. `instance "i-abc123"`
+}
+
+// List the attachments in the state read from "-i" whose instance or volume
+// is missing from it, exiting with auditOrphansExitCode if there are any
+func auditMode(ctx context.Context, opts docopt.Opts) {
+	tfstate, _ := readTfStateFile(ctx, opts)
+
+	orphans := findOrphanedAttachments(tfstate, resourceTypesFromOpts(opts))
+	for _, orphan := range orphans {
+		fmt.Printf("%s in module %s: %s not in the state\n",
+			orphan.resourceID, orphan.modulePath, strings.Join(orphan.missing, " and "))
+	}
+	if len(orphans) == 0 {
+		fmt.Fprint(os.Stderr, "No orphaned attachments\n")
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%d attachment(s) may be stale, check them before removing them\n", len(orphans))
+	emitMetrics("")
+	os.Exit(auditOrphansExitCode)
+}
+
+// Find the attachments in tfstate whose "instance_id" or "volume_id" isn't the
+// ID of any instance or volume of the given types in any module. Results are
+// ordered by module and then resource.
+func findOrphanedAttachments(tfstate *terraform.State, types resourceTypes) []orphanedAttachment {
+	types = types.withDefaults()
+	instanceIDs := make(map[string]bool)
+	volumeIDs := make(map[string]bool)
+	for _, moduleState := range tfstate.Modules {
+		for resourceID, resourceState := range moduleState.Resources {
+			if resourceState.Primary == nil {
+				continue
+			}
+			if strings.HasPrefix(resourceID, types.instance+".") {
+				instanceIDs[resourceState.Primary.ID] = true
+			} else if strings.HasPrefix(resourceID, types.volume+".") {
+				volumeIDs[resourceState.Primary.ID] = true
+			}
+		}
+	}
+
+	var orphans []orphanedAttachment
+	for _, moduleState := range tfstate.Modules {
+		metrics.ModulesScanned++
+		resourceIDs := make([]string, 0, len(moduleState.Resources))
+		for resourceID := range moduleState.Resources {
+			resourceIDs = append(resourceIDs, resourceID)
+		}
+		sort.Strings(resourceIDs)
+
+		for _, resourceID := range resourceIDs {
+			resourceState := moduleState.Resources[resourceID]
+			if !strings.HasPrefix(resourceID, types.attachment+".") || resourceState.Primary == nil {
+				continue
+			}
+			attributes := resourceState.Primary.Attributes
+			var missing []string
+			if instanceID := attributes["instance_id"]; !instanceIDs[instanceID] {
+				missing = append(missing, fmt.Sprintf("instance \"%s\"", instanceID))
+			}
+			if volumeID := attributes["volume_id"]; !volumeIDs[volumeID] {
+				missing = append(missing, fmt.Sprintf("volume \"%s\"", volumeID))
+			}
+			if len(missing) > 0 {
+				orphans = append(orphans, orphanedAttachment{
+					modulePath: strings.Join(moduleState.Path, "."),
+					resourceID: resourceID,
+					missing:    missing,
+				})
+			}
+		}
+	}
+	return orphans
+}
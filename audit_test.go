@@ -0,0 +1,27 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindOrphanedAttachments(t *testing.T) {
+	tfstate := loadTfState(t, "orphaned.tfstate")
+	orphans := findOrphanedAttachments(tfstate, resourceTypes{})
+	want := []orphanedAttachment{
+		{"root", "aws_volume_attachment.old_dsk_attch", []string{`volume "vol-0deadbeef0000000a"`}},
+		{"root.app1", "aws_volume_attachment.gone_attch",
+			[]string{`instance "i-0ffffffffffffffff"`, `volume "vol-0fffffffffffffff0"`}},
+	}
+	if !reflect.DeepEqual(orphans, want) {
+		t.Errorf("got %+v, want %+v", orphans, want)
+	}
+
+	// Attachments of other types are ignored
+	if orphans := findOrphanedAttachments(tfstate, resourceTypes{attachment: "custom_attachment"}); len(orphans) != 0 {
+		t.Errorf("got %+v for a type with no attachments", orphans)
+	}
+	if orphans := findOrphanedAttachments(loadTfState(t, "single-module.tfstate"), resourceTypes{}); len(orphans) != 0 {
+		t.Errorf("got %+v for a state without attachments", orphans)
+	}
+}
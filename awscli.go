@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/docopt/docopt-go"
+	"github.com/hashicorp/terraform/terraform"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// How to run the AWS CLI for the modes that query AWS. The tool has no AWS
+// SDK dependency; the CLI brings the user's configuration, credentials and
+// SSO sessions along.
+type awsCLI struct {
+	command string // from "--aws-cmd"
+	profile string // from "--profile", passed on as $AWS_PROFILE if set
+	region  string
+}
+
+// Messages of the AWS CLI that mean there are no usable credentials
+var awsCredentialsErrors = []string{
+	"Unable to locate credentials",
+	"could not be found",
+	"Token has expired",
+	"Error loading SSO Token",
+	"ExpiredToken",
+	"InvalidClientTokenId",
+	"AuthFailure",
+}
+
+// Set up the AWS CLI from "--aws-cmd", "--profile" and "--region" in opts,
+// resolving the region as awsRegionFromOpts does
+func awsCLIFromOpts(opts docopt.Opts, tfstate *terraform.State) awsCLI {
+	aws := awsCLI{}
+	aws.command, _ = opts.String("--aws-cmd")
+	if aws.command == "" {
+		aws.command = "aws"
+	}
+	aws.profile, _ = opts.String("--profile")
+	aws.region = awsRegionFromOpts(opts, tfstate)
+	return aws
+}
+
+// Run "<command> <subcommand> --region <region> --output json" followed by
+// args and return its output. Its errors are passed through to stderr.
+func (aws awsCLI) run(ctx context.Context, subcommand string, args ...string) ([]byte, error) {
+	script := aws.command + " " + subcommand + ` --region "$1" --output json`
+	for i := range args {
+		script += fmt.Sprintf(` "$%d"`, i+2)
+	}
+	cmd := exec.CommandContext(ctx, "sh", append([]string{"-c", script, "sh", aws.region}, args...)...)
+	if aws.profile != "" {
+		cmd.Env = append(os.Environ(), "AWS_PROFILE="+aws.profile)
+	}
+	var output, errorOutput bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, io.MultiWriter(os.Stderr, &errorOutput)
+	if err := cmd.Run(); err != nil {
+		for _, message := range awsCredentialsErrors {
+			if strings.Contains(errorOutput.String(), message) {
+				return nil, fmt.Errorf("No usable AWS credentials for %s, log in (e.g. \"aws sso login\") "+
+					"or choose another profile with --profile", aws.profileName())
+			}
+		}
+		return nil, fmt.Errorf("Error running \"%s %s\": %s", aws.command, subcommand, err)
+	}
+	return output.Bytes(), nil
+}
+
+// Describe the profile the AWS CLI uses, for messages
+func (aws awsCLI) profileName() string {
+	if aws.profile != "" {
+		return "profile " + aws.profile
+	}
+	if profile := awsCommandProfile(aws.command); profile != "" {
+		return "profile " + profile
+	}
+	if profile := os.Getenv("AWS_PROFILE"); profile != "" {
+		return "profile " + profile
+	}
+	return "the default profile"
+}
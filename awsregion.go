@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/docopt/docopt-go"
+	"github.com/hashicorp/terraform/terraform"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The region part of an availability zone, e.g. "eu-west-1" of "eu-west-1a"
+// or "us-west-2" of the local zone "us-west-2-lax-1a"
+var zoneRegionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+`)
+
+// The region field of an ARN, e.g. "eu-west-1" of
+// "arn:aws:ec2:eu-west-1:123456789012:volume/vol-1"
+var arnRegionPattern = regexp.MustCompile(`^arn:[a-z-]+:[a-z0-9-]+:([a-z]{2}(-[a-z]+)+-[0-9]+):`)
+
+// The AWS region for the modes that call AWS, from "--region" in opts, the
+// environment, the profile or the zones recorded in tfstate, in that order.
+// "--profile", or else a "--profile" in "--aws-cmd", takes the place of
+// $AWS_PROFILE.
+func awsRegionFromOpts(opts docopt.Opts, tfstate *terraform.State) string {
+	flag, _ := opts.String("--region")
+	awsCommand, _ := opts.String("--aws-cmd")
+	profile, _ := opts.String("--profile")
+	if profile == "" {
+		profile = awsCommandProfile(awsCommand)
+	}
+	getenv := os.Getenv
+	if profile != "" {
+		getenv = func(name string) string {
+			if name == "AWS_PROFILE" {
+				return profile
+			}
+			return os.Getenv(name)
+		}
+	}
+	region, source, err := resolveAWSRegion(flag, getenv, tfstate)
+	if err != nil {
+		die("%s", err)
+	}
+	verbosef("using AWS region %s from %s", region, source)
+	return region
+}
+
+// Determine the AWS region, returning it along with where it came from. The
+// first of these that is set wins: flag ("--region"), $AWS_REGION,
+// $AWS_DEFAULT_REGION, the "region" of $AWS_PROFILE (or "default") in the
+// AWS CLI config file, and finally the region of the availability zones and
+// ARNs in tfstate if they all agree. getenv stands in for os.Getenv.
+func resolveAWSRegion(flag string, getenv func(string) string, tfstate *terraform.State) (string, string, error) {
+	if flag != "" {
+		return flag, "--region", nil
+	}
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := getenv(name); region != "" {
+			return region, "$" + name, nil
+		}
+	}
+
+	profile := getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	configFileName := getenv("AWS_CONFIG_FILE")
+	if configFileName == "" && getenv("HOME") != "" {
+		configFileName = filepath.Join(getenv("HOME"), ".aws", "config")
+	}
+	if configFileName != "" {
+		region, err := profileRegion(configFileName, profile)
+		if err != nil {
+			return "", "", err
+		}
+		if region != "" {
+			return region, "profile " + profile + " in " + configFileName, nil
+		}
+	}
+
+	regions := stateRegions(tfstate)
+	if len(regions) == 1 {
+		return regions[0], "the availability zones and ARNs in the state", nil
+	}
+	message := "Can't determine the AWS region: pass --region, set AWS_REGION or AWS_DEFAULT_REGION, " +
+		"or set a region for profile " + profile
+	if len(regions) > 1 {
+		message += fmt.Sprintf(" (the state spans %s)", strings.Join(regions, ", "))
+	}
+	return "", "", fmt.Errorf("%s", message)
+}
+
+// The profile given with "--profile p" or "--profile=p" in awsCommand, if any
+func awsCommandProfile(awsCommand string) string {
+	fields := strings.Fields(awsCommand)
+	for i, field := range fields {
+		if field == "--profile" && i+1 < len(fields) {
+			return fields[i+1]
+		}
+		if strings.HasPrefix(field, "--profile=") {
+			return strings.TrimPrefix(field, "--profile=")
+		}
+	}
+	return ""
+}
+
+// The "region" set for profile in the AWS CLI config file configFileName, or
+// "" if there's none or the file doesn't exist
+func profileRegion(configFileName, profile string) (string, error) {
+	configFile, err := os.Open(configFileName)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("Error reading AWS config: %s", err)
+	}
+	defer configFile.Close()
+
+	// Every profile but "default" is "[profile name]" in the config file
+	section := "[profile " + profile + "]"
+	if profile == "default" {
+		section = "[default]"
+	}
+	inSection := false
+	scanner := bufio.NewScanner(configFile)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			inSection = strings.Join(strings.Fields(line), " ") == section
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if inSection && len(parts) == 2 && strings.TrimSpace(parts[0]) == "region" {
+			return strings.TrimSpace(parts[1]), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("Error reading AWS config: %s", err)
+	}
+	return "", nil
+}
+
+// The distinct regions of the "availability_zone" and "arn" attributes in
+// tfstate, sorted. Global ARNs, without a region, are skipped.
+func stateRegions(tfstate *terraform.State) []string {
+	if tfstate == nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var regions []string
+	for _, moduleState := range tfstate.Modules {
+		for _, resourceState := range moduleState.Resources {
+			if resourceState.Primary == nil {
+				continue
+			}
+			attributes := resourceState.Primary.Attributes
+			found := []string{zoneRegionPattern.FindString(attributes["availability_zone"])}
+			if match := arnRegionPattern.FindStringSubmatch(attributes["arn"]); match != nil {
+				found = append(found, match[1])
+			}
+			for _, region := range found {
+				if region != "" && !seen[region] {
+					seen[region] = true
+					regions = append(regions, region)
+				}
+			}
+		}
+	}
+	sort.Strings(regions)
+	return regions
+}
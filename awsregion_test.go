@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveAWSRegion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-ebs-attach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFileName := filepath.Join(dir, "config")
+	config := "[default]\nregion = us-east-1\n\n[profile prod]\noutput = json\nregion=eu-central-1\n\n[profile bare]\n"
+	if err := ioutil.WriteFile(configFileName, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	attached := loadTfState(t, "attached.tfstate") // in eu-west-1
+
+	tests := []struct {
+		name       string
+		flag       string
+		env        map[string]string
+		noState    bool
+		wantRegion string
+		wantErr    string
+	}{
+		{"flag first", "ap-south-1",
+			map[string]string{"AWS_REGION": "us-west-2", "AWS_CONFIG_FILE": configFileName}, false, "ap-south-1", ""},
+		{"AWS_REGION", "",
+			map[string]string{"AWS_REGION": "us-west-2", "AWS_DEFAULT_REGION": "us-west-1"}, false, "us-west-2", ""},
+		{"AWS_DEFAULT_REGION", "",
+			map[string]string{"AWS_DEFAULT_REGION": "us-west-1", "AWS_CONFIG_FILE": configFileName}, false, "us-west-1", ""},
+		{"default profile", "",
+			map[string]string{"AWS_CONFIG_FILE": configFileName}, false, "us-east-1", ""},
+		{"named profile", "",
+			map[string]string{"AWS_CONFIG_FILE": configFileName, "AWS_PROFILE": "prod"}, false, "eu-central-1", ""},
+		{"config under HOME", "",
+			map[string]string{"HOME": filepath.Join(dir, "home")}, false, "eu-west-1", ""},
+		{"profile without a region", "",
+			map[string]string{"AWS_CONFIG_FILE": configFileName, "AWS_PROFILE": "bare"}, false, "eu-west-1", ""},
+		{"nothing to go on", "",
+			map[string]string{"AWS_CONFIG_FILE": configFileName, "AWS_PROFILE": "bare"}, true, "",
+			"Can't determine the AWS region"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getenv := func(name string) string { return tt.env[name] }
+			tfstate := attached
+			if tt.noState {
+				tfstate = nil
+			}
+			region, _, err := resolveAWSRegion(tt.flag, getenv, tfstate)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if region != tt.wantRegion {
+				t.Errorf("got region %q, want %q", region, tt.wantRegion)
+			}
+		})
+	}
+}
+
+func TestStateRegions(t *testing.T) {
+	tfstate := loadTfState(t, "attached.tfstate")
+	tfstate.Modules[0].Resources["aws_instance.mysrv"].Primary.Attributes["availability_zone"] = "us-west-2-lax-1a"
+	got := stateRegions(tfstate)
+	if strings.Join(got, ",") != "eu-west-1,us-west-2" {
+		t.Errorf("got %v, want [eu-west-1 us-west-2]", got)
+	}
+	if _, _, err := resolveAWSRegion("", func(string) string { return "" }, tfstate); err == nil ||
+		!strings.Contains(err.Error(), "spans eu-west-1, us-west-2") {
+		t.Errorf("got error %v for a state in two regions", err)
+	}
+}
+
+func TestStateRegionsFromARNs(t *testing.T) {
+	tfstate := loadTfState(t, "attached.tfstate")
+	for _, resourceState := range tfstate.Modules[0].Resources {
+		delete(resourceState.Primary.Attributes, "availability_zone")
+	}
+	resources := tfstate.Modules[0].Resources
+	resources["aws_instance.mysrv"].Primary.Attributes["arn"] = "arn:aws:ec2:ap-southeast-2:123456789012:instance/i-1"
+	// IAM ARNs have no region
+	resources["aws_ebs_volume.mysrv_dsk0"].Primary.Attributes["arn"] = "arn:aws:iam::123456789012:role/ebs"
+	if got := stateRegions(tfstate); strings.Join(got, ",") != "ap-southeast-2" {
+		t.Errorf("got %v, want [ap-southeast-2]", got)
+	}
+}
+
+func TestAWSCommandProfile(t *testing.T) {
+	for command, want := range map[string]string{
+		"aws":                        "",
+		"aws --profile prod":         "prod",
+		"aws --profile=prod --debug": "prod",
+		"aws --profile":              "",
+	} {
+		if got := awsCommandProfile(command); got != want {
+			t.Errorf("awsCommandProfile(%q) = %q, want %q", command, got, want)
+		}
+	}
+}
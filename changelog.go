@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/docopt/docopt-go"
+	"github.com/hashicorp/terraform/terraform"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// One line of the "--changelog" file, recording an attachment added to a
+// state file
+type changelogEntry struct {
+	Time      string `json:"time"`
+	Address   string `json:"address"`
+	Module    string `json:"module"`
+	ID        string `json:"id"`
+	StateFile string `json:"state_file"`
+}
+
+// A changelog entry, without time or state file, for the attachment
+// resourceID that was added to moduleState
+func newChangelogEntry(moduleState *terraform.ModuleState, resourceID string) changelogEntry {
+	entry := changelogEntry{
+		Address: resourceAddress(moduleState.Path, resourceID),
+		Module:  strings.Join(moduleState.Path, "."),
+	}
+	if resourceState := moduleState.Resources[resourceID]; resourceState != nil && resourceState.Primary != nil {
+		entry.ID = resourceState.Primary.ID
+	}
+	return entry
+}
+
+// With "--changelog", record entries for each state file written, as given
+// by "-o" or "--tfc-workspace"
+func recordChangelog(opts docopt.Opts, entries []changelogEntry) {
+	changelogFileName, _ := opts.String("--changelog")
+	if changelogFileName == "" || len(entries) == 0 {
+		return
+	}
+	var stateFiles []string
+	if workspaceArg, _ := opts.String("--tfc-workspace"); workspaceArg != "" {
+		stateFiles = []string{"tfc:" + workspaceArg}
+	} else {
+		for _, outputFileName := range resolveOutputFileNames(opts) {
+			if outputFileName == "-" {
+				stateFiles = append(stateFiles, "<stdout>")
+			} else if absPath, err := filepath.Abs(outputFileName); err == nil {
+				stateFiles = append(stateFiles, absPath)
+			} else {
+				stateFiles = append(stateFiles, outputFileName)
+			}
+		}
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	var recorded []changelogEntry
+	for _, stateFile := range stateFiles {
+		for _, entry := range entries {
+			entry.Time, entry.StateFile = now, stateFile
+			recorded = append(recorded, entry)
+		}
+	}
+	if err := appendChangelog(changelogFileName, recorded); err != nil {
+		die("The state was written, but "+err.Error(), nil)
+	}
+}
+
+// Append entries to fileName as JSON lines, creating it if needed. All of
+// them go in a single write, so concurrent runs don't interleave lines.
+func appendChangelog(fileName string, entries []changelogEntry) error {
+	var lines bytes.Buffer
+	encoder := json.NewEncoder(&lines)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return fmt.Errorf("error encoding changelog entry: %s", err)
+		}
+	}
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening changelog: %s", err)
+	}
+	if _, err := f.Write(lines.Bytes()); err != nil {
+		f.Close()
+		return fmt.Errorf("error appending to changelog: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error appending to changelog: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAppendChangelog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-ebs-attach-changelog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "changes.jsonl")
+
+	// The file is created on first use and appended to afterwards
+	first := changelogEntry{Time: "2018-06-01T12:00:00Z", Address: "aws_volume_attachment.a",
+		Module: "root", ID: "vai-1", StateFile: "/tmp/terraform.tfstate"}
+	second := first
+	second.Address, second.Module, second.ID = "module.app1.aws_volume_attachment.b", "root.app1", "vai-2"
+	if err := appendChangelog(fileName, []changelogEntry{first}); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendChangelog(fileName, []changelogEntry{second}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), data)
+	}
+	for i, want := range []changelogEntry{first, second} {
+		var got changelogEntry
+		if err := json.Unmarshal([]byte(lines[i]), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("line %d = %+v, want %+v", i+1, got, want)
+		}
+	}
+	if !strings.Contains(lines[0], `"state_file":"/tmp/terraform.tfstate"`) {
+		t.Errorf("unexpected field names: %s", lines[0])
+	}
+}
+
+func TestNewChangelogEntry(t *testing.T) {
+	tfstate := loadTfState(t, "multi-module.tfstate")
+	params := injectParams{
+		instanceName: "srv", volumeName: "dsk",
+		attachmentName: "dsk_attch", deviceName: "/dev/sdh",
+	}
+	existing := resourcesNamed(tfstate, params.attachmentResourceID())
+	moduleState, err := injectVolumeAttachment(params, tfstate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if existing[moduleState.Resources[params.attachmentResourceID()]] {
+		t.Error("new attachment counted as existing")
+	}
+	entry := newChangelogEntry(moduleState, params.attachmentResourceID())
+	if entry.Address != "module.app1.aws_volume_attachment.dsk_attch" || entry.Module != "root.app1" ||
+		!strings.HasPrefix(entry.ID, "vai-") {
+		t.Errorf("got %+v", entry)
+	}
+
+	// Importing it again leaves the same resource in place
+	existing = resourcesNamed(tfstate, params.attachmentResourceID())
+	if moduleState, err = injectVolumeAttachment(params, tfstate); err != nil {
+		t.Fatal(err)
+	}
+	if !existing[moduleState.Resources[params.attachmentResourceID()]] {
+		t.Error("repeated import counted as a new attachment")
+	}
+}
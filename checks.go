@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/terraform/terraform"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Look for signs in moduleState that volumeID is already attached to an
+// instance other than instanceID, returning a warning for each. This is best
+// effort: it only uses attributes that happen to be recorded in the state.
+// attachmentResourceID is the attachment being added, which is ignored.
+// Instances and attachments are found by their types in types.
+func checkVolumeAttachedElsewhere(moduleState *terraform.ModuleState, types resourceTypes, volumeResourceID,
+	volumeID, instanceID, attachmentResourceID string) []string {
+
+	types = types.withDefaults()
+
+	var warnings []string
+
+	// An "attachment" set on the volume itself
+	if volumeState := moduleState.Resources[volumeResourceID]; volumeState != nil && volumeState.Primary != nil {
+		for key, value := range volumeState.Primary.Attributes {
+			if strings.HasPrefix(key, "attachment.") && strings.HasSuffix(key, ".instance_id") && value != instanceID {
+				warnings = append(warnings, fmt.Sprintf("%s records an attachment to instance %s",
+					volumeResourceID, value))
+			}
+		}
+	}
+
+	for resourceID, resourceState := range moduleState.Resources {
+		if resourceState.Primary == nil || resourceID == attachmentResourceID {
+			continue
+		}
+		attributes := resourceState.Primary.Attributes
+
+		switch resourceState.Type {
+		case types.instance:
+			// An "ebs_block_device" on another instance
+			if resourceState.Primary.ID == instanceID {
+				continue
+			}
+			for key, value := range attributes {
+				if strings.HasPrefix(key, "ebs_block_device.") && strings.HasSuffix(key, ".volume_id") && value == volumeID {
+					warnings = append(warnings, fmt.Sprintf("%s (%s) has %s as an ebs_block_device",
+						resourceID, resourceState.Primary.ID, volumeID))
+				}
+			}
+		case types.attachment:
+			// Another attachment of the same volume
+			if attributes["volume_id"] == volumeID && attributes["instance_id"] != instanceID {
+				warnings = append(warnings, fmt.Sprintf("%s attaches %s to instance %s",
+					resourceID, volumeID, attributes["instance_id"]))
+			}
+		}
+	}
+
+	sort.Strings(warnings)
+	return warnings
+}
+
+// Look for devices already using deviceName on the instance in moduleState,
+// returning a description of each. Both block devices recorded on the
+// instance itself and other attachments of attachmentType to it are checked,
+// except for attachmentResourceID, the attachment being added.
+func checkDeviceInUse(moduleState *terraform.ModuleState, attachmentType, instanceResourceID, instanceID,
+	deviceName, attachmentResourceID string) []string {
+
+	var conflicts []string
+
+	// "ebs_block_device" and "root_block_device" entries on the instance
+	if instanceState := moduleState.Resources[instanceResourceID]; instanceState != nil && instanceState.Primary != nil {
+		for key, value := range instanceState.Primary.Attributes {
+			if !strings.HasSuffix(key, ".device_name") || value != deviceName {
+				continue
+			}
+			if blockType := strings.SplitN(key, ".", 2)[0]; blockType == "ebs_block_device" || blockType == "root_block_device" {
+				conflicts = append(conflicts, fmt.Sprintf("%s already has %s in its %s",
+					instanceResourceID, deviceName, blockType))
+			}
+		}
+	}
+
+	// Other attachments to the same instance
+	for resourceID, resourceState := range moduleState.Resources {
+		if resourceID == attachmentResourceID || resourceState.Type != attachmentType ||
+			resourceState.Primary == nil {
+			continue
+		}
+		attributes := resourceState.Primary.Attributes
+		if attributes["instance_id"] == instanceID && attributes["device_name"] == deviceName {
+			conflicts = append(conflicts, fmt.Sprintf("%s already attaches %s to %s as %s",
+				resourceID, attributes["volume_id"], instanceID, deviceName))
+		}
+	}
+
+	sort.Strings(conflicts)
+	return conflicts
+}
+
+// Find attachments of attachmentType anywhere in tfstate, other than
+// attachmentResourceID in the module at modulePath, that already attach
+// volumeID to instanceID as deviceName, i.e. the same attachment imported
+// under another name. Returns their addresses.
+func checkSameAttachmentElsewhere(tfstate *terraform.State, attachmentType string, modulePath []string,
+	attachmentResourceID, instanceID, volumeID, deviceName string) []string {
+
+	var addresses []string
+	for _, moduleState := range tfstate.Modules {
+		for resourceID, resourceState := range moduleState.Resources {
+			if resourceState.Type != attachmentType || resourceState.Primary == nil ||
+				(resourceID == attachmentResourceID && reflect.DeepEqual(moduleState.Path, modulePath)) {
+				continue
+			}
+			attributes := resourceState.Primary.Attributes
+			if attributes["instance_id"] == instanceID && attributes["volume_id"] == volumeID &&
+				attributes["device_name"] == deviceName {
+				addresses = append(addresses, resourceAddress(moduleState.Path, resourceID))
+			}
+		}
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// Describe the mismatch if the instance and volume record different
+// availability zones, since a volume can only attach within its own. Returns
+// "" if they match or either zone isn't in the state.
+func checkAvailabilityZones(instanceResourceID string, instanceState *terraform.ResourceState,
+	volumeResourceID string, volumeState *terraform.ResourceState) string {
+
+	if instanceState.Primary == nil || volumeState.Primary == nil {
+		return ""
+	}
+	instanceZone := instanceState.Primary.Attributes["availability_zone"]
+	volumeZone := volumeState.Primary.Attributes["availability_zone"]
+	if instanceZone == "" || volumeZone == "" || instanceZone == volumeZone {
+		return ""
+	}
+	return fmt.Sprintf("%s is in %s but %s is in %s",
+		volumeResourceID, volumeZone, instanceResourceID, instanceZone)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/hashicorp/terraform/terraform"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckVolumeAttachedElsewhere(t *testing.T) {
+	const (
+		instanceID = "i-0598c7d356eba48d7"
+		volumeID   = "vol-049df61146c4d7901"
+	)
+
+	tests := []struct {
+		name         string
+		modify       func(resources map[string]*terraform.ResourceState)
+		wantWarnings []string
+	}{
+		{
+			name:   "no conflicts",
+			modify: func(map[string]*terraform.ResourceState) {},
+		},
+		{
+			name: "volume attachment set",
+			modify: func(resources map[string]*terraform.ResourceState) {
+				attributes := resources["aws_ebs_volume.mysrv_dsk0"].Primary.Attributes
+				attributes["attachment.#"] = "1"
+				attributes["attachment.0.instance_id"] = "i-0ffffffffffffffff"
+			},
+			wantWarnings: []string{"aws_ebs_volume.mysrv_dsk0 records an attachment to instance i-0ffffffffffffffff"},
+		},
+		{
+			name: "volume attachment set on our instance",
+			modify: func(resources map[string]*terraform.ResourceState) {
+				attributes := resources["aws_ebs_volume.mysrv_dsk0"].Primary.Attributes
+				attributes["attachment.#"] = "1"
+				attributes["attachment.0.instance_id"] = instanceID
+			},
+		},
+		{
+			name: "ebs_block_device of another instance",
+			modify: func(resources map[string]*terraform.ResourceState) {
+				resources["aws_instance.other"] = &terraform.ResourceState{
+					Type: "aws_instance",
+					Primary: &terraform.InstanceState{
+						ID: "i-0ffffffffffffffff",
+						Attributes: map[string]string{
+							"ebs_block_device.#":                    "1",
+							"ebs_block_device.2576023345.volume_id": volumeID,
+						},
+					},
+				}
+			},
+			wantWarnings: []string{"aws_instance.other (i-0ffffffffffffffff) has vol-049df61146c4d7901 as an ebs_block_device"},
+		},
+		{
+			name: "attachment to another instance",
+			modify: func(resources map[string]*terraform.ResourceState) {
+				resources["aws_volume_attachment.other"] = &terraform.ResourceState{
+					Type: "aws_volume_attachment",
+					Primary: &terraform.InstanceState{
+						ID: "vai-1",
+						Attributes: map[string]string{
+							"instance_id": "i-0ffffffffffffffff",
+							"volume_id":   volumeID,
+						},
+					},
+				}
+			},
+			wantWarnings: []string{"aws_volume_attachment.other attaches vol-049df61146c4d7901 to instance i-0ffffffffffffffff"},
+		},
+		{
+			name: "attachment being replaced",
+			modify: func(resources map[string]*terraform.ResourceState) {
+				resources["aws_volume_attachment.mysrv_dsk0_attch"] = &terraform.ResourceState{
+					Type: "aws_volume_attachment",
+					Primary: &terraform.InstanceState{
+						ID: "vai-1",
+						Attributes: map[string]string{
+							"instance_id": "i-0ffffffffffffffff",
+							"volume_id":   volumeID,
+						},
+					},
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tfstate := loadTfState(t, "single-module.tfstate")
+			moduleState := tfstate.Modules[0]
+			tt.modify(moduleState.Resources)
+
+			warnings := checkVolumeAttachedElsewhere(moduleState, resourceTypes{}, "aws_ebs_volume.mysrv_dsk0",
+				volumeID, instanceID, "aws_volume_attachment.mysrv_dsk0_attch")
+			if !reflect.DeepEqual(warnings, tt.wantWarnings) {
+				t.Errorf("warnings = %q, want %q", warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestCheckDeviceInUse(t *testing.T) {
+	const instanceID = "i-0598c7d356eba48d7"
+
+	tests := []struct {
+		name          string
+		deviceName    string
+		modify        func(attributes map[string]string)
+		wantConflicts []string
+	}{
+		{
+			name:       "device free",
+			deviceName: "/dev/sdg",
+			modify:     func(map[string]string) {},
+		},
+		{
+			name:       "ebs_block_device on the instance",
+			deviceName: "/dev/sdg",
+			modify: func(attributes map[string]string) {
+				attributes["ebs_block_device.#"] = "1"
+				attributes["ebs_block_device.2576023345.device_name"] = "/dev/sdg"
+			},
+			wantConflicts: []string{"aws_instance.mysrv already has /dev/sdg in its ebs_block_device"},
+		},
+		{
+			name:       "root_block_device on the instance",
+			deviceName: "/dev/xvda",
+			modify: func(attributes map[string]string) {
+				attributes["root_block_device.#"] = "1"
+				attributes["root_block_device.0.device_name"] = "/dev/xvda"
+			},
+			wantConflicts: []string{"aws_instance.mysrv already has /dev/xvda in its root_block_device"},
+		},
+		{
+			name:          "another attachment",
+			deviceName:    "/dev/sdf",
+			modify:        func(map[string]string) {},
+			wantConflicts: []string{"aws_volume_attachment.mysrv_dsk0_attch already attaches vol-049df61146c4d7901 to i-0598c7d356eba48d7 as /dev/sdf"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tfstate := loadTfState(t, "attached.tfstate")
+			moduleState := tfstate.Modules[0]
+			tt.modify(moduleState.Resources["aws_instance.mysrv"].Primary.Attributes)
+
+			conflicts := checkDeviceInUse(moduleState, "aws_volume_attachment", "aws_instance.mysrv", instanceID,
+				tt.deviceName, "aws_volume_attachment.new_attch")
+			if !reflect.DeepEqual(conflicts, tt.wantConflicts) {
+				t.Errorf("got %q, want %q", conflicts, tt.wantConflicts)
+			}
+		})
+	}
+}
+
+// Renamed resource types, as with --instance-type and --attachment-type, are
+// checked like the default ones
+func TestChecksResourceTypes(t *testing.T) {
+	const (
+		instanceID = "i-0598c7d356eba48d7"
+		volumeID   = "vol-049df61146c4d7901"
+	)
+	tfstate := loadTfState(t, "attached.tfstate")
+	moduleState := tfstate.Modules[0]
+	rename := func(from, to, resourceType string) {
+		resourceState := moduleState.Resources[from]
+		resourceState.Type = resourceType
+		moduleState.Resources[to] = resourceState
+		delete(moduleState.Resources, from)
+	}
+	rename("aws_instance.mysrv", "wrapped_instance.mysrv", "wrapped_instance")
+	rename("aws_volume_attachment.mysrv_dsk0_attch", "wrapped_attachment.mysrv_dsk0_attch", "wrapped_attachment")
+	moduleState.Resources["wrapped_instance.other"] = &terraform.ResourceState{
+		Type: "wrapped_instance",
+		Primary: &terraform.InstanceState{
+			ID: "i-0ffffffffffffffff",
+			Attributes: map[string]string{
+				"ebs_block_device.#":                    "1",
+				"ebs_block_device.2576023345.volume_id": volumeID,
+			},
+		},
+	}
+	types := resourceTypes{instance: "wrapped_instance", attachment: "wrapped_attachment"}
+
+	warnings := checkVolumeAttachedElsewhere(moduleState, types, "aws_ebs_volume.mysrv_dsk0", volumeID,
+		"i-0ffffffffffffff00", "wrapped_attachment.new_attch")
+	wantWarnings := []string{
+		"wrapped_attachment.mysrv_dsk0_attch attaches vol-049df61146c4d7901 to instance i-0598c7d356eba48d7",
+		"wrapped_instance.other (i-0ffffffffffffffff) has vol-049df61146c4d7901 as an ebs_block_device",
+	}
+	if !reflect.DeepEqual(warnings, wantWarnings) {
+		t.Errorf("warnings = %q, want %q", warnings, wantWarnings)
+	}
+
+	conflicts := checkDeviceInUse(moduleState, "wrapped_attachment", "wrapped_instance.mysrv", instanceID,
+		"/dev/sdf", "wrapped_attachment.new_attch")
+	wantConflicts := []string{
+		"wrapped_attachment.mysrv_dsk0_attch already attaches vol-049df61146c4d7901 to i-0598c7d356eba48d7 as /dev/sdf",
+	}
+	if !reflect.DeepEqual(conflicts, wantConflicts) {
+		t.Errorf("conflicts = %q, want %q", conflicts, wantConflicts)
+	}
+}
+
+func TestInjectVolumeAttachmentDeviceInUse(t *testing.T) {
+	tfstate := loadTfState(t, "attached.tfstate")
+	params := injectParams{
+		instanceName: "mysrv", volumeName: "mysrv_dsk0",
+		attachmentName: "new_attch", deviceName: "/dev/sdf",
+	}
+	if _, err := injectVolumeAttachment(params, tfstate); err == nil {
+		t.Error("expected an error for a device that's already attached")
+	}
+
+	var warnings bytes.Buffer
+	verboseOutput = &warnings
+	defer func() { verboseOutput = os.Stderr }()
+	params.force = true
+	if _, err := injectVolumeAttachment(params, tfstate); err != nil {
+		t.Errorf("unexpected error with --force: %s", err)
+	}
+	if !strings.Contains(warnings.String(), "already attaches") {
+		t.Errorf("missing warning, got %q", warnings.String())
+	}
+}
+
+func TestInjectVolumeAttachmentDuplicate(t *testing.T) {
+	tfstate := loadTfState(t, "attached.tfstate")
+	params := injectParams{
+		instanceName: "mysrv", volumeName: "mysrv_dsk0",
+		attachmentName: "renamed_attch", deviceName: "/dev/sdf",
+	}
+	_, err := injectVolumeAttachment(params, tfstate)
+	if !errors.Is(err, errDuplicateAttachment) {
+		t.Fatalf("got %v, want errDuplicateAttachment", err)
+	}
+	if !strings.Contains(err.Error(), "aws_volume_attachment.mysrv_dsk0_attch already attaches") {
+		t.Errorf("error doesn't name the existing attachment: %s", err)
+	}
+
+	// The same triple under its existing name is just already present
+	params.attachmentName = "mysrv_dsk0_attch"
+	if _, err := injectVolumeAttachment(params, tfstate); errors.Is(err, errDuplicateAttachment) {
+		t.Errorf("unexpected error for the existing attachment: %s", err)
+	}
+
+	var warnings bytes.Buffer
+	verboseOutput = &warnings
+	defer func() { verboseOutput = os.Stderr }()
+	params.attachmentName, params.force = "renamed_attch", true
+	if _, err := injectVolumeAttachment(params, tfstate); err != nil {
+		t.Errorf("unexpected error with --force: %s", err)
+	}
+	if !strings.Contains(warnings.String(), "aws_volume_attachment.mysrv_dsk0_attch already attaches") {
+		t.Errorf("missing warning, got %q", warnings.String())
+	}
+}
+
+func TestCheckAvailabilityZones(t *testing.T) {
+	tests := []struct {
+		name                     string
+		instanceZone, volumeZone string
+		want                     string
+	}{
+		{"same zone", "eu-west-1a", "eu-west-1a", ""},
+		{"different zones", "eu-west-1b", "eu-west-1a",
+			"aws_ebs_volume.mysrv_dsk0 is in eu-west-1a but aws_instance.mysrv is in eu-west-1b"},
+		{"instance zone missing", "", "eu-west-1a", ""},
+		{"volume zone missing", "eu-west-1b", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tfstate := loadTfState(t, "single-module.tfstate")
+			instanceState, _ := findResource(tfstate, "aws_instance.mysrv")
+			volumeState, _ := findResource(tfstate, "aws_ebs_volume.mysrv_dsk0")
+			setOrDelete(instanceState.Primary.Attributes, "availability_zone", tt.instanceZone)
+			setOrDelete(volumeState.Primary.Attributes, "availability_zone", tt.volumeZone)
+
+			got := checkAvailabilityZones("aws_instance.mysrv", instanceState,
+				"aws_ebs_volume.mysrv_dsk0", volumeState)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func setOrDelete(attributes map[string]string, key, value string) {
+	if value == "" {
+		delete(attributes, key)
+	} else {
+		attributes[key] = value
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docopt/docopt-go"
+	"github.com/hashicorp/terraform/terraform"
+	"os"
+	"sort"
+	"strings"
+)
+
+// An attachment as reported by "aws ec2 describe-volumes"
+type awsAttachment struct {
+	Device     string `json:"Device"`
+	InstanceID string `json:"InstanceId"`
+	State      string `json:"State"`
+	VolumeID   string `json:"VolumeId"`
+}
+
+// An attachment in the state whose recorded attributes don't match AWS
+type attachmentDrift struct {
+	address string
+	problem string
+	state   map[string]string
+	actual  map[string]string
+}
+
+// Diff each attachment in the state read from "-i" against what EC2 reports
+// for its volume, exiting with diffChangesExitCode if any of them drifted
+func compareAWSMode(ctx context.Context, opts docopt.Opts) {
+	tfstate, _ := readTfStateFile(ctx, opts)
+	aws := awsCLIFromOpts(opts, tfstate)
+	types := resourceTypesFromOpts(opts).withDefaults()
+
+	var volumeIDs []string
+	for _, moduleState := range tfstate.Modules {
+		for _, resourceState := range moduleState.Resources {
+			if resourceState.Type == types.attachment && resourceState.Primary != nil {
+				volumeIDs = append(volumeIDs, resourceState.Primary.Attributes["volume_id"])
+			}
+		}
+	}
+	if len(volumeIDs) == 0 {
+		fmt.Fprint(os.Stderr, "No attachments in the state\n")
+		return
+	}
+	volumes, err := describeVolumes(ctx, aws, volumeIDs)
+	if err != nil {
+		exitIfTimedOut(ctx)
+		die("%s", err)
+	}
+
+	drifts := findAttachmentDrift(tfstate, types.attachment, volumes)
+	var output strings.Builder
+	for _, drift := range drifts {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", drift.address, drift.problem)
+		stateBytes, _ := json.MarshalIndent(drift.state, "", "    ")
+		actualBytes, _ := json.MarshalIndent(drift.actual, "", "    ")
+		output.WriteString(drift.address + ":\n")
+		output.WriteString(renderJSONDiff(opts, stateBytes, actualBytes, os.Stdout))
+	}
+	if len(drifts) == 0 {
+		fmt.Fprint(os.Stderr, "No drift, every attachment matches AWS\n")
+		return
+	}
+	printPaged(opts, output.String())
+	emitMetrics("")
+	os.Exit(diffChangesExitCode)
+}
+
+// Run "aws ec2 describe-volumes" for volumeIDs, returning the attachments of
+// each volume that exists, keyed by volume ID. Volumes that no longer exist
+// are missing from the result rather than an error.
+func describeVolumes(ctx context.Context, aws awsCLI, volumeIDs []string) (map[string][]awsAttachment, error) {
+	output, err := aws.run(ctx, "ec2 describe-volumes", "--filters", "Name=volume-id,Values="+strings.Join(volumeIDs, ","))
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Volumes []struct {
+			VolumeID    string          `json:"VolumeId"`
+			Attachments []awsAttachment `json:"Attachments"`
+		} `json:"Volumes"`
+	}
+	if err := json.Unmarshal(output, &response); err != nil {
+		return nil, fmt.Errorf("Error parsing describe-volumes output as JSON: %s", err)
+	}
+	volumes := make(map[string][]awsAttachment)
+	for _, volume := range response.Volumes {
+		volumes[volume.VolumeID] = append([]awsAttachment{}, volume.Attachments...)
+	}
+	return volumes, nil
+}
+
+// Compare the attachments of attachmentType in tfstate with volumes as
+// returned by describeVolumes. Results are ordered by address.
+func findAttachmentDrift(tfstate *terraform.State, attachmentType string,
+	volumes map[string][]awsAttachment) []attachmentDrift {
+
+	var drifts []attachmentDrift
+	for _, moduleState := range tfstate.Modules {
+		metrics.ModulesScanned++
+		for resourceID, resourceState := range moduleState.Resources {
+			if resourceState.Type != attachmentType || resourceState.Primary == nil {
+				continue
+			}
+			attributes := resourceState.Primary.Attributes
+			state := map[string]string{
+				"device_name": attributes["device_name"],
+				"instance_id": attributes["instance_id"],
+				"volume_id":   attributes["volume_id"],
+			}
+			attachments, found := volumes[state["volume_id"]]
+			drift := attachmentDrift{
+				address: resourceAddress(moduleState.Path, resourceID),
+				state:   state,
+				actual:  map[string]string{},
+			}
+
+			switch {
+			case !found:
+				drift.problem = fmt.Sprintf("volume %s no longer exists", state["volume_id"])
+			case len(attachments) == 0:
+				drift.problem = fmt.Sprintf("volume %s is detached", state["volume_id"])
+			default:
+				// Prefer the attachment to the recorded instance, if any
+				actual := attachments[0]
+				for _, attachment := range attachments {
+					if attachment.InstanceID == state["instance_id"] {
+						actual = attachment
+					}
+				}
+				drift.actual = map[string]string{
+					"device_name": actual.Device,
+					"instance_id": actual.InstanceID,
+					"volume_id":   actual.VolumeID,
+				}
+				if actual.InstanceID != state["instance_id"] {
+					drift.problem = fmt.Sprintf("volume %s is attached to %s instead",
+						state["volume_id"], actual.InstanceID)
+				} else if actual.Device != state["device_name"] {
+					drift.problem = fmt.Sprintf("volume %s is attached as %s instead of %s",
+						state["volume_id"], actual.Device, state["device_name"])
+				} else if actual.State != "attached" && actual.State != "attaching" {
+					drift.problem = fmt.Sprintf("volume %s is %s", state["volume_id"], actual.State)
+				}
+			}
+			if drift.problem != "" {
+				drifts = append(drifts, drift)
+			}
+		}
+	}
+	sort.Slice(drifts, func(i, j int) bool { return drifts[i].address < drifts[j].address })
+	return drifts
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDescribeVolumes(t *testing.T) {
+	// A stand-in for the AWS CLI that checks its arguments
+	fakeAWS := `f() { test "$*" = "ec2 describe-volumes --region eu-west-1 --output json --filters Name=volume-id,Values=vol-1,vol-2" &&
+		cat testdata/describe-volumes.json; }; f`
+	aws := awsCLI{command: fakeAWS, region: "eu-west-1"}
+	volumes, err := describeVolumes(context.Background(), aws, []string{"vol-1", "vol-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]awsAttachment{
+		"vol-049df61146c4d7901": {{"/dev/sdf", "i-0598c7d356eba48d7", "attached", "vol-049df61146c4d7901"}},
+	}
+	if !reflect.DeepEqual(volumes, want) {
+		t.Errorf("got %v, want %v", volumes, want)
+	}
+
+	aws.command = "false"
+	if _, err := describeVolumes(context.Background(), aws, []string{"vol-1"}); err == nil {
+		t.Error("expected an error when the AWS CLI fails")
+	}
+}
+
+func TestAWSCLIProfile(t *testing.T) {
+	// The profile reaches the AWS CLI as $AWS_PROFILE
+	aws := awsCLI{command: `f() { test "$AWS_PROFILE" = prod && echo '{}'; }; f`, profile: "prod", region: "eu-west-1"}
+	if _, err := aws.run(context.Background(), "sts get-caller-identity"); err != nil {
+		t.Error(err)
+	}
+
+	// Missing credentials are reported plainly
+	aws.command = `f() { echo "Unable to locate credentials. You can configure credentials by running \"aws configure\"." >&2; false; }; f`
+	_, err := aws.run(context.Background(), "ec2 describe-volumes")
+	if err == nil || !strings.Contains(err.Error(), "No usable AWS credentials for profile prod") {
+		t.Errorf("got %v, want a credentials error", err)
+	}
+}
+
+func TestFindAttachmentDrift(t *testing.T) {
+	const volumeID, instanceID = "vol-049df61146c4d7901", "i-0598c7d356eba48d7"
+	tests := []struct {
+		name        string
+		attachments []awsAttachment
+		found       bool
+		wantProblem string
+	}{
+		{"matching", []awsAttachment{{"/dev/sdf", instanceID, "attached", volumeID}}, true, ""},
+		{"deleted volume", nil, false, "volume vol-049df61146c4d7901 no longer exists"},
+		{"detached", nil, true, "volume vol-049df61146c4d7901 is detached"},
+		{"other instance", []awsAttachment{{"/dev/sdf", "i-other", "attached", volumeID}}, true,
+			"volume vol-049df61146c4d7901 is attached to i-other instead"},
+		{"other device", []awsAttachment{{"/dev/sdh", instanceID, "attached", volumeID}}, true,
+			"volume vol-049df61146c4d7901 is attached as /dev/sdh instead of /dev/sdf"},
+		{"detaching", []awsAttachment{{"/dev/sdf", instanceID, "detaching", volumeID}}, true,
+			"volume vol-049df61146c4d7901 is detaching"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			volumes := map[string][]awsAttachment{}
+			if tt.found {
+				volumes[volumeID] = tt.attachments
+			}
+			drifts := findAttachmentDrift(loadTfState(t, "attached.tfstate"), "aws_volume_attachment", volumes)
+			if tt.wantProblem == "" {
+				if len(drifts) != 0 {
+					t.Errorf("unexpected drift %v", drifts)
+				}
+				return
+			}
+			if len(drifts) != 1 {
+				t.Fatalf("got %d drifts, want 1", len(drifts))
+			}
+			if drifts[0].address != "aws_volume_attachment.mysrv_dsk0_attch" || drifts[0].problem != tt.wantProblem {
+				t.Errorf("got %s: %q, want %q", drifts[0].address, drifts[0].problem, tt.wantProblem)
+			}
+		})
+	}
+}
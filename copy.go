@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/docopt/docopt-go"
+	"github.com/hashicorp/terraform/terraform"
+	"strings"
+)
+
+// Copy the attachment <att-addr> from <src-state> into the state read from
+// "-i", writing to "-o"
+func copyMode(ctx context.Context, opts docopt.Opts) {
+	sourceFileName, _ := opts.String("<src-state>")
+	address, _ := opts.String("<att-addr>")
+	targetModulePath, _ := opts.String("--module")
+	recomputeID, _ := opts.Bool("--recompute-id")
+	lenient, _ := opts.Bool("--lenient")
+
+	sourceState, _, err := readTfStatePath(sourceFileName, lenient)
+	if err != nil {
+		die("%s", err)
+	}
+	tfstate, inputBytes := readTfStateFile(ctx, opts)
+
+	attachmentType := resourceTypesFromOpts(opts).attachment
+	moduleState, err := copyVolumeAttachment(sourceState, address, attachmentType, tfstate, targetModulePath,
+		recomputeID)
+	if err != nil {
+		die("%s", err)
+	}
+	prepareOutputState(opts, tfstate)
+
+	confirmWrite(opts, fmt.Sprintf("Copying %s from %s to module %s",
+		address, sourceFileName, strings.Join(moduleState.Path, ".")), false)
+	writeTfStateFile(ctx, opts, tfstate, inputBytes)
+}
+
+// Copy the attachment of attachmentType at address in sourceState into tfstate,
+// returning the module it was added to. The resource is copied verbatim,
+// including attributes like "force_detach" and "skip_destroy", except that
+// its ID is recalculated from its attributes if recomputeID is set. The
+// target module (e.g. "root.app1") defaults to the source module's path.
+func copyVolumeAttachment(sourceState *terraform.State, address, attachmentType string,
+	tfstate *terraform.State, targetModulePath string, recomputeID bool) (*terraform.ModuleState, error) {
+
+	modulePath, resourceID, err := parseResourceAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(resourceID, attachmentType+".") {
+		return nil, fmt.Errorf("\"%s\" is not an %s", address, attachmentType)
+	}
+
+	// Locate the source resource
+	var resourceState *terraform.ResourceState
+	for _, moduleState := range sourceState.Modules {
+		metrics.ModulesScanned++
+		if strings.Join(moduleState.Path, ".") == modulePath {
+			resourceState = moduleState.Resources[resourceID]
+			break
+		}
+	}
+	if resourceState == nil || resourceState.Primary == nil {
+		return nil, fmt.Errorf("Could not locate \"%s\" in source tfstate", address)
+	}
+
+	if recomputeID {
+		attributes := resourceState.Primary.Attributes
+		attachmentID, err := volumeAttachmentID(
+			attributes["device_name"], attributes["volume_id"], attributes["instance_id"])
+		if err != nil {
+			return nil, fmt.Errorf("Error recalculating ID of \"%s\": %s", address, err)
+		}
+		resourceState.Primary.ID = attachmentID
+		attributes["id"] = attachmentID
+	}
+
+	// Insert it into the target module
+	if targetModulePath == "" {
+		targetModulePath = modulePath
+	}
+	for _, moduleState := range tfstate.Modules {
+		metrics.ModulesScanned++
+		if strings.Join(moduleState.Path, ".") != targetModulePath {
+			continue
+		}
+		if _, found := moduleState.Resources[resourceID]; found {
+			return nil, fmt.Errorf("\"%s\" already exists in module %s", resourceID, targetModulePath)
+		}
+		if moduleState.Resources == nil {
+			moduleState.Resources = make(map[string]*terraform.ResourceState)
+		}
+		moduleState.Resources[resourceID] = resourceState
+		metrics.ResourcesAdded++
+		return moduleState, nil
+	}
+	return nil, fmt.Errorf("Could not locate module %s in tfstate", targetModulePath)
+}
+
+// Split a resource address like "module.app1.aws_volume_attachment.foo" into
+// the module path as used by --module ("root.app1") and the key of the
+// resource within the module ("aws_volume_attachment.foo")
+func parseResourceAddress(address string) (string, string, error) {
+	parts := strings.Split(address, ".")
+	modulePath := []string{"root"}
+	for len(parts) > 2 && parts[0] == "module" {
+		modulePath = append(modulePath, parts[1])
+		parts = parts[2:]
+	}
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("Invalid resource address \"%s\"", address)
+	}
+	return strings.Join(modulePath, "."), strings.Join(parts, "."), nil
+}
+
+// Join a module path and resource key into an address like
+// "module.app1.aws_volume_attachment.foo", the inverse of parseResourceAddress
+func resourceAddress(modulePath []string, resourceID string) string {
+	var parts []string
+	for _, name := range modulePath[1:] {
+		parts = append(parts, "module", name)
+	}
+	return strings.Join(append(parts, resourceID), ".")
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseResourceAddress(t *testing.T) {
+	tests := []struct {
+		address        string
+		wantModulePath string
+		wantResourceID string
+		wantErr        bool
+	}{
+		{"aws_volume_attachment.foo", "root", "aws_volume_attachment.foo", false},
+		{"module.app1.aws_volume_attachment.foo", "root.app1", "aws_volume_attachment.foo", false},
+		{"module.a.module.b.aws_volume_attachment.foo", "root.a.b", "aws_volume_attachment.foo", false},
+		{"aws_volume_attachment", "", "", true},
+		{"module.app1.aws_volume_attachment", "", "", true},
+		{"aws_volume_attachment.", "", "", true},
+	}
+
+	for _, tt := range tests {
+		modulePath, resourceID, err := parseResourceAddress(tt.address)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseResourceAddress(%q): expected an error", tt.address)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseResourceAddress(%q): %s", tt.address, err)
+			continue
+		}
+		if modulePath != tt.wantModulePath || resourceID != tt.wantResourceID {
+			t.Errorf("parseResourceAddress(%q) = (%q, %q), want (%q, %q)",
+				tt.address, modulePath, resourceID, tt.wantModulePath, tt.wantResourceID)
+		}
+		if address := resourceAddress(strings.Split(modulePath, "."), resourceID); address != tt.address {
+			t.Errorf("resourceAddress(%q, %q) = %q, want %q", modulePath, resourceID, address, tt.address)
+		}
+	}
+}
+
+func TestCopyVolumeAttachment(t *testing.T) {
+	sourceState := loadTfState(t, "attached.tfstate")
+	source, _ := findResource(sourceState, "aws_volume_attachment.mysrv_dsk0_attch")
+	wantAttributes := make(map[string]string)
+	for k, v := range source.Primary.Attributes {
+		wantAttributes[k] = v
+	}
+
+	tfstate := loadTfState(t, "single-module.tfstate")
+	moduleState, err := copyVolumeAttachment(sourceState, "aws_volume_attachment.mysrv_dsk0_attch", "aws_volume_attachment",
+		tfstate, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(moduleState.Path, []string{"root"}) {
+		t.Errorf("copied into module %v, want [root]", moduleState.Path)
+	}
+
+	copied, _ := findResource(tfstate, "aws_volume_attachment.mysrv_dsk0_attch")
+	if copied == nil {
+		t.Fatal("attachment not found in target state")
+	}
+	if copied.Primary.ID != "vai-1234" {
+		t.Errorf("Primary.ID = %q, want the original vai-1234", copied.Primary.ID)
+	}
+	if !reflect.DeepEqual(copied.Primary.Attributes, wantAttributes) {
+		t.Errorf("Attributes = %v, want %v", copied.Primary.Attributes, wantAttributes)
+	}
+
+	// The attachment is in the target now, so a second copy must fail
+	if _, err := copyVolumeAttachment(sourceState, "aws_volume_attachment.mysrv_dsk0_attch",
+		"aws_volume_attachment", tfstate, "", false); err == nil {
+		t.Error("expected an error when copying over an existing attachment")
+	}
+}
+
+func TestCopyVolumeAttachmentNilResources(t *testing.T) {
+	sourceState := loadTfState(t, "attached.tfstate")
+	tfstate := loadTfState(t, "nil-resources.tfstate")
+	moduleState, err := copyVolumeAttachment(sourceState, "aws_volume_attachment.mysrv_dsk0_attch", "aws_volume_attachment",
+		tfstate, "root.app1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moduleState.Resources["aws_volume_attachment.mysrv_dsk0_attch"] == nil {
+		t.Error("attachment not added to the module with null resources")
+	}
+}
+
+func TestCopyVolumeAttachmentRecomputeID(t *testing.T) {
+	sourceState := loadTfState(t, "attached.tfstate")
+	tfstate := loadTfState(t, "single-module.tfstate")
+	if _, err := copyVolumeAttachment(sourceState, "aws_volume_attachment.mysrv_dsk0_attch",
+		"aws_volume_attachment", tfstate, "root", true); err != nil {
+		t.Fatal(err)
+	}
+
+	copied, _ := findResource(tfstate, "aws_volume_attachment.mysrv_dsk0_attch")
+	wantID, _ := volumeAttachmentID("/dev/sdf", "vol-049df61146c4d7901", "i-0598c7d356eba48d7")
+	if copied.Primary.ID != wantID || copied.Primary.Attributes["id"] != wantID {
+		t.Errorf("ID = %q/%q, want %q", copied.Primary.ID, copied.Primary.Attributes["id"], wantID)
+	}
+	for attribute, want := range map[string]string{"device_name": "/dev/sdf", "force_detach": "true", "skip_destroy": "true"} {
+		if got := copied.Primary.Attributes[attribute]; got != want {
+			t.Errorf("%s = %q, want %q", attribute, got, want)
+		}
+	}
+}
+
+func TestCopyVolumeAttachmentErrors(t *testing.T) {
+	tests := []struct {
+		name, address, targetModulePath string
+	}{
+		{"missing resource", "aws_volume_attachment.other", ""},
+		{"missing source module", "module.app1.aws_volume_attachment.mysrv_dsk0_attch", ""},
+		{"missing target module", "aws_volume_attachment.mysrv_dsk0_attch", "root.app1"},
+		{"wrong resource type", "aws_instance.mysrv", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sourceState := loadTfState(t, "attached.tfstate")
+			tfstate := loadTfState(t, "single-module.tfstate")
+			_, err := copyVolumeAttachment(sourceState, tt.address, "aws_volume_attachment", tfstate,
+				tt.targetModulePath, false)
+			if err == nil {
+				t.Error("expected an error, got none")
+			}
+		})
+	}
+}
+
+func TestCopyVolumeAttachmentType(t *testing.T) {
+	sourceState := loadTfState(t, "attached.tfstate")
+	moduleState := sourceState.Modules[0]
+	moduleState.Resources["wrapped_attachment.mysrv_dsk0_attch"] = moduleState.Resources["aws_volume_attachment.mysrv_dsk0_attch"]
+	delete(moduleState.Resources, "aws_volume_attachment.mysrv_dsk0_attch")
+
+	tfstate := loadTfState(t, "single-module.tfstate")
+	if _, err := copyVolumeAttachment(sourceState, "wrapped_attachment.mysrv_dsk0_attch", "aws_volume_attachment",
+		tfstate, "", false); err == nil {
+		t.Error("expected an error copying a wrapped_attachment as aws_volume_attachment")
+	}
+	if _, err := copyVolumeAttachment(sourceState, "wrapped_attachment.mysrv_dsk0_attch", "wrapped_attachment",
+		tfstate, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if copied, _ := findResource(tfstate, "wrapped_attachment.mysrv_dsk0_attch"); copied == nil {
+		t.Error("attachment not found in target state under its custom type")
+	}
+}
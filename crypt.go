@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/hashicorp/terraform/terraform"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// Run command through the shell with input on its stdin, returning what it
+// writes to stdout. Used for "--decrypt-cmd" and "--encrypt-cmd", so the
+// output is kept in memory rather than in a file.
+func runFilterCommand(command string, input io.Reader) ([]byte, error) {
+	var output bytes.Buffer
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = input
+	cmd.Stdout, cmd.Stderr = &output, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Error running \"%s\": %s", command, err)
+	}
+	return output.Bytes(), nil
+}
+
+// Read tfstate from r as readTfState does, first decrypting it with
+// decryptCommand unless that's empty
+func readEncryptedTfState(r io.Reader, decryptCommand string, lenient bool) (*terraform.State, []byte, error) {
+	if decryptCommand == "" {
+		return readTfState(r, lenient)
+	}
+	plaintext, err := runFilterCommand(decryptCommand, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return readTfState(bytes.NewReader(plaintext), lenient)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestRunFilterCommand(t *testing.T) {
+	output, err := runFilterCommand("tr a-z A-Z", strings.NewReader("state\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != "STATE\n" {
+		t.Errorf("got %q", output)
+	}
+	if _, err := runFilterCommand("exit 3", strings.NewReader("")); err == nil {
+		t.Error("expected an error for a failing command")
+	}
+}
+
+func TestReadEncryptedTfState(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/single-module.tfstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+	tfstate, inputData, err := readEncryptedTfState(strings.NewReader(encoded), "base64 -d", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(inputData) != string(data) || tfstate.Serial != 4 {
+		t.Errorf("decrypted state doesn't match the fixture: serial %d", tfstate.Serial)
+	}
+
+	// Without a command the input is parsed as it is
+	if _, _, err := readEncryptedTfState(strings.NewReader(encoded), "", false); err == nil {
+		t.Error("expected an error parsing the encoded state directly")
+	}
+}
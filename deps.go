@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"github.com/docopt/docopt-go"
+	"github.com/hashicorp/terraform/terraform"
+	"regexp"
+	"sort"
+)
+
+// A dependency as recorded in a version 3 state, relative to its module:
+// "type.name", "data.type.name", either with a count index such as ".0" or
+// ".*", or "module.name"
+var dependencyPattern = regexp.MustCompile(
+	`^((data\.)?[A-Za-z_][A-Za-z0-9_-]*\.[A-Za-z_][A-Za-z0-9_-]*(\.([0-9]+|\*))?|module\.[A-Za-z_][A-Za-z0-9_-]*)$`)
+
+// Check that each "--extra-dep" value looks like a dependency address
+func parseExtraDeps(addresses []string) ([]string, error) {
+	for _, address := range addresses {
+		if !dependencyPattern.MatchString(address) {
+			return nil, fmt.Errorf("Invalid --extra-dep \"%s\", expected a resource address relative to "+
+				"the module such as \"null_resource.format\"", address)
+		}
+	}
+	return addresses, nil
+}
+
+// The "--extra-dep" values in opts
+func extraDepsFromOpts(opts docopt.Opts) []string {
+	addresses, _ := opts["--extra-dep"].([]string)
+	deps, err := parseExtraDeps(addresses)
+	if err != nil {
+		die("%s", err)
+	}
+	return deps
+}
+
+// Add deps to the dependencies of resourceState, after the instance and
+// volume found automatically. Duplicates are dropped and the result is
+// sorted, as terraform itself writes them.
+func applyExtraDeps(resourceState *terraform.ResourceState, deps []string) {
+	seen := make(map[string]bool)
+	for _, dep := range resourceState.Dependencies {
+		seen[dep] = true
+	}
+	for _, dep := range deps {
+		if !seen[dep] {
+			resourceState.Dependencies = append(resourceState.Dependencies, dep)
+			seen[dep] = true
+		}
+	}
+	sort.Strings(resourceState.Dependencies)
+}
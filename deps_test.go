@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseExtraDeps(t *testing.T) {
+	for _, address := range []string{
+		"null_resource.format",
+		"aws_kms_key.ebs",
+		"data.aws_kms_key.ebs",
+		"null_resource.format.0",
+		"null_resource.format.*",
+		"module.disks",
+	} {
+		if _, err := parseExtraDeps([]string{address}); err != nil {
+			t.Errorf("%q: %s", address, err)
+		}
+	}
+	for _, address := range []string{
+		"",
+		"null_resource",
+		"null_resource.",
+		"module.disks.null_resource.format",
+		"null_resource.format[0]",
+		"aws_kms_key.ebs extra",
+	} {
+		if _, err := parseExtraDeps([]string{address}); err == nil {
+			t.Errorf("%q: expected an error", address)
+		}
+	}
+}
+
+func TestInjectVolumeAttachmentExtraDeps(t *testing.T) {
+	tfstate := loadTfState(t, "single-module.tfstate")
+	params := injectParams{
+		instanceName: "mysrv", volumeName: "mysrv_dsk0",
+		attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+		extraDeps: []string{"null_resource.format", "aws_ebs_volume.mysrv_dsk0", "aws_kms_key.ebs"},
+	}
+	moduleState, err := injectVolumeAttachment(params, tfstate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"aws_ebs_volume.mysrv_dsk0",
+		"aws_instance.mysrv",
+		"aws_kms_key.ebs",
+		"null_resource.format",
+	}
+	got := moduleState.Resources["aws_volume_attachment.mysrv_dsk0_attch"].Dependencies
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Dependencies = %v, want %v", got, want)
+	}
+}
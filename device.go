@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"github.com/docopt/docopt-go"
+	"strings"
+)
+
+// Device names that usually hold an instance's root volume, which belongs to
+// the instance rather than to an aws_volume_attachment. Checked with
+// "--strict-device".
+var reservedDeviceNames = []string{"/dev/sda", "/dev/sda1", "/dev/xvda"}
+
+// Read "<dev>" from opts, expanding a bare device suffix like "sdg" to its
+// canonical form (e.g. "/dev/sdg") unless "--no-normalize-device" is given.
+// The "vai-" hash depends on the exact string, so normalization is reported.
+func deviceNameFromOpts(opts docopt.Opts) string {
+	deviceName, _ := opts.String("<dev>")
+	return normalizeDeviceNameFromOpts(opts, deviceName)
+}
+
+// Normalize deviceName as deviceNameFromOpts does for "<dev>"
+func normalizeDeviceNameFromOpts(opts docopt.Opts, deviceName string) string {
+	if isNVMeDeviceName(deviceName) {
+		warnf("\"%s\" is the OS name of a Nitro NVMe volume, but the ID must use the "+
+			"device_name AWS records, as in your Terraform code (e.g. \"/dev/sdf\")", deviceName)
+	}
+	if noNormalize, _ := opts.Bool("--no-normalize-device"); noNormalize {
+		return deviceName
+	}
+
+	prefix, _ := opts.String("--device-prefix")
+	normalized, changed := normalizeDeviceName(deviceName, prefix)
+	if changed {
+		warnf("using device name \"%s\" for \"%s\" (use --no-normalize-device to keep it as given)",
+			normalized, deviceName)
+	}
+	return normalized
+}
+
+// Prepend prefix to deviceName unless it's already an absolute path. Returns
+// the resulting name and whether it differs from deviceName.
+func normalizeDeviceName(deviceName, prefix string) (string, bool) {
+	if deviceName == "" || strings.HasPrefix(deviceName, "/") {
+		return deviceName, false
+	}
+	if prefix == "" {
+		prefix = "/dev/"
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix + deviceName, true
+}
+
+// Whether deviceName is an NVMe block device such as "/dev/nvme1n1" or
+// "nvme1n1". These are accepted as given, but on Nitro instances they are the
+// kernel's name for the volume rather than the name it was attached as.
+func isNVMeDeviceName(deviceName string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(deviceName, "/dev/"), "nvme")
+}
+
+// Refuse deviceName if it's one of reservedDeviceNames, or just warn if
+// allowReserved is set
+func checkReservedDevice(deviceName string, allowReserved bool) error {
+	for _, reserved := range reservedDeviceNames {
+		if deviceName != reserved {
+			continue
+		}
+		if !allowReserved {
+			return fmt.Errorf("Device \"%s\" is reserved for the root volume, which shouldn't be managed "+
+				"as an attachment (reserved: %s; use --allow-reserved-device to add it anyway)",
+				deviceName, strings.Join(reservedDeviceNames, ", "))
+		}
+		warnf("device \"%s\" is usually the root volume", deviceName)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import "testing"
+
+func TestNormalizeDeviceName(t *testing.T) {
+	tests := []struct {
+		deviceName, prefix string
+		want               string
+		wantChanged        bool
+	}{
+		{"sdg", "/dev/", "/dev/sdg", true},
+		{"/dev/sdg", "/dev/", "/dev/sdg", false},
+		{"xvdf", "/dev/", "/dev/xvdf", true},
+		{"xvdf", "", "/dev/xvdf", true},
+		{"xvdf", "/dev/disk", "/dev/disk/xvdf", true},
+		{"/dev/xvdf", "/dev/disk/", "/dev/xvdf", false},
+		{"", "/dev/", "", false},
+	}
+
+	for _, tt := range tests {
+		got, changed := normalizeDeviceName(tt.deviceName, tt.prefix)
+		if got != tt.want || changed != tt.wantChanged {
+			t.Errorf("normalizeDeviceName(%q, %q) = (%q, %v), want (%q, %v)",
+				tt.deviceName, tt.prefix, got, changed, tt.want, tt.wantChanged)
+		}
+	}
+}
+
+// Normalization must happen before hashing, so "sdg" and "/dev/sdg" yield the
+// same attachment ID while an un-normalized "sdg" doesn't
+func TestNormalizedDeviceNameID(t *testing.T) {
+	normalized, _ := normalizeDeviceName("sdg", "/dev/")
+	want, _ := volumeAttachmentID("/dev/sdg", "vol-123abc", "i-abc123")
+	if got, _ := volumeAttachmentID(normalized, "vol-123abc", "i-abc123"); got != want {
+		t.Errorf("ID for normalized \"sdg\" = %s, want %s", got, want)
+	}
+	if got, _ := volumeAttachmentID("sdg", "vol-123abc", "i-abc123"); got == want {
+		t.Errorf("ID for bare \"sdg\" unexpectedly equals %s", want)
+	}
+}
+
+func TestIsNVMeDeviceName(t *testing.T) {
+	tests := []struct {
+		deviceName string
+		want       bool
+	}{
+		{"/dev/nvme1n1", true},
+		{"nvme0n1p1", true},
+		{"/dev/sdf", false},
+		{"/dev/xvdf", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := isNVMeDeviceName(tt.deviceName); got != tt.want {
+			t.Errorf("isNVMeDeviceName(%q) = %v, want %v", tt.deviceName, got, tt.want)
+		}
+	}
+}
+
+// NVMe names must be usable as-is, including for the ID
+func TestNormalizeNVMeDeviceName(t *testing.T) {
+	got, changed := normalizeDeviceName("/dev/nvme1n1", "/dev/")
+	if got != "/dev/nvme1n1" || changed {
+		t.Errorf("normalizeDeviceName(\"/dev/nvme1n1\") = (%q, %v)", got, changed)
+	}
+	if _, err := volumeAttachmentID(got, "vol-123abc", "i-abc123"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckReservedDevice(t *testing.T) {
+	for _, deviceName := range reservedDeviceNames {
+		if err := checkReservedDevice(deviceName, false); err == nil {
+			t.Errorf("%q: expected an error", deviceName)
+		}
+		if err := checkReservedDevice(deviceName, true); err != nil {
+			t.Errorf("%q with allowReserved: %s", deviceName, err)
+		}
+	}
+	for _, deviceName := range []string{"/dev/sdf", "/dev/xvdf", "/dev/sda2", "sda1"} {
+		if err := checkReservedDevice(deviceName, false); err != nil {
+			t.Errorf("%q: %s", deviceName, err)
+		}
+	}
+}
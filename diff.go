@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docopt/docopt-go"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/mattn/go-isatty"
+	"github.com/yudai/gojsondiff"
+	"github.com/yudai/gojsondiff/formatter"
+	"golang.org/x/term"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Exit status of "diff --check" when the import would change the state, as
+// with "terraform plan -detailed-exitcode"
+const diffChangesExitCode = 2
+
+// Line that "diff --emit-both" prints between the diff and the resulting
+// state, for tools that split the two apart
+const emitBothSeparator = "=== tf-ebs-attach: resulting state ==="
+
+// Show a text diff between the current tfstate ("-i") and the result of importing
+// the attachment specified in opts
+func diffMode(ctx context.Context, opts docopt.Opts) {
+	if againstFileName, _ := opts.String("--against"); againstFileName != "" {
+		diffAgainstMode(ctx, opts, againstFileName)
+		return
+	}
+	if compareAWS, _ := opts.Bool("--compare-aws"); compareAWS {
+		compareAWSMode(ctx, opts)
+		return
+	}
+
+	// Read and modify tfstate
+	tfstate, inputBytes := readTfStateFile(ctx, opts)
+	added := make(map[string]*terraform.ResourceState)
+	anyChanged := false
+	for _, params := range newInjectParams(opts, tfstate) {
+		moduleState, changed, err := injectVolumeAttachmentChanged(params, tfstate)
+		if err != nil {
+			die("%s", err)
+		}
+		attachmentResourceID := params.attachmentResourceID()
+		added[attachmentResourceID] = moduleState.Resources[attachmentResourceID]
+		anyChanged = anyChanged || changed
+	}
+
+	// With --check, only report whether anything changed, ignoring the serial
+	emitBoth, _ := opts.Bool("--emit-both")
+	if check, _ := opts.Bool("--check"); check {
+		if emitBoth {
+			die("--emit-both can't be used with --check, which prints no diff", nil)
+		}
+		if !anyChanged {
+			fmt.Fprint(os.Stderr, "No changes, the attachments are already in the state\n")
+			return
+		}
+		fmt.Fprint(os.Stderr, "Changes: importing would modify the state\n")
+		emitMetrics("")
+		os.Exit(diffChangesExitCode)
+	}
+	// Importing nothing leaves the state as it is, serial included
+	if !anyChanged {
+		fmt.Fprint(os.Stderr, "No changes, the attachments are already in the state\n")
+		if emitBoth {
+			printPaged(opts, appendResultingState("", inputBytes))
+		}
+		return
+	}
+	prepareOutputState(opts, tfstate)
+	if sortKeys, _ := opts.Bool("--sort-keys"); sortKeys {
+		sortTfState(tfstate)
+	}
+
+	// The diff and --emit-both's state come from the same encoding
+	var outputBytes bytes.Buffer
+	if err := writeTfState(&outputBytes, tfstate, detectStateFormat(inputBytes)); err != nil {
+		die("%s", err)
+	}
+	var diff string
+	if onlyNew, _ := opts.Bool("--diff-only-new"); onlyNew {
+		diff = renderAddedDiff(opts, added, os.Stdout)
+	} else {
+		diff = renderJSONDiff(opts, inputBytes, outputBytes.Bytes(), os.Stdout)
+	}
+	if emitBoth {
+		diff = appendResultingState(diff, outputBytes.Bytes())
+	}
+	printPaged(opts, diff)
+}
+
+// Follow diff with emitBothSeparator and the resulting state in outputBytes,
+// each starting on a line of its own
+func appendResultingState(diff string, outputBytes []byte) string {
+	if diff != "" && !strings.HasSuffix(diff, "\n") {
+		diff += "\n"
+	}
+	diff += emitBothSeparator + "\n" + string(outputBytes)
+	if !bytes.HasSuffix(outputBytes, []byte("\n")) {
+		diff += "\n"
+	}
+	return diff
+}
+
+// Show a text diff between the input state ("-i") and the reference state in
+// againstFileName, without importing anything
+func diffAgainstMode(ctx context.Context, opts docopt.Opts, againstFileName string) {
+	_, inputBytes := readTfStateFile(ctx, opts)
+
+	f, err := os.Open(againstFileName)
+	if err != nil {
+		die("Error opening --against file: %s", err)
+	}
+	defer f.Close()
+	lenient, _ := opts.Bool("--lenient")
+	_, againstBytes, err := readTfState(f, lenient)
+	if err != nil {
+		die("%s", fmt.Errorf("%s: %w", againstFileName, err))
+	}
+
+	printPaged(opts, renderJSONDiff(opts, inputBytes, againstBytes, os.Stdout))
+}
+
+// Generate a diff showing only the added resources, keyed by resource ID, as
+// additions to an empty object. Unlike renderJSONDiff this is unaffected by
+// how the rest of the input file was formatted.
+func renderAddedDiff(opts docopt.Opts, added map[string]*terraform.ResourceState, output *os.File) string {
+	outputBytes, err := json.MarshalIndent(added, "", "    ")
+	if err != nil {
+		die("Error encoding output to JSON: %s", err)
+	}
+	return renderJSONDiff(opts, []byte("{}"), outputBytes, output)
+}
+
+// Generate a text diff between two JSON objects, using the colour ("-c") and
+// width options in opts as applied to output
+func renderJSONDiff(opts docopt.Opts, inputBytes []byte, outputBytes []byte, output *os.File) string {
+	// Generate diff
+	colors := diffColors(opts, output)
+
+	diff, err := gojsondiff.New().Compare(inputBytes, outputBytes)
+	if err != nil {
+		die("Error comparing JSON: %s", err)
+	}
+	if ignored, _ := opts["--diff-ignore"].([]string); len(ignored) > 0 {
+		diff = filteredDiff(filterDeltas(diff.Deltas(), "", ignored))
+	}
+
+	var inputJson map[string]interface{}
+	err = json.Unmarshal(inputBytes, &inputJson)
+	if err != nil {
+		die("Error unmarshaling JSON: %s", err)
+	}
+
+	// The side-by-side layout is built from the uncoloured unified diff
+	sideBySide := diffStyleFromOpts(opts) == "side-by-side"
+	diffString, err := formatter.NewAsciiFormatter(
+		inputJson,
+		formatter.AsciiFormatterConfig{
+			ShowArrayIndex: true,
+			Coloring:       colors && !sideBySide,
+		},
+	).Format(diff)
+	if err != nil {
+		die("Error formatting diff: %s", err)
+	}
+
+	if sideBySide {
+		return sideBySideDiff(diffString, diffWidth(opts, output), colors)
+	}
+	return trimDiffLines(diffString, diffWidth(opts, output))
+}
+
+// Whether to colour a diff written to output: always with "-c yes", never
+// with "-c no", "--no-color" or $NO_COLOR set, otherwise if it's a terminal
+func diffColors(opts docopt.Opts, output *os.File) bool {
+	cArg, _ := opts.String("-c")
+	switch cArg {
+	case "yes":
+		return true
+	case "no":
+		return false
+	}
+	if noColor, _ := opts.Bool("--no-color"); noColor || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	return isatty.IsTerminal(output.Fd())
+}
+
+// Read "--diff-style" from opts, which is "unified" unless given
+func diffStyleFromOpts(opts docopt.Opts) string {
+	style, _ := opts.String("--diff-style")
+	switch style {
+	case "", "unified":
+		return "unified"
+	case "side-by-side":
+		return style
+	}
+	die(fmt.Sprintf("Invalid --diff-style \"%s\" (use \"unified\" or \"side-by-side\")", style), nil)
+	return ""
+}
+
+// Lay out the unified diff produced by the ASCII formatter as two columns,
+// the input on the left and the output on the right, marking each row like
+// sdiff does: "|" for a changed line, "<" or ">" for one only on that side.
+// Each column gets half of width, or fits the longest input line if width
+// is 0.
+func sideBySideDiff(diff string, width int, colors bool) string {
+	type row struct {
+		left, right string
+		marker      byte
+	}
+
+	var rows []row
+	lines := strings.Split(strings.TrimSuffix(diff, "\n"), "\n")
+	for i := 0; i < len(lines); {
+		if lines[i] == "" || lines[i][0] == ' ' {
+			rows = append(rows, row{strings.TrimPrefix(lines[i], " "), strings.TrimPrefix(lines[i], " "), ' '})
+			i++
+			continue
+		}
+
+		// Pair up a run of removed lines with the added lines that follow it
+		var removed, addedLines []string
+		for ; i < len(lines) && strings.HasPrefix(lines[i], "-"); i++ {
+			removed = append(removed, lines[i][1:])
+		}
+		for ; i < len(lines) && strings.HasPrefix(lines[i], "+"); i++ {
+			addedLines = append(addedLines, lines[i][1:])
+		}
+		for j := 0; j < len(removed) || j < len(addedLines); j++ {
+			switch {
+			case j >= len(addedLines):
+				rows = append(rows, row{removed[j], "", '<'})
+			case j >= len(removed):
+				rows = append(rows, row{"", addedLines[j], '>'})
+			default:
+				rows = append(rows, row{removed[j], addedLines[j], '|'})
+			}
+		}
+	}
+
+	columnWidth := (width - 3) / 2
+	if columnWidth < 0 {
+		columnWidth = 0
+	}
+	if width <= 0 {
+		columnWidth = 0
+		for _, r := range rows {
+			if n := utf8.RuneCountInString(r.left); n > columnWidth {
+				columnWidth = n
+			}
+		}
+	}
+
+	var out strings.Builder
+	for _, r := range rows {
+		left := elideLine(r.left, columnWidth)
+		right := elideLine(r.right, columnWidth)
+		padding := strings.Repeat(" ", columnWidth-utf8.RuneCountInString(left))
+		if colors && (r.marker == '|' || r.marker == '<') {
+			left = "\x1b[31m" + left + "\x1b[0m"
+		}
+		if colors && (r.marker == '|' || r.marker == '>') {
+			right = "\x1b[32m" + right + "\x1b[0m"
+		}
+		line := fmt.Sprintf("%s%s %c %s", left, padding, r.marker, right)
+		out.WriteString(strings.TrimRight(line, " ") + "\n")
+	}
+	return out.String()
+}
+
+// Elide the end of line with "…" if it's wider than width
+func elideLine(line string, width int) string {
+	if utf8.RuneCountInString(line) <= width {
+		return line
+	}
+	if width <= 0 {
+		return ""
+	}
+	runes := []rune(line)
+	return string(runes[:width-1]) + "…"
+}
+
+// Determine the width diff lines should be trimmed to: "--width" if given,
+// otherwise the width of the terminal on output. 0 means no trimming.
+func diffWidth(opts docopt.Opts, output *os.File) int {
+	if widthArg, _ := opts.String("--width"); widthArg != "" {
+		width, err := strconv.Atoi(widthArg)
+		if err != nil || width < 0 {
+			die(fmt.Sprintf("Invalid --width \"%s\"", widthArg), nil)
+		}
+		return width
+	}
+
+	if !isatty.IsTerminal(output.Fd()) {
+		return 0
+	}
+	width, _, err := term.GetSize(int(output.Fd()))
+	if err != nil {
+		return 0
+	}
+	return width
+}
+
+// Elide the end of each line in diff that's wider than width with "…". Colour
+// codes wrapped around a line by the ASCII formatter don't count towards its
+// width and are kept intact.
+func trimDiffLines(diff string, width int) string {
+	if width <= 0 {
+		return diff
+	}
+
+	lines := strings.Split(diff, "\n")
+	for i, line := range lines {
+		prefix, suffix := "", ""
+		if strings.HasPrefix(line, "\x1b[") {
+			if end := strings.IndexByte(line, 'm'); end >= 0 {
+				prefix, line = line[:end+1], line[end+1:]
+			}
+		}
+		if strings.HasSuffix(line, "\x1b[0m") {
+			suffix, line = "\x1b[0m", strings.TrimSuffix(line, "\x1b[0m")
+		}
+
+		lines[i] = prefix + elideLine(line, width) + suffix
+	}
+	return strings.Join(lines, "\n")
+}
+
+// A gojsondiff.Diff with some of its deltas removed by filterDeltas
+type filteredDiff []gojsondiff.Delta
+
+func (d filteredDiff) Deltas() []gojsondiff.Delta {
+	return d
+}
+
+func (d filteredDiff) Modified() bool {
+	return len(d) > 0
+}
+
+// Remove the deltas under any of the "--diff-ignore" paths in ignored, such as
+// "serial" or "modules[0].resources", from deltas found at parentPath.
+// Objects and arrays left without any changes are removed too.
+func filterDeltas(deltas []gojsondiff.Delta, parentPath string, ignored []string) []gojsondiff.Delta {
+	var filtered []gojsondiff.Delta
+	for _, delta := range deltas {
+		var position gojsondiff.Position
+		if post, ok := delta.(gojsondiff.PostDelta); ok {
+			position = post.PostPosition()
+		} else {
+			position = delta.(gojsondiff.PreDelta).PrePosition()
+		}
+		path := parentPath
+		if index, ok := position.(gojsondiff.Index); ok {
+			path += fmt.Sprintf("[%d]", index)
+		} else if path == "" {
+			path = position.String()
+		} else {
+			path += "." + position.String()
+		}
+		if isIgnoredPath(path, ignored) {
+			continue
+		}
+
+		switch delta := delta.(type) {
+		case *gojsondiff.Object:
+			if children := filterDeltas(delta.Deltas, path, ignored); len(children) > 0 {
+				filtered = append(filtered, gojsondiff.NewObject(position, children))
+			}
+		case *gojsondiff.Array:
+			if children := filterDeltas(delta.Deltas, path, ignored); len(children) > 0 {
+				filtered = append(filtered, gojsondiff.NewArray(position, children))
+			}
+		default:
+			filtered = append(filtered, delta)
+		}
+	}
+	return filtered
+}
+
+// Whether path is one of the prefixes in ignored or inside one of them
+func isIgnoredPath(path string, ignored []string) bool {
+	for _, prefix := range ignored {
+		if path == prefix || strings.HasPrefix(path, prefix+".") || strings.HasPrefix(path, prefix+"[") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/docopt/docopt-go"
+	"github.com/hashicorp/terraform/terraform"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTrimDiffLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		diff  string
+		width int
+		want  string
+	}{
+		{"no trimming", "+   \"id\": \"vai-1474069414\"\n", 0, "+   \"id\": \"vai-1474069414\"\n"},
+		{"short lines", " {\n }\n", 10, " {\n }\n"},
+		{"exact width", "+ abcdefgh\n", 10, "+ abcdefgh\n"},
+		{"long line", "+ abcdefghijk\n", 10, "+ abcdefg…\n"},
+		{"multibyte", "+ äöüäöüäöüä\n", 10, "+ äöüäöüä…\n"},
+		{
+			"coloured line",
+			"\x1b[30;42m+ abcdefghijk\x1b[0m\n",
+			10,
+			"\x1b[30;42m+ abcdefg…\x1b[0m\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := trimDiffLines(tt.diff, tt.width); got != tt.want {
+				t.Errorf("trimDiffLines(%q, %d) = %q, want %q", tt.diff, tt.width, got, tt.want)
+			}
+		})
+	}
+}
+
+// The diff import --show-diff prints must show exactly what import writes,
+// including the serial bump
+func TestRenderJSONDiff(t *testing.T) {
+	input, err := ioutil.ReadFile("testdata/single-module.tfstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tfstate := loadTfState(t, "single-module.tfstate")
+	params := injectParams{
+		instanceName: "mysrv", volumeName: "mysrv_dsk0",
+		attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+	}
+	if _, err := injectVolumeAttachment(params, tfstate); err != nil {
+		t.Fatal(err)
+	}
+	opts := docopt.Opts{"-c": "no"}
+	prepareOutputState(opts, tfstate)
+
+	diff := renderJSONDiff(opts, input, encodeTfStateFile(opts, tfstate, input), os.Stdout)
+	for _, want := range []string{
+		"-  \"serial\": 4,\n",
+		"+  \"serial\": 5,\n",
+		"+        \"aws_volume_attachment.mysrv_dsk0_attch\": {\n",
+	} {
+		if !strings.Contains(diff, want) {
+			t.Errorf("diff doesn't contain %q:\n%s", want, diff)
+		}
+	}
+}
+
+func TestRenderAddedDiff(t *testing.T) {
+	tfstate := loadTfState(t, "single-module.tfstate")
+	params := injectParams{
+		instanceName: "mysrv", volumeName: "mysrv_dsk0",
+		attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+	}
+	moduleState, err := injectVolumeAttachment(params, tfstate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := map[string]*terraform.ResourceState{
+		"aws_volume_attachment.mysrv_dsk0_attch": moduleState.Resources["aws_volume_attachment.mysrv_dsk0_attch"],
+	}
+
+	diff := renderAddedDiff(docopt.Opts{"-c": "no"}, added, os.Stdout)
+	for _, line := range strings.Split(strings.TrimRight(diff, "\n"), "\n") {
+		if line == " {" || line == " }" {
+			continue
+		}
+		if !strings.HasPrefix(line, "+") {
+			t.Errorf("unexpected line outside the added resource: %q", line)
+		}
+	}
+	if !strings.Contains(diff, `"aws_volume_attachment.mysrv_dsk0_attch"`) {
+		t.Errorf("diff doesn't mention the attachment:\n%s", diff)
+	}
+	if strings.Contains(diff, "\"aws_instance.mysrv\": {") {
+		t.Errorf("diff includes unrelated resources:\n%s", diff)
+	}
+}
+
+func TestAppendResultingState(t *testing.T) {
+	for _, tc := range []struct {
+		diff, state, want string
+	}{
+		{"-a\n+b\n", "{}\n", "-a\n+b\n" + emitBothSeparator + "\n{}\n"},
+		{"-a\n+b", "{}", "-a\n+b\n" + emitBothSeparator + "\n{}\n"},
+		{"", "{}\n", emitBothSeparator + "\n{}\n"},
+	} {
+		if got := appendResultingState(tc.diff, []byte(tc.state)); got != tc.want {
+			t.Errorf("appendResultingState(%q, %q) = %q, want %q", tc.diff, tc.state, got, tc.want)
+		}
+	}
+}
+
+func TestSideBySideDiff(t *testing.T) {
+	diff := " {\n-  \"serial\": 4,\n+  \"serial\": 5,\n+  \"x\": 1\n-  \"y\": 2\n }\n"
+	tests := []struct {
+		name   string
+		width  int
+		colors bool
+		want   string
+	}{
+		{
+			"fit to input",
+			0,
+			false,
+			"{                {\n" +
+				"  \"serial\": 4, |   \"serial\": 5,\n" +
+				"               >   \"x\": 1\n" +
+				"  \"y\": 2       <\n" +
+				"}                }\n",
+		},
+		{
+			"elided",
+			19,
+			false,
+			"{          {\n" +
+				"  \"seri… |   \"seri…\n" +
+				"         >   \"x\": 1\n" +
+				"  \"y\": 2 <\n" +
+				"}          }\n",
+		},
+		{
+			"coloured",
+			0,
+			true,
+			"{                {\n" +
+				"\x1b[31m  \"serial\": 4,\x1b[0m | \x1b[32m  \"serial\": 5,\x1b[0m\n" +
+				"               > \x1b[32m  \"x\": 1\x1b[0m\n" +
+				"\x1b[31m  \"y\": 2\x1b[0m       <\n" +
+				"}                }\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sideBySideDiff(diff, tt.width, tt.colors); got != tt.want {
+				t.Errorf("sideBySideDiff() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffColors(t *testing.T) {
+	defer os.Setenv("NO_COLOR", os.Getenv("NO_COLOR"))
+
+	// os.Stdout isn't a terminal under go test, so "auto" means no colours
+	tests := []struct {
+		name    string
+		c       string
+		noColor bool
+		env     string
+		want    bool
+	}{
+		{"auto", "auto", false, "", false},
+		{"yes", "yes", false, "", true},
+		{"yes beats NO_COLOR", "yes", false, "1", true},
+		{"yes beats --no-color", "yes", true, "", true},
+		{"no", "no", false, "", false},
+		{"--no-color", "auto", true, "", false},
+		{"NO_COLOR", "auto", false, "1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("NO_COLOR", tt.env)
+			opts := docopt.Opts{"-c": tt.c, "--no-color": tt.noColor}
+			if got := diffColors(opts, os.Stdout); got != tt.want {
+				t.Errorf("diffColors() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// What diff shows as added must be exactly what import writes for the same
+// options
+func TestDiffMatchesImport(t *testing.T) {
+	opts := docopt.Opts{
+		"<inst-name>": "mysrv", "<vol-name>": "mysrv_dsk0", "<att-name>": "mysrv_dsk0_attch", "<dev>": "sdg",
+		"--provider": "provider.aws", "--force-detach": true, "--skip-destroy": true,
+		"--attribute": []string{"skip_destroy=false"},
+	}
+	attachmentResourceID := "aws_volume_attachment.mysrv_dsk0_attch"
+
+	// diff mode
+	tfstate := loadTfState(t, "single-module.tfstate")
+	added := make(map[string]*terraform.ResourceState)
+	for _, params := range newInjectParams(opts, tfstate) {
+		moduleState, err := injectVolumeAttachment(params, tfstate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		added[attachmentResourceID] = moduleState.Resources[attachmentResourceID]
+	}
+	diffBlock, err := json.Marshal(added[attachmentResourceID])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// import mode
+	tfstate = loadTfState(t, "single-module.tfstate")
+	for _, params := range newInjectParams(opts, tfstate) {
+		if _, err := injectVolumeAttachment(params, tfstate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var written bytes.Buffer
+	if err := writeTfState(&written, tfstate, defaultStateFormat); err != nil {
+		t.Fatal(err)
+	}
+	writtenState, _, err := readTfState(&written, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resourceState, _ := findResource(writtenState, attachmentResourceID)
+	importBlock, err := json.Marshal(resourceState)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(diffBlock) != string(importBlock) {
+		t.Errorf("diff shows\n%s\nbut import writes\n%s", diffBlock, importBlock)
+	}
+	attributes := resourceState.Primary.Attributes
+	if attributes["force_detach"] != "true" || attributes["skip_destroy"] != "false" {
+		t.Errorf("force_detach = %q, skip_destroy = %q, want \"true\" and \"false\"",
+			attributes["force_detach"], attributes["skip_destroy"])
+	}
+}
+
+func TestRenderDiffIgnore(t *testing.T) {
+	before := []byte(`{"serial": 4, "modules": [{"path": ["root"], "resources": {"a": {"meta": {"x": "1"}, "id": "a1"}}}]}`)
+	after := []byte(`{"serial": 5, "modules": [{"path": ["root"], "resources": {"a": {"meta": {"x": "2"}, "id": "a2"}}}]}`)
+	tests := []struct {
+		ignore      []string
+		wantChanged []string
+	}{
+		{nil, []string{`"id": "a2"`, `"x": "2"`, `"serial": 5`}},
+		{[]string{"serial"}, []string{`"id": "a2"`, `"x": "2"`}},
+		{[]string{"serial", "modules[0].resources.a.meta"}, []string{`"id": "a2"`}},
+		{[]string{"modules"}, []string{`"serial": 5`}},
+		{[]string{"serial", "modules"}, nil},
+		// A prefix of a name isn't a path prefix
+		{[]string{"ser", "modules[0].resources.a.me"}, []string{`"id": "a2"`, `"x": "2"`, `"serial": 5`}},
+	}
+	for _, tt := range tests {
+		opts := docopt.Opts{"-c": "no", "--diff-ignore": tt.ignore}
+		var changed []string
+		for _, line := range strings.Split(renderJSONDiff(opts, before, after, os.Stdout), "\n") {
+			if strings.HasPrefix(line, "+") {
+				changed = append(changed, strings.TrimRight(strings.TrimSpace(line[1:]), ","))
+			}
+		}
+		if strings.Join(changed, "|") != strings.Join(tt.wantChanged, "|") {
+			t.Errorf("%q: added lines %q, want %q", tt.ignore, changed, tt.wantChanged)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+//go:build integration
+// +build integration
+
+package main
+
+// End-to-end tests of the built binary, run with: go test -tags integration
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Path of the binary built by TestMain
+var binary string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "tf-ebs-attach-e2e")
+	if err != nil {
+		panic(err)
+	}
+	binary = filepath.Join(dir, "tf-ebs-attach")
+	build := exec.Command("go", "build", "-o", binary, ".")
+	build.Stdout, build.Stderr = os.Stderr, os.Stderr
+	if err := build.Run(); err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// Run the binary in dir with args and stdin, returning its stdout, stderr and
+// exit status
+func runBinary(t *testing.T, dir string, stdin string, args ...string) (string, string, int) {
+	t.Helper()
+	cmd := exec.Command(binary, args...)
+	cmd.Dir = dir
+	cmd.Env = binaryEnv()
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return stdout.String(), stderr.String(), exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), 0
+}
+
+// The environment to run the binary in: just enough to find programs and a
+// temporary directory, so that variables such as TF_WORKSPACE, TF_DATA_DIR,
+// TF_STATE or AWS_REGION set in the developer's shell don't change the result
+func binaryEnv() []string {
+	env := []string{"PATH=" + os.Getenv("PATH")}
+	if tmpDir := os.Getenv("TMPDIR"); tmpDir != "" {
+		env = append(env, "TMPDIR="+tmpDir)
+	}
+	return env
+}
+
+// Copy testdata/<name> into dir as "terraform.tfstate"
+func copyFixture(t *testing.T, name, dir string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "terraform.tfstate")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestE2EShow(t *testing.T) {
+	want, err := ioutil.ReadFile("testdata/show-basic.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Options may come before the command
+	for _, args := range [][]string{
+		{"show", "i-abc123", "mysrv_dsk0", "vol-123abc", "mysrv_dsk0_attch", "/dev/sdg"},
+		{"--provider", "provider.aws", "show", "i-abc123", "mysrv_dsk0", "vol-123abc", "mysrv_dsk0_attch", "sdg"},
+	} {
+		stdout, stderr, code := runBinary(t, ".", "", args...)
+		if code != 0 {
+			t.Fatalf("%v: exit status %d: %s", args, code, stderr)
+		}
+		if stdout != string(want) {
+			t.Errorf("%v: stdout:\n%s\nwant:\n%s", args, stdout, want)
+		}
+	}
+}
+
+func TestE2EUsageErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"bogus"},
+		{"show", "i-abc123"},
+	} {
+		if _, _, code := runBinary(t, ".", "", args...); code == 0 {
+			t.Errorf("%v: exit status 0, want an error", args)
+		}
+	}
+}
+
+func TestE2EPlanDiffRefusesDecrypt(t *testing.T) {
+	stdout, _, code := runBinary(t, ".", "", "plan-diff", "--decrypt-cmd", "cat",
+		"-i", "testdata/single-module.tfstate", "mysrv", "mysrv_dsk0", "mysrv_dsk0_attch", "/dev/sdg")
+	if code != 1 || !strings.Contains(stdout, "--decrypt-cmd can't be used with plan-diff") {
+		t.Errorf("exit status %d, output %q", code, stdout)
+	}
+}
+
+func TestE2EScaffoldRejectsForEachVolume(t *testing.T) {
+	stdout, _, code := runBinary(t, ".", "", "scaffold", "mysrv", "i-0598c7d356eba48d7",
+		`disks["logs"]`, "vol-049df61146c4d7901", "logs_attch", "/dev/sdg")
+	if code != 1 || !strings.Contains(stdout, "only index resources by count") {
+		t.Errorf("exit status %d, output %q", code, stdout)
+	}
+}
+
+func TestE2EShowByPrivateIP(t *testing.T) {
+	fakeAWS := `f() { echo '{"Reservations": [{"Instances": [{"InstanceId": "i-0598c7d356eba48d7", "State": {"Name": "running"}}]}]}'; }; f`
+	byID, stderr, code := runBinary(t, ".", "", "show", "i-0598c7d356eba48d7", "mysrv_dsk0",
+		"vol-049df61146c4d7901", "mysrv_dsk0_attch", "/dev/sdg")
+	if code != 0 {
+		t.Fatalf("exit status %d: %s", code, stderr)
+	}
+	byIP, stderr, code := runBinary(t, ".", "", "show", "--by-private-ip", "--aws-cmd", fakeAWS,
+		"--region", "eu-west-1", "10.0.1.23", "mysrv_dsk0", "vol-049df61146c4d7901", "mysrv_dsk0_attch", "/dev/sdg")
+	if code != 0 || byIP != byID {
+		t.Errorf("exit status %d, stderr %q, got:\n%s\nwant:\n%s", code, stderr, byIP, byID)
+	}
+}
+
+func TestE2EImportShowDiffMatchesWritten(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-ebs-attach-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Dependencies out of order, which --sort-keys changes
+	tfstate := loadTfState(t, "single-module.tfstate")
+	tfstate.Modules[0].Resources["aws_instance.mysrv"].Dependencies = []string{"null_resource.b", "null_resource.a"}
+	var input bytes.Buffer
+	if err := writeTfState(&input, tfstate, defaultStateFormat); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "in.tfstate"), input.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, flag := range []string{"--sort-keys", "--canonical"} {
+		_, preview, code := runBinary(t, dir, "", "import", "--show-diff", flag, "--no-color", "--yes",
+			"-i", "in.tfstate", "-o", "out.tfstate", "mysrv", "mysrv_dsk0", "mysrv_dsk0_attch", "/dev/sdg")
+		if code != 0 {
+			t.Fatalf("%s: exit status %d: %s", flag, code, preview)
+		}
+		written, stderr, code := runBinary(t, dir, "", "diff", "--no-color", "-i", "in.tfstate",
+			"--against", "out.tfstate")
+		if code != 0 {
+			t.Fatalf("%s: diff --against: exit status %d: %s", flag, code, stderr)
+		}
+		if !strings.Contains(preview, written) {
+			t.Errorf("%s: --show-diff printed:\n%s\nbut the written file differs by:\n%s", flag, preview, written)
+		}
+	}
+}
+
+func TestE2EImportExitCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		args    []string
+		want    int
+	}{
+		{"instance not found", "single-module.tfstate", []string{"othersrv", "mysrv_dsk0", "att", "/dev/sdg"}, 3},
+		{"volume not found", "single-module.tfstate", []string{"mysrv", "otherdsk", "att", "/dev/sdg"}, 4},
+		{"attachment exists", "attached.tfstate", []string{"mysrv", "mysrv_dsk0", "mysrv_dsk0_attch", "/dev/sdg"}, 5},
+		{"unsupported version", "v4.tfstate", []string{"mysrv", "mysrv_dsk0", "att", "/dev/sdg"}, 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"import", "-i", filepath.Join("testdata", tt.fixture), "-o", "-"}, tt.args...)
+			if stdout, _, code := runBinary(t, ".", "", args...); code != tt.want {
+				t.Errorf("exit status %d, want %d: %s", code, tt.want, stdout)
+			}
+		})
+	}
+}
+
+func TestE2EIgnoresTerraformEnvironment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-ebs-attach-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	copyFixture(t, "single-module.tfstate", dir)
+	for name, value := range map[string]string{
+		"TF_WORKSPACE": "staging", "TF_DATA_DIR": filepath.Join(dir, "nosuchdir"), "TF_STATE": "nosuch.tfstate",
+	} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Setenv(name, value)
+	}
+
+	// The default workspace's state is used despite the variables above
+	stdout, stderr, code := runBinary(t, dir, "", "import", "-o", "-", "mysrv", "mysrv_dsk0",
+		"mysrv_dsk0_attch", "/dev/sdg")
+	if code != 0 || !strings.Contains(stdout, `"aws_volume_attachment.mysrv_dsk0_attch"`) {
+		t.Errorf("exit status %d: %s%s", code, stdout, stderr)
+	}
+}
+
+func TestE2EImportThenDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-ebs-attach-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	statePath := copyFixture(t, "single-module.tfstate", dir)
+	attachment := []string{"mysrv", "mysrv_dsk0", "mysrv_dsk0_attch", "/dev/sdg"}
+
+	// diff --check reports the pending change
+	_, stderr, code := runBinary(t, dir, "", append([]string{"diff", "--check"}, attachment...)...)
+	if code != diffChangesExitCode {
+		t.Fatalf("diff --check before import: exit status %d, want %d: %s", code, diffChangesExitCode, stderr)
+	}
+
+	// Without a terminal, import refuses to write unless given --yes
+	if _, _, code := runBinary(t, dir, "", append([]string{"import", "--in-place"}, attachment...)...); code != 1 {
+		t.Errorf("import without --yes: exit status %d, want 1", code)
+	}
+	_, stderr, code = runBinary(t, dir, "", append([]string{"import", "--in-place", "--yes"}, attachment...)...)
+	if code != 0 {
+		t.Fatalf("import: exit status %d: %s", code, stderr)
+	}
+	written, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(written, []byte(`"aws_volume_attachment.mysrv_dsk0_attch"`)) {
+		t.Errorf("attachment missing from the written state:\n%s", written)
+	}
+	if _, err := os.Stat(statePath + ".backup"); err != nil {
+		t.Errorf("no backup written: %s", err)
+	}
+
+	// Afterwards there is nothing left to do
+	_, stderr, code = runBinary(t, dir, "", append([]string{"diff", "--check"}, attachment...)...)
+	if code != 0 || !strings.Contains(stderr, "No changes") {
+		t.Errorf("diff --check after import: exit status %d, stderr %q", code, stderr)
+	}
+	stdout, stderr, code := runBinary(t, dir, "", append([]string{"diff", "--no-color"}, attachment...)...)
+	if code != 0 || stdout != "" || !strings.Contains(stderr, "No changes") {
+		t.Errorf("diff after import: exit status %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	_, stderr, code = runBinary(t, dir, "", append([]string{"import", "--in-place", "--yes"}, attachment...)...)
+	if code != 0 || !strings.Contains(stderr, "no changes") {
+		t.Errorf("repeated import: exit status %d, stderr %q", code, stderr)
+	}
+}
+
+func TestE2EDiffEmitBoth(t *testing.T) {
+	attachment := []string{"-i", "testdata/single-module.tfstate",
+		"mysrv", "mysrv_dsk0", "mysrv_dsk0_attch", "/dev/sdg"}
+	stdout, stderr, code := runBinary(t, ".", "",
+		append([]string{"diff", "--emit-both", "--no-color"}, attachment...)...)
+	if code != 0 {
+		t.Fatalf("exit status %d: %s", code, stderr)
+	}
+	parts := strings.SplitN(stdout, "\n"+emitBothSeparator+"\n", 2)
+	if len(parts) != 2 || !strings.Contains(parts[0], "mysrv_dsk0_attch") {
+		t.Fatalf("expected a diff and a state separated by %q:\n%s", emitBothSeparator, stdout)
+	}
+
+	// The state is exactly what import would write
+	imported, stderr, code := runBinary(t, ".", "", append([]string{"import", "-o", "-"}, attachment...)...)
+	if code != 0 {
+		t.Fatalf("import: exit status %d: %s", code, stderr)
+	}
+	if parts[1] != imported {
+		t.Errorf("state after the separator differs from the imported state:\n%s\nwant:\n%s", parts[1], imported)
+	}
+
+	if _, _, code := runBinary(t, ".", "",
+		append([]string{"diff", "--emit-both", "--check"}, attachment...)...); code != 1 {
+		t.Errorf("--emit-both with --check: exit status %d, want 1", code)
+	}
+}
+
+func TestE2EImportOnlyIfExists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-ebs-attach-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	args := []string{"import", "--yes", "-i", "missing.tfstate", "-o", "out.tfstate",
+		"mysrv", "mysrv_dsk0", "mysrv_dsk0_attch", "/dev/sdg"}
+
+	if _, _, code := runBinary(t, dir, "", args...); code != 1 {
+		t.Errorf("without --only-if-exists: exit status %d, want 1", code)
+	}
+	_, stderr, code := runBinary(t, dir, "", append([]string{"--only-if-exists"}, args...)...)
+	if code != 0 || !strings.Contains(stderr, "nothing to do") {
+		t.Errorf("with --only-if-exists: exit status %d, stderr %q", code, stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.tfstate")); !os.IsNotExist(err) {
+		t.Errorf("output written for a missing input: %v", err)
+	}
+}
+
+func TestE2EImportStdin(t *testing.T) {
+	state, err := ioutil.ReadFile("testdata/single-module.tfstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, code := runBinary(t, ".", string(state),
+		"import", "-i", "-", "-o", "-", "mysrv", "mysrv_dsk0", "mysrv_dsk0_attch", "/dev/sdg")
+	if code != 0 {
+		t.Fatalf("exit status %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, `"serial": 5`) || !strings.Contains(stdout, "aws_volume_attachment.mysrv_dsk0_attch") {
+		t.Errorf("unexpected output state:\n%s", stdout)
+	}
+}
+
+func TestE2EImportMultiDoc(t *testing.T) {
+	input := concatFixtures(t, "count-volume.tfstate", "single-module.tfstate")
+	stdout, stderr, code := runBinary(t, ".", string(input), "import", "--multi-doc", "--yes",
+		"-i", "-", "-o", "-", "mysrv", "mysrv_dsk0", "mysrv_dsk0_attch", "/dev/sdg")
+	if code != 0 {
+		t.Fatalf("exit status %d: %s", code, stderr)
+	}
+	documents, err := readStateDocuments(strings.NewReader(stdout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(documents) != 2 || !strings.HasPrefix(string(input), string(documents[0].data)+"\n") {
+		t.Fatalf("first document not copied through unchanged:\n%s", stdout)
+	}
+	if resource, _ := findResource(documents[1].tfstate, "aws_volume_attachment.mysrv_dsk0_attch"); resource == nil {
+		t.Errorf("attachment missing from the second document:\n%s", stdout)
+	}
+}
+
+func TestE2EEncryptedState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-ebs-attach-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	statePath := copyFixture(t, "single-module.tfstate", dir)
+	plaintext, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// base64 stands in for a real cipher
+	if err := ioutil.WriteFile(statePath, []byte(base64.StdEncoding.EncodeToString(plaintext)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	attachment := []string{"mysrv", "mysrv_dsk0", "mysrv_dsk0_attch", "/dev/sdg"}
+
+	// The decrypted state isn't written back in the clear
+	args := append([]string{"import", "--in-place", "--yes", "--decrypt-cmd", "base64 -d"}, attachment...)
+	if _, _, code := runBinary(t, dir, "", args...); code != 1 {
+		t.Errorf("import without --encrypt-cmd: exit status %d, want 1", code)
+	}
+
+	args = append([]string{"import", "--in-place", "--yes", "--decrypt-cmd", "base64 -d",
+		"--encrypt-cmd", "base64"}, attachment...)
+	if _, stderr, code := runBinary(t, dir, "", args...); code != 0 {
+		t.Fatalf("import: exit status %d: %s", code, stderr)
+	}
+	written, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.Replace(string(written), "\n", "", -1))
+	if err != nil {
+		t.Fatalf("written state isn't encrypted: %s", err)
+	}
+	if !bytes.Contains(decoded, []byte(`"aws_volume_attachment.mysrv_dsk0_attch"`)) {
+		t.Errorf("attachment missing from the written state:\n%s", decoded)
+	}
+}
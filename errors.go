@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+)
+
+// Kinds of failure wrapped by the errors injectVolumeAttachment and
+// readTfState return, so callers can tell them apart with errors.Is
+var (
+	errInstanceNotFound        = errors.New("instance not found")
+	errVolumeNotFound          = errors.New("volume not found")
+	errResourceExists          = errors.New("attachment already exists")
+	errResourceTainted         = errors.New("instance or volume tainted")
+	errResourceNotApplied      = errors.New("instance or volume not applied")
+	errDuplicateAttachment     = errors.New("attachment exists under another name")
+	errUnsupportedStateVersion = errors.New("unsupported state version")
+)
+
+// Exit statuses die uses for errors wrapping the sentinels above, so scripts
+// can tell these failures apart. Other errors exit with 1.
+var errorExitCodes = []struct {
+	err  error
+	code int
+}{
+	{errInstanceNotFound, 3},
+	{errVolumeNotFound, 4},
+	{errResourceExists, 5},
+	{errUnsupportedStateVersion, 6},
+}
+
+// The exit status for err, 1 unless it wraps one of errorExitCodes
+func exitCode(err error) int {
+	for _, errorExitCode := range errorExitCodes {
+		if errors.Is(err, errorExitCode.err) {
+			return errorExitCode.code
+		}
+	}
+	return 1
+}
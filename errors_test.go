@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{fmt.Errorf("Could not locate module: %w", errInstanceNotFound), 3},
+		{fmt.Errorf("Could not locate module: %w", errVolumeNotFound), 4},
+		{fmt.Errorf("Document 2: %w", fmt.Errorf("exists: %w", errResourceExists)), 5},
+		{fmt.Errorf("State version 9: %w", errUnsupportedStateVersion), 6},
+		{fmt.Errorf("tainted: %w", errResourceTainted), 1},
+		{errors.New("Error reading input file"), 1},
+		{nil, 1},
+	}
+
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/docopt/docopt-go"
+	"github.com/hashicorp/terraform/terraform"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A stale "vai-" ID corrected by fixVolumeAttachmentIDs
+type attachmentIDFix struct {
+	modulePath string
+	resourceID string
+	oldID      string
+	newID      string
+}
+
+// Recalculate the IDs of all attachments in the state read from "-i", writing
+// to "-o" if any of them changed
+func fixIdsMode(ctx context.Context, opts docopt.Opts) {
+	tfstate, inputBytes := readTfStateFile(ctx, opts)
+
+	fixes := fixVolumeAttachmentIDs(tfstate, resourceTypesFromOpts(opts).attachment)
+	for _, fix := range fixes {
+		fmt.Fprintf(os.Stderr, "%s in module %s: %s -> %s\n",
+			fix.resourceID, fix.modulePath, fix.oldID, fix.newID)
+	}
+	if len(fixes) == 0 {
+		fmt.Fprint(os.Stderr, "All attachment IDs are up to date, nothing to write\n")
+		return
+	}
+	prepareOutputState(opts, tfstate)
+
+	confirmWrite(opts, fmt.Sprintf("Fixing %d attachment ID(s)", len(fixes)), false)
+	writeTfStateFile(ctx, opts, tfstate, inputBytes)
+}
+
+// Recalculate the "vai-" ID of every attachment of attachmentType in tfstate
+// from its own "device_name", "volume_id" and "instance_id" attributes, updating both
+// the primary ID and the "id" attribute where they differ. Attachments whose
+// attributes are incomplete are left alone with a warning.
+func fixVolumeAttachmentIDs(tfstate *terraform.State, attachmentType string) []attachmentIDFix {
+	var fixes []attachmentIDFix
+	for _, moduleState := range tfstate.Modules {
+		metrics.ModulesScanned++
+		modulePath := strings.Join(moduleState.Path, ".")
+
+		resourceIDs := make([]string, 0, len(moduleState.Resources))
+		for resourceID := range moduleState.Resources {
+			resourceIDs = append(resourceIDs, resourceID)
+		}
+		sort.Strings(resourceIDs)
+
+		for _, resourceID := range resourceIDs {
+			resourceState := moduleState.Resources[resourceID]
+			if !strings.HasPrefix(resourceID, attachmentType+".") || resourceState.Primary == nil {
+				continue
+			}
+			attributes := resourceState.Primary.Attributes
+			attachmentID, err := volumeAttachmentID(
+				attributes["device_name"], attributes["volume_id"], attributes["instance_id"])
+			if err != nil {
+				warnf("Skipping %s in module %s: %s", resourceID, modulePath, err)
+				continue
+			}
+			if resourceState.Primary.ID == attachmentID && attributes["id"] == attachmentID {
+				continue
+			}
+
+			fixes = append(fixes, attachmentIDFix{
+				modulePath: modulePath,
+				resourceID: resourceID,
+				oldID:      resourceState.Primary.ID,
+				newID:      attachmentID,
+			})
+			resourceState.Primary.ID = attachmentID
+			attributes["id"] = attachmentID
+		}
+	}
+	return fixes
+}
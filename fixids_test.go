@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFixVolumeAttachmentIDs(t *testing.T) {
+	tfstate := loadTfState(t, "attached.tfstate")
+	resourceState, _ := findResource(tfstate, "aws_volume_attachment.mysrv_dsk0_attch")
+
+	fixes := fixVolumeAttachmentIDs(tfstate, "aws_volume_attachment")
+	if len(fixes) != 1 {
+		t.Fatalf("got %d fixes, want 1", len(fixes))
+	}
+	want, err := volumeAttachmentID("/dev/sdf", "vol-049df61146c4d7901", "i-0598c7d356eba48d7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fix := fixes[0]
+	if fix.modulePath != "root" || fix.resourceID != "aws_volume_attachment.mysrv_dsk0_attch" ||
+		fix.oldID != "vai-1234" || fix.newID != want {
+		t.Errorf("unexpected fix %+v", fix)
+	}
+	if resourceState.Primary.ID != want || resourceState.Primary.Attributes["id"] != want {
+		t.Errorf("ID not updated: %s / %s", resourceState.Primary.ID, resourceState.Primary.Attributes["id"])
+	}
+
+	if fixes := fixVolumeAttachmentIDs(tfstate, "aws_volume_attachment"); len(fixes) != 0 {
+		t.Errorf("second pass made %d fixes, want none", len(fixes))
+	}
+}
+
+func TestFixVolumeAttachmentIDsType(t *testing.T) {
+	tfstate := loadTfState(t, "attached.tfstate")
+	moduleState := tfstate.Modules[0]
+	resourceState := moduleState.Resources["aws_volume_attachment.mysrv_dsk0_attch"]
+	moduleState.Resources["wrapped_attachment.mysrv_dsk0_attch"] = resourceState
+	delete(moduleState.Resources, "aws_volume_attachment.mysrv_dsk0_attch")
+
+	if fixes := fixVolumeAttachmentIDs(tfstate, "aws_volume_attachment"); len(fixes) != 0 {
+		t.Errorf("got %d fixes for the default type, want none", len(fixes))
+	}
+	fixes := fixVolumeAttachmentIDs(tfstate, "wrapped_attachment")
+	if len(fixes) != 1 || fixes[0].resourceID != "wrapped_attachment.mysrv_dsk0_attch" {
+		t.Errorf("unexpected fixes %+v", fixes)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/hashicorp/terraform/terraform"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How long to wait for an HTTP state endpoint before giving up
+const httpStateTimeout = 30 * time.Second
+
+// Whether fileName (the value of "-i" or "-o") is an HTTP(S) URL
+func isStateURL(fileName string) bool {
+	return strings.HasPrefix(fileName, "http://") || strings.HasPrefix(fileName, "https://")
+}
+
+// Fetch tfstate from url, such as one served by terraform's HTTP backend.
+// headers are "Name: value" strings added to the request, e.g. for auth.
+// Timeouts, throttling and 5xx responses are retried as per "--max-retries".
+func readTfStateURL(ctx context.Context, url string, headers []string, lenient bool) (*terraform.State, []byte, error) {
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error fetching input: %s", err)
+	}
+	for _, header := range headers {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, nil, fmt.Errorf("Invalid --header \"%s\", expected \"Name: value\"", header)
+		}
+		request.Header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	var body []byte
+	err = withRetries(ctx, "fetching "+url, func(ctx context.Context) error {
+		body, err = fetchURL(request.WithContext(ctx))
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return readTfState(bytes.NewReader(body), lenient)
+}
+
+// Perform a single request, returning the body of a 200 response. Errors
+// worth trying again are returned as retryableError.
+func fetchURL(request *http.Request) ([]byte, error) {
+	client := &http.Client{Timeout: httpStateTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		if request.Context().Err() != nil {
+			return nil, fmt.Errorf("Error fetching input: %s", err)
+		}
+		return nil, retryableError{fmt.Errorf("Error fetching input: %s", err)}
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusOK:
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		return nil, retryableError{fmt.Errorf("Error fetching %s: %s", request.URL, response.Status)}
+	default:
+		return nil, fmt.Errorf("Error fetching %s: %s", request.URL, response.Status)
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, retryableError{fmt.Errorf("Error reading input: %s", err)}
+	}
+	return body, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadTfStateURL(t *testing.T) {
+	state, err := ioutil.ReadFile("testdata/single-module.tfstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "no token", http.StatusUnauthorized)
+			return
+		}
+		w.Write(state)
+	}))
+	defer server.Close()
+
+	tfstate, _, err := readTfStateURL(context.Background(), server.URL, []string{"Authorization: Bearer secret"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tfstate.Serial != 4 {
+		t.Errorf("serial = %d, want 4", tfstate.Serial)
+	}
+
+	_, _, err = readTfStateURL(context.Background(), server.URL, nil, false)
+	if err == nil || !strings.Contains(err.Error(), "401 Unauthorized") {
+		t.Errorf("expected an error with the status, got %v", err)
+	}
+
+	if _, _, err = readTfStateURL(context.Background(), server.URL, []string{"no colon"}, false); err == nil {
+		t.Error("expected an error for a malformed header")
+	}
+}
+
+func TestReadTfStateURLRetries(t *testing.T) {
+	defer func(delay time.Duration) { retryBaseDelay = delay }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch {
+		case r.URL.Path == "/denied":
+			http.Error(w, "denied", http.StatusForbidden)
+		case requests < 3:
+			http.Error(w, "slow down", http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte(`{"version": 3, "serial": 7, "modules": []}`))
+		}
+	}))
+	defer server.Close()
+
+	tfstate, _, err := readTfStateURL(context.Background(), server.URL, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tfstate.Serial != 7 || requests != 3 {
+		t.Errorf("serial = %d after %d requests, want 7 after 3", tfstate.Serial, requests)
+	}
+
+	requests = 0
+	if _, _, err := readTfStateURL(context.Background(), server.URL+"/denied", nil, false); err == nil {
+		t.Error("expected an error for 403")
+	}
+	if requests != 1 {
+		t.Errorf("403 was requested %d times, want 1", requests)
+	}
+}
+
+func TestReadTfStateURLDeadline(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := readTfStateURL(ctx, server.URL, nil, false); err == nil {
+		t.Error("expected an error once the deadline passed")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("fetch took %s, the deadline wasn't honoured", elapsed)
+	}
+}
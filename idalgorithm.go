@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The order the AWS provider hashes the components of a "vai-" ID in
+const defaultIDAlgorithm = "device-instance-volume"
+
+// Order of the components in the buffer hashed by volumeAttachmentID, as set
+// by "--id-algorithm"
+var idComponentOrder = strings.Split(defaultIDAlgorithm, "-")
+
+// Parse an "--id-algorithm" name, a dash-separated ordering of "device",
+// "instance" and "volume" each used exactly once
+func parseIDAlgorithm(name string) ([]string, error) {
+	order := strings.Split(name, "-")
+	sorted := append([]string(nil), order...)
+	sort.Strings(sorted)
+	if strings.Join(sorted, "-") != "device-instance-volume" {
+		return nil, fmt.Errorf("Unknown ID algorithm \"%s\", expected an ordering of "+
+			"device, instance and volume such as \"%s\"", name, defaultIDAlgorithm)
+	}
+	return order, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Every ordering accepted by --id-algorithm, each with its expected IDs for
+// attachmentTriples in testdata/id-<algorithm>.golden
+var idAlgorithms = []string{
+	"device-instance-volume",
+	"device-volume-instance",
+	"instance-device-volume",
+	"instance-volume-device",
+	"volume-device-instance",
+	"volume-instance-device",
+}
+
+func TestIDAlgorithmGolden(t *testing.T) {
+	defer func(order []string) { idComponentOrder = order }(idComponentOrder)
+
+	for _, algorithm := range idAlgorithms {
+		order, err := parseIDAlgorithm(algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idComponentOrder = order
+
+		var out bytes.Buffer
+		for _, tt := range attachmentTriples {
+			if err := explainVolumeAttachmentID(&out, tt.deviceName, tt.volumeID, tt.instanceID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		checkGolden(t, "id-"+algorithm+".golden", out.Bytes())
+	}
+}
+
+func TestParseIDAlgorithm(t *testing.T) {
+	for _, name := range []string{"", "device", "device-instance", "device-device-volume",
+		"device-instance-volume-device", "dev-instance-volume", "DEVICE-INSTANCE-VOLUME"} {
+		if _, err := parseIDAlgorithm(name); err == nil {
+			t.Errorf("parseIDAlgorithm(%q) succeeded, want an error", name)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+// Make hand-edited JSON acceptable to encoding/json by blanking out "//" and
+// "/* */" comments and trailing commas before "}" or "]". Removed characters
+// are replaced with spaces (newlines are kept), so offsets in any subsequent
+// parse errors still point at the right place in the original input.
+func stripJSONExtensions(data []byte) []byte {
+	return stripTrailingCommas(stripComments(data))
+}
+
+// Blank out comments that appear outside of string literals
+func stripComments(data []byte) []byte {
+	out := make([]byte, len(data))
+	copy(out, data)
+
+	inString := false
+	for i := 0; i < len(out); i++ {
+		switch {
+		case inString:
+			if out[i] == '\\' {
+				i++
+			} else if out[i] == '"' {
+				inString = false
+			}
+		case out[i] == '"':
+			inString = true
+		case out[i] == '/' && i+1 < len(out) && out[i+1] == '/':
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+		case out[i] == '/' && i+1 < len(out) && out[i+1] == '*':
+			out[i], out[i+1] = ' ', ' '
+			for i += 2; i < len(out); i++ {
+				if out[i] == '*' && i+1 < len(out) && out[i+1] == '/' {
+					out[i], out[i+1] = ' ', ' '
+					i++
+					break
+				}
+				if out[i] != '\n' {
+					out[i] = ' '
+				}
+			}
+		}
+	}
+	return out
+}
+
+// Blank out commas that are directly followed by a closing "}" or "]"
+func stripTrailingCommas(data []byte) []byte {
+	inString := false
+	for i := 0; i < len(data); i++ {
+		switch {
+		case inString:
+			if data[i] == '\\' {
+				i++
+			} else if data[i] == '"' {
+				inString = false
+			}
+		case data[i] == '"':
+			inString = true
+		case data[i] == ',':
+			j := i + 1
+			for j < len(data) && isJSONWhitespace(data[j]) {
+				j++
+			}
+			if j < len(data) && (data[j] == '}' || data[j] == ']') {
+				data[i] = ' '
+			}
+		}
+	}
+	return data
+}
+
+func isJSONWhitespace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+func TestStripJSONExtensions(t *testing.T) {
+	tests := []struct {
+		name, input, want string
+	}{
+		{"strict input", `{"a": [1, 2]}`, `{"a": [1, 2]}`},
+		{"line comment", "{\"a\": 1 // one\n}", "{\"a\": 1       \n}"},
+		{"block comment", "{/* x\ny */\"a\": 1}", "{    \n    \"a\": 1}"},
+		{"trailing comma in object", `{"a": 1, }`, `{"a": 1  }`},
+		{"trailing comma in array", "[1, 2,\n]", "[1, 2 \n]"},
+		{"trailing comma before comment", "[1, // last\n]", "[1         \n]"},
+		{"comment markers in string", `{"a": "http://x/*y*/"}`, `{"a": "http://x/*y*/"}`},
+		{"comma in string", `{"a": ",}"}`, `{"a": ",}"}`},
+		{"escaped quote in string", `{"a": "\"//", }`, `{"a": "\"//"  }`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(stripJSONExtensions([]byte(tt.input)))
+			if got != tt.want {
+				t.Errorf("stripJSONExtensions(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadTfStateLenient(t *testing.T) {
+	input, err := ioutil.ReadFile("testdata/hand-edited.tfstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := readTfState(bytes.NewReader(input), false); err == nil {
+		t.Error("expected strict parsing of hand-edited state to fail")
+	}
+
+	tfstate, inputData, err := readTfState(bytes.NewReader(input), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !json.Valid(inputData) {
+		t.Error("lenient readTfState returned invalid JSON")
+	}
+
+	var output bytes.Buffer
+	if err := writeTfState(&output, tfstate, defaultStateFormat); err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile("testdata/single-module.tfstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.String() != string(want) {
+		t.Errorf("hand-edited state didn't parse to testdata/single-module.tfstate:\n%s", output.String())
+	}
+}
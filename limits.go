@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"github.com/docopt/docopt-go"
+	"github.com/hashicorp/terraform/terraform"
+	"strconv"
+)
+
+// The largest state processed, from "--max-modules" and "--max-resources".
+// 0 means no limit.
+type stateLimits struct {
+	modules   int
+	resources int
+}
+
+// Used by the modes without "--max-modules" and "--max-resources", the same
+// as their defaults in usage
+var defaultStateLimits = stateLimits{modules: 10000, resources: 100000}
+
+// The limits given in opts, with defaultStateLimits for those not given
+func stateLimitsFromOpts(opts docopt.Opts) stateLimits {
+	limits := defaultStateLimits
+	for _, limit := range []struct {
+		flag  string
+		value *int
+	}{{"--max-modules", &limits.modules}, {"--max-resources", &limits.resources}} {
+		arg, _ := opts.String(limit.flag)
+		if arg == "" {
+			continue
+		}
+		value, err := strconv.Atoi(arg)
+		if err != nil || value < 0 {
+			die(fmt.Sprintf("Invalid %s \"%s\", expected a number, or 0 for no limit", limit.flag, arg), nil)
+		}
+		*limit.value = value
+	}
+	return limits
+}
+
+// Refuse tfstate if it has more modules or resources than limits allow.
+// Called right after reading, before anything is searched or injected.
+func checkStateLimits(tfstate *terraform.State, limits stateLimits) error {
+	if limits.modules > 0 && len(tfstate.Modules) > limits.modules {
+		return fmt.Errorf("The state has %d modules, more than --max-modules %d; raise the limit "+
+			"(or use import --stream) if it's really that large", len(tfstate.Modules), limits.modules)
+	}
+	if limits.resources == 0 {
+		return nil
+	}
+	resources := 0
+	for _, moduleState := range tfstate.Modules {
+		resources += len(moduleState.Resources)
+	}
+	if resources > limits.resources {
+		return fmt.Errorf("The state has %d resources, more than --max-resources %d; raise the limit "+
+			"(or use import --stream) if it's really that large", resources, limits.resources)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCheckStateLimits(t *testing.T) {
+	// Just over the default number of modules, with two resources each
+	tfstate, _, err := readTfState(bytes.NewReader(largeTfState(t, defaultStateLimits.modules+1)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = checkStateLimits(tfstate, defaultStateLimits)
+	if err == nil || !strings.Contains(err.Error(), "10001 modules, more than --max-modules 10000") {
+		t.Errorf("default limits: got %v", err)
+	}
+	err = checkStateLimits(tfstate, stateLimits{modules: 0, resources: 20000})
+	if err == nil || !strings.Contains(err.Error(), "20002 resources, more than --max-resources 20000") {
+		t.Errorf("resource limit: got %v", err)
+	}
+	if err := checkStateLimits(tfstate, stateLimits{}); err != nil {
+		t.Errorf("no limits: got %v", err)
+	}
+	if err := checkStateLimits(loadTfState(t, "multi-module.tfstate"), defaultStateLimits); err != nil {
+		t.Errorf("small state: got %v", err)
+	}
+}
@@ -1,17 +1,29 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/docopt/docopt-go"
-	"github.com/hashicorp/terraform/helper/hashcode"
 	"github.com/hashicorp/terraform/terraform"
 	"github.com/mattn/go-isatty"
-	"github.com/yudai/gojsondiff"
-	"github.com/yudai/gojsondiff/formatter"
+	"golang.org/x/term"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 //       1         2         3         4         5         6         7         8
@@ -19,9 +31,132 @@ import (
 const usage = `terraform-ebs-attach
 
 Usage:
-  tf-ebs-attach import [-i f] [-o f] <inst-name> <vol-name> <att-name> <dev>  
-  tf-ebs-attach diff   [-i f] [-c m] <inst-name> <vol-name> <att-name> <dev>  
-  tf-ebs-attach show <inst-id> <vol-name> <vol-id> <att-name> <dev>
+  tf-ebs-attach import [-i f] [-o f]... [--skip-attached] [--provider p] [--yes]
+                       [--lenient] [--device-prefix p | --no-normalize-device]
+                       [--state-version n] [--print-resource] [--verbose]
+                       [--show-diff [--diff-only-new]] [-c m | --no-color]
+                       [--diff-ignore p]...
+                       [--width n] [--diff-style s] [--metrics] [--header h]...
+                       [--compact | --canonical] [--max-retries n]
+                       [--instance-id i] [--volume-id v] [--instance-type t]
+                       [--volume-type t] [--attachment-type t] [--force-version]
+                       [--force] [--sort-keys] [--timeout d] [--attribute kv]...
+                       [--force-detach] [--skip-destroy] [--in-place]
+                       [--under p | --root-only] [--id-algorithm a]
+                       [--allow-tainted] [--attachment-id x] [--device-tag k]
+                       [--name-tag k] [--drop-unknown] [--extra-dep a]...
+                       [--decrypt-cmd c] [--encrypt-cmd c]
+                       [--strict-device [--allow-reserved-device]]
+                       [--tfc-workspace w [--tfc-token t] [--tfc-host h]]
+                       [--changelog f] [--name-regex] [--debug-hash]
+                       [--only-if-exists] [--max-modules n] [--max-resources n]
+                       [--multi-doc]
+                       [--by-private-ip [--aws-cmd c] [--profile n]
+                        [--region r]]
+                       (<inst-name> <vol-name> <att-name> <dev> |
+                        (--attach g)... | --from-tags <inst-name> <vol-name>)
+  tf-ebs-attach import --stream [-i f] [-o f]... [--skip-attached] [--yes]
+                       [--provider p] [--compact] [--verbose] [--metrics]
+                       [--device-prefix p | --no-normalize-device]
+                       [--instance-id i] [--volume-id v] [--instance-type t]
+                       [--volume-type t] [--attachment-type t] [--force]
+                       [--timeout d] [--attribute kv]... [--force-detach]
+                       [--skip-destroy] [--under p | --root-only] [--in-place]
+                       [--id-algorithm a] [--allow-tainted] [--attachment-id x]
+                       [--strict-device [--allow-reserved-device]]
+                       [--debug-hash] [--only-if-exists] [--extra-dep a]...
+                       (<inst-name> <vol-name> <att-name> <dev> |
+                        (--attach g)...)
+  tf-ebs-attach diff   [-i f] [-c m | --no-color] [--check | --diff-only-new]
+                       [--diff-ignore p]... [--emit-both]
+                       [--skip-attached] [--provider p] [--lenient]
+                       [--device-prefix p | --no-normalize-device] [--verbose]
+                       [--state-version n] [--width n] [--metrics]
+                       [--header h]... [--max-retries n] [--diff-style s]
+                       [--instance-id i] [--volume-id v] [--instance-type t]
+                       [--volume-type t] [--attachment-type t] [--force-version]
+                       [--force] [--sort-keys] [--timeout d] [--attribute kv]...
+                       [--force-detach] [--skip-destroy]
+                       [--under p | --root-only] [--id-algorithm a]
+                       [--allow-tainted] [--attachment-id x] [--device-tag k]
+                       [--name-tag k] [--pager p | --no-pager]
+                       [--decrypt-cmd c]
+                       [--strict-device [--allow-reserved-device]]
+                       [--tfc-workspace w [--tfc-token t] [--tfc-host h]]
+                       [--name-regex] [--extra-dep a]...
+                       [--max-modules n] [--max-resources n]
+                       (<inst-name> <vol-name> <att-name> <dev> |
+                        (--attach g)... | --from-tags <inst-name> <vol-name>)
+  tf-ebs-attach diff   [-i f] [-c m | --no-color] [--width n] [--diff-style s]
+                       [--diff-ignore p]...
+                       [--lenient] [--header h]... [--max-retries n]
+                       [--timeout d] [--force-version] [--pager p | --no-pager]
+                       [--decrypt-cmd c] --against f
+  tf-ebs-attach diff   --compare-aws [-i f] [-c m | --no-color] [--width n]
+                       [--diff-style s] [--aws-cmd c] [--attachment-type t]
+                       [--lenient] [--header h]... [--max-retries n]
+                       [--timeout d] [--force-version] [--pager p | --no-pager]
+                       [--decrypt-cmd c] [--metrics] [--region r] [--verbose]
+                       [--profile n]
+  tf-ebs-attach reconcile [-i f] [-o f]... [--dry-run] [--yes] [--provider p]
+                       [--lenient] [--device-prefix p | --no-normalize-device]
+                       [--state-version n] [--verbose] [--metrics]
+                       [--compact | --canonical] [--sort-keys] [--header h]...
+                       [--max-retries n] [--force-version] [--timeout d]
+                       [--drop-unknown] [--in-place] [--under p | --root-only]
+                       [--id-algorithm a] [--allow-tainted]
+                       [--decrypt-cmd c] [--encrypt-cmd c]
+                       [--strict-device [--allow-reserved-device]]
+                       [--max-modules n] [--max-resources n]
+                       <manifest>
+  tf-ebs-attach (remove|undo) [-i f] [-o f]... [--module m] [--yes] [--lenient]
+                       [--state-version n] [--metrics] [--compact | --canonical]
+                       [--sort-keys] [--header h]... [--max-retries n]
+                       [--force-version] [--timeout d] [--in-place]
+                       [--drop-unknown] [--decrypt-cmd c] [--encrypt-cmd c]
+                       [--attachment-type t] <att-name>
+  tf-ebs-attach copy   [-i f] [-o f]... [--module m] [--recompute-id] [--yes]
+                       [--lenient] [--state-version n] [--metrics]
+                       [--compact | --canonical] [--header h]...
+                       [--max-retries n] [--force-version] [--sort-keys]
+                       [--timeout d] [--in-place] [--id-algorithm a]
+                       [--drop-unknown] [--decrypt-cmd c] [--encrypt-cmd c]
+                       [--attachment-type t] <src-state> <att-addr>
+  tf-ebs-attach fix-ids [-i f] [-o f]... [--yes] [--lenient] [--state-version n]
+                       [--metrics] [--compact | --canonical] [--header h]...
+                       [--max-retries n] [--force-version] [--sort-keys]
+                       [--timeout d] [--in-place] [--id-algorithm a]
+                       [--drop-unknown] [--decrypt-cmd c] [--encrypt-cmd c]
+                       [--attachment-type t]
+  tf-ebs-attach audit  [-i f] [--lenient] [--metrics] [--header h]...
+                       [--max-retries n] [--force-version] [--timeout d]
+                       [--instance-type t] [--volume-type t]
+                       [--attachment-type t] [--decrypt-cmd c]
+  tf-ebs-attach plan   <plan-json> [<att-name>]
+  tf-ebs-attach plan-diff [-i f] [--terraform-cmd c] [--chdir d] [--lenient]
+                       [--provider p] [--verbose] [--metrics] [--timeout d]
+                       [--device-prefix p | --no-normalize-device]
+                       [--instance-type t] [--volume-type t]
+                       [--attachment-type t] [--under p | --root-only]
+                       [--decrypt-cmd c] [--name-regex] [--extra-dep a]...
+                       <inst-name> <vol-name> <att-name> <dev>
+  tf-ebs-attach show   [--explain-id] [--provider p] [--metrics] [--compact]
+                       [--device-prefix p | --no-normalize-device]
+                       [--volume-type t] [--attachment-type t]
+                       [--attribute kv]... [--force-detach] [--skip-destroy]
+                       [--id-algorithm a] [--attachment-id x] [--extra-dep a]...
+                       [--output-template t | --output-format f] [--debug-hash]
+                       [--by-private-ip [--aws-cmd c] [--profile n]
+                        [--region r]]
+                       <inst-id> <vol-name> <vol-id> <att-name> <dev>
+  tf-ebs-attach scaffold [--provider p] [--compact]
+                       [--device-prefix p | --no-normalize-device]
+                       [--instance-type t] [--volume-type t]
+                       [--attachment-type t] [--attribute kv]...
+                       [--id-algorithm a]
+                       <inst-name> <inst-id> <vol-name> <vol-id> <att-name>
+                       <dev>
+  tf-ebs-attach version
   tf-ebs-attach -h|--help
   
 This tool lets you "import" an AWS EBS volume attachment into your Terraform 
@@ -34,219 +169,1710 @@ identifiable counterpart in AWS, so this hack provides a workaround.
 Options:
   -i file Read existing Terraform state from "file" [default: terraform.tfstate]
   -o file Write updated Terraform state to "file" [default: terraform.tfstate]
+          The previous contents of "file" are kept in "file.backup". If
+          "file" is also the input, "file.new" is written instead (see
+          the --in-place option). May be repeated to write the same state
+          to several files, or to a file and stdout ("-").
+          Without -i/-o, $TF_EBS_ATTACH_STATE or else $TF_STATE is used before
+          falling back to the default (flag > environment > default). The
+          default is the local state of the selected workspace, as given
+          by $TF_WORKSPACE or "$TF_DATA_DIR/environment" (".terraform" if
+          unset), e.g. "terraform.tfstate.d/staging/terraform.tfstate".
+          The input may also be an http:// or https:// URL, e.g. of the HTTP
+          backend. Writing to a URL is not supported.
+  --changelog f  Append a JSON line to f for each attachment added and each
+                state file written, recording the time, resource address,
+                module, "vai-" ID and state file, e.g. as an audit trail
+  --tfc-workspace w  Read the state from the Terraform Cloud workspace w,
+                given as "organization/workspace", through its API instead of
+                from a file, and upload the result to it as a new state
+                version. The workspace is locked during the upload.
+  --tfc-token t  API token for --tfc-workspace. Defaults to $TFE_TOKEN.
+  --tfc-host h  Hostname of the Terraform Enterprise instance to use instead
+                of Terraform Cloud [default: app.terraform.io]
+  --decrypt-cmd c  Pipe the state read with -i through the shell command c to
+                decrypt it, e.g. "age -d -i key.txt" or
+                "sops -d --input-type json --output-type json /dev/stdin"
+  --encrypt-cmd c  Pipe the state through the shell command c to encrypt it
+                before writing it, e.g. "age -r <recipient>". Required to
+                write a file with --decrypt-cmd. The decrypted state is only
+                kept in memory and passed to these commands through pipes,
+                never written to a temporary file. It is still shown by
+                diff mode and --show-diff, and c is visible in the process
+                list and runs with your environment, so keep keys out of it.
+  --header h    Add the HTTP header h ("Name: value") when -i is a URL, e.g.
+                for an auth token. May be repeated.
+  --timeout d   Give up after the duration d (e.g. "30s", "2m"), cancelling any
+                fetch in progress and exiting with status 124 without writing
+  --max-modules n  Refuse a state with more than n modules, as a guard against
+                processing a runaway or malicious file. 0 means no limit.
+                Not checked with --stream. [default: 10000]
+  --max-resources n  Refuse a state with more than n resources in all modules
+                together, as with --max-modules [default: 100000]
+  --max-retries n  Retry fetching a URL up to n times with exponential
+                backoff on timeouts, throttling and 5xx errors [default: 3]
   -c mode Use coloured output (mode = auto/no/yes) [default: auto]
+          With "auto", setting $NO_COLOR also disables colours.
+  --no-color    The same as "-c no"
+  --width n     Elide diff lines longer than n characters with "…". Defaults to
+                the terminal width when writing to a terminal, 0 disables.
+  --pager p     Page diff mode's output through the command p when writing to
+                a terminal. Defaults to $PAGER, or else "less -R" with $LESS
+                set to "FRX" if unset, so output that fits is just printed.
+  --no-pager    Print the diff directly even on a terminal
+  --diff-style s  Lay the diff out as "unified" (the default) or as
+                "side-by-side" columns of the state before and after
+  --show-diff   Print the diff that diff mode would show to stderr before
+                writing (import mode only)
+  --dry-run     Only report what reconcile would add, without writing
+  --check       Print no diff, just exit with 0 if the import would leave the
+                state unchanged or 2 if it would change it. Errors still
+                exit with 1.
+  --against f   Diff the input against the state file f instead of against
+                the result of an import, e.g. to compare with a known-good
+                state
+  --diff-ignore p  Leave changes at the JSON path p, and anything under it,
+                out of the diff, e.g. "serial" or
+                "modules[0].resources.aws_instance.srv.primary.meta". May be
+                repeated.
+  --compare-aws  Diff the device_name, instance_id and volume_id of every
+                attachment in the input against what EC2 reports for its
+                volume, flagging detached volumes and device mismatches.
+                Exits with status 2 if any of them drifted.
+  --aws-cmd c   Command used to run the AWS CLI, for --compare-aws and
+                for --by-private-ip [default: aws]
+  --by-private-ip  Take <inst-id> (show) or --instance-id (import) to be
+                the instance's private IP address or private DNS name, and
+                look up its ID with "aws ec2 describe-instances". Fails
+                unless exactly one instance that isn't terminated matches.
+  --profile n   Profile of the AWS CLI config to use, including SSO profiles,
+                for --compare-aws and for --by-private-ip. It's passed to the
+                AWS CLI as $AWS_PROFILE. Without it the AWS CLI's default
+                credential chain applies.
+  --region r    AWS region for the AWS CLI. Otherwise taken from
+                $AWS_REGION, $AWS_DEFAULT_REGION, the region of the profile
+                (--profile, a "--profile" in --aws-cmd, $AWS_PROFILE or
+                "default") in the AWS CLI config, or else the region of the
+                "availability_zone" and "arn" attributes in the state if
+                they all agree, in that order. --region always wins.
+  --terraform-cmd c  Command used to run terraform for plan-diff
+                [default: terraform]
+  --chdir d     Directory of the terraform configuration to plan in, which
+                must have been initialized with "terraform init" [default: .]
+  --diff-only-new  Diff only the added attachment resources against nothing,
+                instead of the whole state file before and after
+  --emit-both   After the diff, print a line reading
+                "=== tf-ebs-attach: resulting state ===" followed by the full
+                state the import would write, so both can be archived from
+                one run. Not available with --check.
+  --print-resource  Print the resource object that would be added, using the
+                IDs found in the state, instead of writing the state
+  --explain-id  Print the inputs and result of the "vai-" ID calculation
+                instead of the resource object (show mode only)
+  --debug-hash  Print each "vai-" ID calculation to stderr as it happens: the
+                exact buffer that is hashed, its length in bytes and the hash
+                before it's formatted, to compare with terraform's debug logs
+  --output-template t  Print the attachment with the Go text/template t
+                instead of the resource object, e.g. "{{.ID}}". The fields
+                are .ID, .DeviceName, .InstanceID, .VolumeID and
+                .AttachmentName (show mode only)
+  --output-format f  Print the attachment as "json", the resource object as
+                it goes in the state, or as "tfshow", the attribute block
+                "terraform state show" prints (show mode only) [default: json]
+  --under p     Only look for <inst-name> and <vol-name> in the module p, e.g.
+                "root.app1", and the modules nested in it
+  --name-regex  Treat <inst-name> and <vol-name> as regular expressions that
+                must match the whole resource name, e.g. "web_[0-9a-f]+".
+                Each must match exactly one resource in the module.
+  --root-only   Only look for <inst-name> and <vol-name> in the root module,
+                never falling back to a nested one
+  --skip-attached  Skip modules that already contain <att-name>, picking the
+                first module that still needs the attachment
+  --provider p  Provider of the attachment, used when the matched instance
+                doesn't record one [default: provider.aws]
+  --attach g    Add the attachment g, written as the four positional arguments
+                joined by colons ("inst:vol:att:dev"). May be repeated to add
+                several attachments while reading and writing the state once.
+  --from-tags   Read <att-name> and <dev> from tags on <vol-name>, as recorded
+                in the state, so only the instance and volume need be given
+  --device-tag k  Tag of <vol-name> holding <dev> for --from-tags
+                [default: DeviceName]
+  --name-tag k  Tag of <vol-name> holding <att-name> for --from-tags
+                [default: AttachmentName]
+  --attribute kv  Set the attribute "key=value" on the attachment, e.g. for
+                attributes added by newer providers. Overrides calculated
+                attributes such as "id" with a warning. May be repeated.
+  --extra-dep a  Add the resource address a, relative to the module, to the
+                attachment's dependencies along with its instance and volume,
+                e.g. "null_resource.format" or "aws_kms_key.ebs". May be
+                repeated.
+  --force-detach  Set "force_detach" to "true" on the attachment, as with
+                "--attribute force_detach=true"
+  --skip-destroy  Set "skip_destroy" to "true" on the attachment
+  --attachment-id x  Use x as the ID of the attachment instead of calculating
+                it, e.g. a "vai-" ID known from a log or another state.
+                Warns if it differs from the calculated one.
+  --instance-id i  Use instance ID i in the attachment instead of the ID
+                recorded for <inst-name>, which is still used to find the module
+  --volume-id v  Use volume ID v in the attachment instead of the ID recorded
+                for <vol-name>, which is still used to find the module
+  --instance-type t  Resource type of <inst-name> [default: aws_instance]
+  --volume-type t  Resource type of <vol-name> [default: aws_ebs_volume]
+  --attachment-type t  Resource type of the attachment to create or look for
+                [default: aws_volume_attachment]
+  --force       Add the attachment even if <dev> is already used by a block
+                device or another attachment on the instance, if the same
+                attachment is already in the state under another name, or if
+                the instance and volume are in different availability zones.
+                Also replaces an existing <att-name> that differs; an
+                identical one is always left alone.
+  --allow-tainted  Add the attachment even if <inst-name> or <vol-name> is
+                tainted, i.e. will be replaced with a new ID on the next apply
+  --stream      Copy the state one module at a time instead of reading it
+                all into memory, for very large states. The output is always
+                formatted as terraform writes it (or with --compact), and
+                options that need the whole state aren't available.
+  --multi-doc   Read the input as several state documents one after the
+                other, as some backup tools concatenate them, and add each
+                attachment to the one document containing its instance and
+                volume. It's an error if more than one does. All documents
+                are written back in their order, the others unchanged. Not
+                available with --lenient, --show-diff, --from-tags,
+                --decrypt-cmd, --encrypt-cmd or --tfc-workspace.
+  --in-place    Overwrite the input file when it's also the output. Before
+                version 1.0 this was the default.
+  --yes         Don't ask for confirmation before writing
+  --only-if-exists  If the input file doesn't exist, exit successfully
+                without writing anything instead of failing. Any other error
+                reading it still fails.
+  --strict-device  Refuse device names reserved for the root volume, which
+                shouldn't be managed by an attachment: /dev/sda, /dev/sda1
+                and /dev/xvda
+  --allow-reserved-device  Accept a reserved device name, only warning
+                about it in the --strict-device check
+  --device-prefix p  Prefix for a bare <dev> such as "sdg" [default: /dev/]
+  --no-normalize-device  Use <dev> exactly as given, even without a prefix
+  --state-version n  Set the "version" of the output state instead of keeping
+                the version that was read. Only version 3 can be written;
+                terraform 0.12 and later upgrade it to version 4 themselves.
+  --verbose     Report each module checked while locating <inst-name> and
+                <vol-name>, and how many were scanned
+  --metrics     When done, print a JSON object with the modules scanned,
+                resources added/removed, duration and whether a backup was
+                made to stderr
+  --module m    Module to remove <att-name> from, e.g. "root.app1". Required
+                if <att-name> exists in more than one module. In copy mode,
+                the module to copy into, defaulting to that of <att-addr>.
+  --id-algorithm a  Order in which <dev>, the instance ID and the volume ID
+                are joined (each followed by "-") and hashed into the "vai-"
+                ID [default: device-instance-volume]. The default is the AWS
+                provider's order. The other orders, device-volume-instance,
+                instance-device-volume, instance-volume-device,
+                volume-device-instance and volume-instance-device, reproduce
+                IDs from tools that built the hashed string differently.
+  --recompute-id  Calculate a new "vai-" ID for the copied attachment from its
+                attributes instead of keeping the original one
+  --force-version  Operate on states with a "version" newer than this tool
+                supports instead of refusing. This may corrupt the state.
+  --drop-unknown  Leave out top-level keys of the input that this tool doesn't
+                model, e.g. ones added by a newer terraform, instead of
+                copying them to the output unchanged
+  --lenient     Accept comments and trailing commas in the input file. The
+                output is always strict JSON.
+  --sort-keys   Sort modules by path (root first) and each list of
+                dependencies before writing, so the same logical state always
+                gives the same output. Resources are always sorted by key.
+  --compact     Write JSON without indentation instead of with four spaces
+  --canonical   Write the state exactly as terraform itself would: sorted as
+                with --sort-keys, empty lists and maps instead of nulls,
+                four-space indentation and "\n" line endings, regardless of
+                how the input was formatted
   
   inst-name: Name of the "aws_instance"          resource in your Terraform code 
   vol-name:  Name of the "aws_ebs_volume"        resource in your Terraform code
+             A count index, "name[0]", picks one instance of the volume
+             resource. As for <att-name>, for_each keys are rejected.
   att-name:  Name of the "aws_volume_attachment" resource in your Terraform code
+             In import and diff mode, a comma-separated list adds one
+             attachment per name, each paired with the same position in <dev>
+             A count index may be given as "name[0]". for_each keys such as
+             'name["a"]' need a version 4 state and are rejected.
   
   inst-id:   EC2 Instance ID (i-abcd123)
   vol-id:    EBS Volume ID (vol-abcd123)
   
-  dev:      Value of "device_name" from "aws_volume_attachment"
+  plan-json: Output of "terraform show -json <planfile>", or "-" for stdin
+  
+  src-state: Terraform state file to copy an attachment from
+  att-addr:  Address of the "aws_volume_attachment" in <src-state>, e.g.
+             "module.app1.aws_volume_attachment.dsk_attch"
+  
+  dev:      Value of "device_name" from "aws_volume_attachment". A bare name
+            like "sdg" is expanded to "/dev/sdg" since the "vai-" ID depends
+            on the exact string. Comma-separated to go with a list of
+            <att-name>s. NVMe names like "/dev/nvme1n1" are accepted, but on
+            Nitro instances AWS records the name from your Terraform code
+            (e.g. "/dev/sdf"), which is what the ID must be calculated from.
 
 Modes:
   import: Reads in a terraform state file, locates the definitions for 
           <inst-name> and <vol-name> and injects a new definition for the volume 
-          attachment <vol-name>.
+          attachment <vol-name>. Names the output file and module before 
+          writing, asking for confirmation on a terminal unless --yes is given.
+          Without a terminal, writing a file requires --yes.
   diff:   Prints a diff of the changes that would be made to the input file 
+  reconcile: Imports the attachments listed in <manifest> that aren't in the
+          state yet, leaving those already present alone, and reports how
+          many it will add and skip. <manifest> is a JSON file of the form
+          {"attachments": [{"instance": "mysrv", "volume": "mysrv_dsk0",
+          "attachment": "mysrv_dsk0_attch", "device": "/dev/sdg"}, ...]},
+          as described by the JSON Schema in manifest.schema.json.
+  copy:   Copies the volume attachment <att-addr> from <src-state> into a 
+          terraform state file verbatim, e.g. when splitting a state.
+  remove: Deletes the volume attachment <att-name> from a terraform state file,
+          reverting an import. Also available as "undo".
+  fix-ids: Recalculates the "vai-" ID of every volume attachment from its
+          "device_name", "volume_id" and "instance_id" and corrects the ones
+          that have drifted, e.g. after a volume or instance was replaced.
+  audit:  Lists the volume attachments whose "instance_id" or "volume_id" isn't
+          the ID of any instance or volume in the state, which may be stale
+          leftovers to remove. Exits with 2 if any are found, 0 otherwise.
+  plan:   Reads the output of "terraform show -json <planfile>" and prints the
+          actions planned for each volume attachment (or just <att-name>),
+          with the attributes that changed, e.g. to see why it's replaced.
+  plan-diff: Imports the attachment into a temporary copy of the state, runs
+          "terraform plan -state=<copy>" in --chdir and reports whether the
+          attachment would still change, printing the planned actions if so.
+          Exits with 2 if it would, 0 if the plan is clean for it. The state
+          given to -state is only used with the local backend. Encrypted
+          states are refused with --decrypt-cmd, since terraform would have
+          to read the decrypted state from a file.
   show:   Prints out the resource object that would be inserted given the 
           specified instance and volume. Doesn't use a terraform state file. 
+  scaffold: Prints a new, minimal state containing placeholder <inst-name> and
+          <vol-name> resources with just the given IDs, and the attachment
+          between them, e.g. as a starting point for tests.
+  version: Prints the version, commit and build date of this binary and the
+          terraform library (and so the state version) it was built with.
+
+Exit status:
+  0 on success and 1 on most errors, or 2 where a mode above says so. Modes
+  that add an attachment exit with 3 if the instance isn't found, 4 if the
+  instance is found without the volume and 5 if the attachment already
+  exists with different values. Any mode exits with 6 if the state's version
+  isn't supported.
+
+Interrupting:
+  Ctrl-C (SIGINT) or SIGTERM before the state is written stops without
+  writing anything and exits with status 130. The state is replaced by a
+  rename, so it's never left half-written. A second Ctrl-C exits at once.
+
+Response files:
+  An argument "@file" right after the mode is replaced by the arguments in
+  file, separated by whitespace or newlines. Quote an argument with '...' or
+  "..." to keep whitespace in it. Backslashes are taken literally.
 
 Examples:
   tf-ebs-attach import mysrv mysrv_dsk0 mysrv_dsk0_attch /dev/sdg
+  tf-ebs-attach import --in-place mysrv mysrv_dsk0 mysrv_dsk0_attch /dev/sdg
   tf-ebs-attach diff -i foo.state  mysrv mysrv_dsk0 mysrv_dsk0_attch /dev/sdg
+  terraform state pull | tf-ebs-attach diff -i - mysrv mysrv_dsk0 att /dev/sdg
+  tf-ebs-attach import --skip-attached srv dsk dsk_attch /dev/sdg
+  tf-ebs-attach import mysrv shared shared_a,shared_b /dev/sdg,/dev/sdh
+  tf-ebs-attach import --attach web:web_dsk:web_att:/dev/sdf \
+                       --attach db:db_dsk:db_att:/dev/sdg
+  tf-ebs-attach import --stream -i huge.tfstate -o new.tfstate srv dsk att sdg
+  tf-ebs-attach import --from-tags mysrv mysrv_dsk0
+  tf-ebs-attach import @attachment.args
+  tf-ebs-attach reconcile --dry-run attachments.json
+  tf-ebs-attach plan-diff --chdir infra/ mysrv mysrv_dsk0 mysrv_dsk0_attch sdg
+  tf-ebs-attach remove --module root.app1 dsk_attch
+  tf-ebs-attach copy -i app.tfstate old.tfstate aws_volume_attachment.dsk_att
+  tf-ebs-attach fix-ids --yes
+  tf-ebs-attach audit -i app.tfstate
+  terraform show -json plan.out | tf-ebs-attach plan - mysrv_dsk0_attch
   tf-ebs-attach show i-abc123 mysrv_dsk0 vol-123abc mysrv_dsk0_att /dev/sdg
+  tf-ebs-attach scaffold srv i-abc123 dsk0 vol-123abc dsk0_att /dev/sdg
+  tf-ebs-attach show --explain-id i-abc123 dsk0 vol-123abc dsk0_att /dev/sdg
 `
 
 func main() {
-	opts, err := docopt.ParseDoc(usage)
+	args, err := expandResponseFile(os.Args[1:])
+	if err != nil {
+		die("%s", err)
+	}
+	opts, err := docopt.ParseArgs(usage, args, "")
 	if err != nil {
 		die("Internal error parsing docopt string: %s", err)
 	}
+	verbose, _ = opts.Bool("--verbose")
+	debugHash, _ = opts.Bool("--debug-hash")
+	forceVersion, _ = opts.Bool("--force-version")
+	if algorithmArg, _ := opts.String("--id-algorithm"); algorithmArg != "" {
+		if idComponentOrder, err = parseIDAlgorithm(algorithmArg); err != nil {
+			die("%s", err)
+		}
+	}
+	if retriesArg, _ := opts.String("--max-retries"); retriesArg != "" {
+		if maxRetries, err = strconv.Atoi(retriesArg); err != nil || maxRetries < 0 {
+			die("Invalid --max-retries \""+retriesArg+"\"", nil)
+		}
+	}
+	command := commandFromOpts(opts)
+	metricsArg, _ := opts.Bool("--metrics")
+	startMetrics(metricsArg, command)
 
-	switch os.Args[1] {
+	// Bound the whole run by "--timeout", and stop before writing on Ctrl-C
+	ctx, stop := interruptibleContext()
+	defer stop()
+	if timeoutArg, _ := opts.String("--timeout"); timeoutArg != "" {
+		timeout, err := time.ParseDuration(timeoutArg)
+		if err != nil || timeout <= 0 {
+			die("Invalid --timeout \""+timeoutArg+"\", expected a duration like \"30s\"", nil)
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	switch command {
 	case "show":
-		showMode(opts)
+		showMode(ctx, opts)
 	case "diff":
-		diffMode(opts)
+		diffMode(ctx, opts)
 	case "import":
-		importMode(opts)
+		importMode(ctx, opts)
+	case "reconcile":
+		reconcileMode(ctx, opts)
+	case "remove", "undo":
+		removeMode(ctx, opts)
+	case "copy":
+		copyMode(ctx, opts)
+	case "fix-ids":
+		fixIdsMode(ctx, opts)
+	case "audit":
+		auditMode(ctx, opts)
+	case "plan":
+		planMode(opts)
+	case "plan-diff":
+		planDiffMode(ctx, opts)
+	case "scaffold":
+		scaffoldMode(opts)
+	case "version":
+		versionMode()
 	}
+	emitMetrics("")
+}
+
+// The commands in usage, each also a key in the parsed opts
+var commands = []string{"import", "diff", "remove", "undo", "copy", "fix-ids", "audit", "plan", "plan-diff", "show", "scaffold",
+	"version", "reconcile"}
+
+// Determine the command docopt matched. Options may come before it, so it
+// isn't necessarily os.Args[1].
+func commandFromOpts(opts docopt.Opts) string {
+	for _, command := range commands {
+		if given, _ := opts.Bool(command); given {
+			return command
+		}
+	}
+	return ""
+}
+
+// Set by "--verbose"
+var verbose bool
+
+// Where verbosef and warnf write to
+var verboseOutput io.Writer = os.Stderr
+
+// Set by "--force-version"
+var forceVersion bool
+
+// Set by "--debug-hash"
+var debugHash bool
+
+// Print a line of progress information when running with "--verbose"
+func verbosef(format string, args ...interface{}) {
+	if verbose {
+		fmt.Fprintf(verboseOutput, format+"\n", args...)
+	}
+}
+
+// Print a warning that doesn't stop the operation
+func warnf(format string, args ...interface{}) {
+	fmt.Fprintf(verboseOutput, "Warning: "+format+"\n", args...)
+}
+
+// Exit status when "--timeout" elapses, as with timeout(1)
+const timeoutExitCode = 124
+
+// Exit status when interrupted by SIGINT or SIGTERM, as shells report SIGINT
+const interruptedExitCode = 130
+
+// Exit with timeoutExitCode if ctx's deadline has passed, or with
+// interruptedExitCode if it was cancelled by a signal. Called before writing
+// anything, so a run that times out or is interrupted leaves the output
+// untouched.
+func exitIfTimedOut(ctx context.Context) {
+	message, code := "Timed out, no changes written", timeoutExitCode
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+	case context.Canceled:
+		message, code = "Interrupted, no changes written", interruptedExitCode
+	default:
+		return
+	}
+	fmt.Print(message + "\n")
+	emitMetrics(message)
+	os.Exit(code)
+}
+
+// A context cancelled on the first SIGINT or SIGTERM. A second one kills the
+// process as usual, in case it's stuck.
+func interruptibleContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			signal.Reset(os.Interrupt, syscall.SIGTERM)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// With "--only-if-exists", exit successfully without writing anything if err
+// is from inputFileName not existing
+func exitIfInputMissing(opts docopt.Opts, inputFileName string, err error) {
+	if onlyIfExists, _ := opts.Bool("--only-if-exists"); !onlyIfExists || !errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s doesn't exist, nothing to do\n", inputFileName)
+	emitMetrics("")
+	os.Exit(0)
 }
 
 func die(message string, err error) {
 	if err != nil {
-		fmt.Printf(message+"\n", err)
-	} else {
-		fmt.Printf(message + "\n")
+		message = fmt.Sprintf(message, err)
 	}
-	os.Exit(1)
+	fmt.Print(message + "\n")
+	emitMetrics(message)
+	os.Exit(exitCode(err))
 }
 
 // Show the ResourceState that would be created from the values in opts
-func showMode(opts docopt.Opts) {
+func showMode(ctx context.Context, opts docopt.Opts) {
 	instanceID, _ := opts.String("<inst-id>")
-	volumeName, _ := opts.String("<vol-name>")
+	instanceID = instanceIDFromOpts(ctx, opts, nil, instanceID)
 	volumeID, _ := opts.String("<vol-id>")
-	attachmentName, _ := opts.String("<att-name>")
-	deviceName, _ := opts.String("<dev>")
+	attachmentName, err := stateResourceName(opts["<att-name>"].(string))
+	if err != nil {
+		die("%s", err)
+	}
+	volumeName, err := stateResourceName(opts["<vol-name>"].(string))
+	if err != nil {
+		die("%s", err)
+	}
+	deviceName := deviceNameFromOpts(opts)
+	provider, _ := opts.String("--provider")
 
-	result := make(map[string]*terraform.ResourceState)
-	result["aws_volume_attachment."+attachmentName] =
-		newAwsVolumeAttachmentState(instanceID, volumeName, volumeID, deviceName)
+	if explainID, _ := opts.Bool("--explain-id"); explainID {
+		if err := explainVolumeAttachmentID(os.Stdout, deviceName, volumeID, instanceID); err != nil {
+			die("%s", err)
+		}
+		return
+	}
 
-	outputData, err := json.MarshalIndent(result, "", "    ")
+	types := resourceTypesFromOpts(opts)
+	attachmentState, err := newVolumeAttachmentState(types, "", instanceID, volumeName, volumeID, deviceName, provider)
 	if err != nil {
-		die("Error encoding output to JSON: %s", err)
+		die("%s", err)
+	}
+	if attachmentID, _ := opts.String("--attachment-id"); attachmentID != "" {
+		applyAttachmentID(types.attachment+"."+attachmentName, attachmentState, attachmentID)
 	}
+	applyAttributes(types.attachment+"."+attachmentName, attachmentState, attributesFromOpts(opts))
+	applyExtraDeps(attachmentState, extraDepsFromOpts(opts))
+	if outputTemplate, _ := opts.String("--output-template"); outputTemplate != "" {
+		if err := writeOutputTemplate(os.Stdout, outputTemplate, newShowFields(attachmentName, attachmentState)); err != nil {
+			die("%s", err)
+		}
+		return
+	}
+	switch outputFormat, _ := opts.String("--output-format"); outputFormat {
+	case "json":
+	case "tfshow":
+		if err := writeTfShow(os.Stdout, types.attachment+"."+attachmentName, attachmentState); err != nil {
+			die("%s", err)
+		}
+		return
+	default:
+		die(fmt.Sprintf("Unknown --output-format \"%s\", expected \"json\" or \"tfshow\"", outputFormat), nil)
+	}
+	compact, _ := opts.Bool("--compact")
+	printResources(map[string]*terraform.ResourceState{
+		types.attachment + "." + attachmentName: attachmentState,
+	}, compact)
+}
 
-	fmt.Print(string(outputData) + "\n")
+// Print resources as a JSON object keyed by their resource IDs
+func printResources(result map[string]*terraform.ResourceState, compact bool) {
+	if err := writeResources(os.Stdout, result, compact); err != nil {
+		die("%s", err)
+	}
 }
 
-// Show a text diff between the current tfstate ("-i") and the result of importing
-// the attachment specified in opts
-func diffMode(opts docopt.Opts) {
-	// Read and modify tfstate
-	tfstate, inputBytes := readTfState(opts)
-	injectVolumeAttachment(opts, &tfstate)
-	outputBytes, err := json.MarshalIndent(tfstate, "", "    ")
+// Write resources to w as a JSON object keyed by their resource IDs
+func writeResources(w io.Writer, result map[string]*terraform.ResourceState, compact bool) error {
+	var outputData []byte
+	var err error
+	if compact {
+		outputData, err = json.Marshal(result)
+	} else {
+		outputData, err = json.MarshalIndent(result, "", "    ")
+	}
 	if err != nil {
-		die("Error encoding output to JSON: %s", err)
+		return fmt.Errorf("Error encoding output to JSON: %s", err)
 	}
 
-	// Generate diff
-	colors := false
-	cArg, _ := opts.String("-c")
-	switch cArg {
-	case "":
-		fallthrough
-	case "auto":
-		colors = isatty.IsTerminal(os.Stdout.Fd())
-	case "yes":
-		colors = true
+	if _, err = w.Write(append(outputData, '\n')); err != nil {
+		return fmt.Errorf("Error writing output: %s", err)
 	}
+	return nil
+}
 
-	diff, err := gojsondiff.New().Compare(inputBytes, outputBytes)
-	if err != nil {
-		die("Error comparing JSON: %s", err)
+// Import the attachment specified in opts, reading from "-i", writing to "-o"
+func importMode(ctx context.Context, opts docopt.Opts) {
+	if stream, _ := opts.Bool("--stream"); stream {
+		streamImportMode(ctx, opts)
+		return
+	}
+	if multiDoc, _ := opts.Bool("--multi-doc"); multiDoc {
+		multiDocImportMode(ctx, opts)
+		return
 	}
 
-	var inputJson map[string]interface{}
-	err = json.Unmarshal(inputBytes, &inputJson)
-	if err != nil {
-		die("Error unmarshaling JSON: %s", err)
+	// Read input file
+	tfstate, inputBytes := readTfStateFile(ctx, opts)
+
+	// Modify it, adding one attachment per <att-name>/<dev> pair
+	added := make(map[string]*terraform.ResourceState)
+	var descriptions []string
+	var changelog []changelogEntry
+	paramsList := newInjectParams(opts, tfstate)
+	if byPrivateIP, _ := opts.Bool("--by-private-ip"); byPrivateIP {
+		instanceID := instanceIDFromOpts(ctx, opts, tfstate, paramsList[0].instanceID)
+		for i := range paramsList {
+			paramsList[i].instanceID = instanceID
+		}
+	}
+	for _, params := range paramsList {
+		moduleState, changed, err := injectVolumeAttachmentChanged(params, tfstate)
+		if err != nil {
+			die("%s", err)
+		}
+		attachmentResourceID := params.attachmentResourceID()
+		added[attachmentResourceID] = moduleState.Resources[attachmentResourceID]
+		if changed {
+			changelog = append(changelog, newChangelogEntry(moduleState, attachmentResourceID))
+		}
+		descriptions = append(descriptions, fmt.Sprintf("%s to module %s",
+			attachmentResourceID, strings.Join(moduleState.Path, ".")))
 	}
 
-	diffString, err := formatter.NewAsciiFormatter(
-		inputJson,
-		formatter.AsciiFormatterConfig{
-			ShowArrayIndex: true,
-			Coloring:       colors,
-		},
-	).Format(diff)
+	// With --print-resource, show what would be added instead of writing it
+	if printOnly, _ := opts.Bool("--print-resource"); printOnly {
+		compact, _ := opts.Bool("--compact")
+		printResources(added, compact)
+		return
+	}
+
+	// Don't rewrite the file (or back it up) if the attachments were already there
+	if len(changelog) == 0 {
+		var resourceIDs []string
+		for resourceID := range added {
+			resourceIDs = append(resourceIDs, resourceID)
+		}
+		sort.Strings(resourceIDs)
+		fmt.Fprintf(os.Stderr, "%s already present, no changes\n", strings.Join(resourceIDs, ", "))
+		return
+	}
+	prepareOutputState(opts, tfstate)
+
+	// Preview the change from the very bytes that will be written, after
+	// "--sort-keys" and "--canonical"
+	outputData := encodeTfStateFile(opts, tfstate, inputBytes)
+	if showDiff, _ := opts.Bool("--show-diff"); showDiff {
+		if onlyNew, _ := opts.Bool("--diff-only-new"); onlyNew {
+			fmt.Fprint(os.Stderr, renderAddedDiff(opts, added, os.Stderr))
+		} else {
+			fmt.Fprint(os.Stderr, renderJSONDiff(opts, inputBytes, outputData, os.Stderr))
+		}
+	}
+
+	// Write out tfstate
+	confirmWrite(opts, "Adding "+strings.Join(descriptions, ", "), true)
+	writeEncodedTfStateFile(ctx, opts, tfstate, outputData)
+	recordChangelog(opts, changelog)
+}
+
+// Remove the attachment specified in opts, reading from "-i", writing to "-o"
+func removeMode(ctx context.Context, opts docopt.Opts) {
+	tfstate, inputBytes := readTfStateFile(ctx, opts)
+
+	attachmentName, err := stateResourceName(opts["<att-name>"].(string))
+	if err != nil {
+		die("%s", err)
+	}
+	modulePath, _ := opts.String("--module")
+	types := resourceTypesFromOpts(opts)
+	moduleState, err := removeVolumeAttachment(types.attachment, attachmentName, modulePath, tfstate)
 	if err != nil {
-		die("Error formatting diff: %s", err)
+		die("%s", err)
 	}
+	prepareOutputState(opts, tfstate)
 
-	fmt.Printf(diffString)
+	confirmWrite(opts, fmt.Sprintf("Removing %s.%s from module %s",
+		types.attachment, attachmentName, strings.Join(moduleState.Path, ".")), false)
+	writeTfStateFile(ctx, opts, tfstate, inputBytes)
 }
 
-// Import the attachment specified in opts, reading from "-i", writing to "-o"
-func importMode(opts docopt.Opts) {
-	// Read input file
-	tfstate, _ := readTfState(opts)
+// Update a modified tfstate before it's written out: bump its serial and apply
+// "--state-version", which defaults to the version that was read
+func prepareOutputState(opts docopt.Opts, tfstate *terraform.State) {
+	tfstate.Serial++
 
-	// Modify it
-	injectVolumeAttachment(opts, &tfstate)
+	versionArg, _ := opts.String("--state-version")
+	if versionArg == "" {
+		return
+	}
+	version, err := strconv.Atoi(versionArg)
+	if err != nil {
+		die("Invalid --state-version: %s", err)
+	}
+	if err := checkStateVersion(version); err != nil {
+		die("%s", err)
+	}
+	tfstate.Version = version
+}
+
+// Make sure we can serialize tfstate in the given version. Only the format
+// read and written by terraform.State is supported.
+func checkStateVersion(version int) error {
+	if version > terraform.StateVersion {
+		return fmt.Errorf("Can't write state version %d, only version %d is supported. Terraform 0.12 "+
+			"and later upgrade a version %d state themselves, so import into it as is and let the "+
+			"new terraform convert it", version, terraform.StateVersion, terraform.StateVersion)
+	}
+	if version != terraform.StateVersion {
+		return fmt.Errorf("Can't write state version %d, only version %d is supported",
+			version, terraform.StateVersion)
+	}
+	return nil
+}
+
+// Tell the user what we're about to write where, asking for confirmation if
+// running on a terminal without "--yes". With requireYes, writing a file
+// without "--yes" when there's no terminal to ask on is an error rather than
+// going ahead unconfirmed.
+func confirmWrite(opts docopt.Opts, action string, requireYes bool) {
+	var outputPaths, filePaths []string
+	if workspaceArg, _ := opts.String("--tfc-workspace"); workspaceArg != "" {
+		outputPaths = []string{"Terraform Cloud workspace " + workspaceArg}
+		filePaths = outputPaths
+	} else {
+		for _, outputFileName := range resolveOutputFileNames(opts) {
+			if outputFileName == "-" {
+				outputPaths = append(outputPaths, "<stdout>")
+				continue
+			}
+			outputPath := outputFileName
+			if absPath, err := filepath.Abs(outputFileName); err == nil {
+				outputPath = absPath
+			}
+			outputPaths = append(outputPaths, outputPath)
+			filePaths = append(filePaths, outputPath)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%s in %s\n", action, strings.Join(outputPaths, ", "))
+	if yes, _ := opts.Bool("--yes"); yes {
+		return
+	}
+	if isatty.IsTerminal(os.Stdin.Fd()) {
+		if !confirm("Proceed?") {
+			die("Aborted, no changes written", nil)
+		}
+	} else if requireYes && len(filePaths) > 0 {
+		die("Not running interactively, pass --yes to write "+strings.Join(filePaths, ", "), nil)
+	}
+}
 
-	// Encode and write out tfstate
-	writeTfState(opts, tfstate)
+// Ask the user a yes/no question on the terminal, defaulting to no. A single
+// keystroke answers it.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer := make([]byte, 1)
+	if oldState, err := term.MakeRaw(int(os.Stdin.Fd())); err == nil {
+		_, err = os.Stdin.Read(answer)
+		term.Restore(int(os.Stdin.Fd()), oldState)
+		fmt.Fprint(os.Stderr, "\n")
+		return err == nil && (answer[0] == 'y' || answer[0] == 'Y')
+	}
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	line = strings.ToLower(strings.TrimSpace(line))
+	return line == "y" || line == "yes"
 }
 
 // Read tfstate from the file specified by "-i"
-func readTfState(opts docopt.Opts) (terraform.State, []byte) {
+func readTfStateFile(ctx context.Context, opts docopt.Opts) (*terraform.State, []byte) {
 	// Parse options
 	inputFileName, _ := opts.String("-i")
-	if inputFileName == "-" {
-		inputFileName = "/dev/stdin"
+	inputFileName = resolveStateFileName(inputFileName)
+
+	// Read in Terraform state
+	lenient, _ := opts.Bool("--lenient")
+	decryptCommand, _ := opts.String("--decrypt-cmd")
+	var tfstate *terraform.State
+	var inputData []byte
+	workspace, err := tfcWorkspaceFromOpts(opts)
+	if err != nil {
+		die("%s", err)
 	}
-	if inputFileName == "" {
-		inputFileName = "terraform.tfstate"
+	if workspace != nil {
+		tfstate, inputData, err = readTfStateTFC(ctx, workspace, lenient)
+	} else if inputFileName == "-" {
+		// Typically the output of "terraform state pull"
+		if isatty.IsTerminal(os.Stdin.Fd()) {
+			die("Reading state from stdin, which is a terminal; pipe it in, "+
+				"e.g. \"terraform state pull | tf-ebs-attach ... -i -\"", nil)
+		}
+		tfstate, inputData, err = readEncryptedTfState(os.Stdin, decryptCommand, lenient)
+	} else if isStateURL(inputFileName) {
+		if decryptCommand != "" {
+			die("--decrypt-cmd can't be used with a URL", nil)
+		}
+		headers, _ := opts["--header"].([]string)
+		tfstate, inputData, err = readTfStateURL(ctx, inputFileName, headers, lenient)
+	} else if decryptCommand != "" {
+		var inputFile *os.File
+		if inputFile, err = os.Open(inputFileName); err != nil {
+			exitIfInputMissing(opts, inputFileName, err)
+			die("Error reading input file: %s", err)
+		}
+		tfstate, inputData, err = readEncryptedTfState(inputFile, decryptCommand, lenient)
+		inputFile.Close()
+	} else {
+		tfstate, inputData, err = readTfStatePath(inputFileName, lenient)
+		exitIfInputMissing(opts, inputFileName, err)
 	}
+	if err != nil {
+		exitIfTimedOut(ctx)
+		die("%s", err)
+	}
+	if err := checkStateLimits(tfstate, stateLimitsFromOpts(opts)); err != nil {
+		die("%s", err)
+	}
+	return tfstate, inputData
+}
 
-	// Read in Terraform state
-	tfstate := terraform.State{}
-	inputData, err := ioutil.ReadFile(inputFileName)
+// Read tfstate from the named file
+func readTfStatePath(fileName string, lenient bool) (*terraform.State, []byte, error) {
+	inputFile, err := os.Open(fileName)
 	if err != nil {
-		die("Error reading input file: %s", err)
+		return nil, nil, fmt.Errorf("Error reading input file: %w", err)
 	}
-	if err = json.Unmarshal(inputData, &tfstate); err != nil {
-		die("Error parsing input file as JSON: %s", err)
+	defer inputFile.Close()
+
+	return readTfState(inputFile, lenient)
+}
+
+// Whether the JSON in data has a top-level "resources" key, as version 4 states
+// do instead of "modules". Such states decode to a State without any modules.
+func hasTopLevelResources(data []byte) bool {
+	var layout struct {
+		Resources json.RawMessage `json:"resources"`
 	}
+	return json.Unmarshal(data, &layout) == nil && layout.Resources != nil
+}
 
-	return tfstate, inputData
+// Newest state format this tool understands. Newer states are refused by
+// readTfState since editing them as this format could corrupt them.
+const maxSupportedVersion = 3
+
+// Read tfstate from r, returning it along with the raw bytes read. If lenient
+// is set, comments and trailing commas are removed from the returned bytes.
+func readTfState(r io.Reader, lenient bool) (*terraform.State, []byte, error) {
+	inputData, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error reading input file: %s", err)
+	}
+	// "terraform state pull" prints nothing when there's no state yet
+	if len(bytes.TrimSpace(inputData)) == 0 {
+		return nil, nil, fmt.Errorf("Input is empty, there is no state to modify")
+	}
+	if lenient {
+		inputData = stripJSONExtensions(inputData)
+	}
+
+	tfstate := &terraform.State{}
+	if err = json.Unmarshal(inputData, tfstate); err != nil {
+		return nil, nil, fmt.Errorf("Error parsing input file as JSON: %s", err)
+	}
+	if tfstate.Version > maxSupportedVersion {
+		if !forceVersion {
+			return nil, nil, fmt.Errorf("State version %d is newer than this tool supports (%d), "+
+				"please upgrade tf-ebs-attach (or use --force-version at your own risk): %w",
+				tfstate.Version, maxSupportedVersion, errUnsupportedStateVersion)
+		}
+		warnf("state version %d is newer than this tool supports (%d), continuing due to --force-version",
+			tfstate.Version, maxSupportedVersion)
+	}
+	// Scanning a large state for these is slow, so only done to report them
+	if verbose {
+		if unknownKeys := unknownStateKeys(inputData); len(unknownKeys) > 0 {
+			verbosef("keeping top-level key(s) %s, which this tool doesn't model, unchanged",
+				stateKeyNames(unknownKeys))
+		}
+	}
+	if len(tfstate.Modules) == 0 && hasTopLevelResources(inputData) {
+		return nil, nil, fmt.Errorf("This state (version %d) lists its resources at the top level, "+
+			"as terraform 0.12+ does, and can't be edited by this tool yet: %w", tfstate.Version,
+			errUnsupportedStateVersion)
+	}
+	return tfstate, inputData, nil
 }
 
-// Write out the tfstate to the file specified by "-o"
-func writeTfState(opts docopt.Opts, tfstate terraform.State) {
-	outputFileName, _ := opts.String("-o")
-	if outputFileName == "-" {
-		outputFileName = "/dev/stdout"
+// Determine the file names specified by "-o", "-" meaning standard output.
+// Each is only listed once.
+func resolveOutputFileNames(opts docopt.Opts) []string {
+	outputFileNames, _ := opts["-o"].([]string)
+	if len(outputFileNames) == 0 {
+		outputFileNames = []string{""}
+	}
+	var resolved []string
+	seen := make(map[string]bool)
+	for _, outputFileName := range outputFileNames {
+		outputFileName = resolveOutputFileName(opts, outputFileName)
+		if !seen[outputFileName] {
+			seen[outputFileName] = true
+			resolved = append(resolved, outputFileName)
+		}
 	}
-	if outputFileName == "" {
-		outputFileName = "terraform.tfstate"
+	return resolved
+}
+
+// Resolve one "-o" value, which may be empty
+func resolveOutputFileName(opts docopt.Opts, outputFileName string) string {
+	outputFileName = resolveStateFileName(outputFileName)
+	if isStateURL(outputFileName) {
+		die("Writing state to a URL is not supported, use -o to name a local file", nil)
 	}
 
-	outputData, err := json.MarshalIndent(tfstate, "", "    ")
+	// Leave the input alone unless asked to replace it
+	if inPlace, _ := opts.Bool("--in-place"); !inPlace && outputFileName != "-" {
+		inputFileName, _ := opts.String("-i")
+		if isSameFile(resolveStateFileName(inputFileName), outputFileName) {
+			outputFileName += ".new"
+		}
+	}
+	return outputFileName
+}
+
+// Whether the paths a and b name the same file, which needn't exist yet
+func isSameFile(a, b string) bool {
+	aInfo, aErr := os.Stat(a)
+	bInfo, bErr := os.Stat(b)
+	if aErr == nil && bErr == nil {
+		return os.SameFile(aInfo, bInfo)
+	}
+	aAbs, aErr := filepath.Abs(a)
+	bAbs, bErr := filepath.Abs(b)
+	return aErr == nil && bErr == nil && aAbs == bAbs
+}
+
+// Environment variables naming the state file, in order of precedence
+var stateFileEnvVars = []string{"TF_EBS_ATTACH_STATE", "TF_STATE"}
+
+// Fall back to the environment and then to the local state of the current
+// terraform workspace if fileName (the value of "-i" or "-o") is empty
+func resolveStateFileName(fileName string) string {
+	if fileName != "" {
+		return fileName
+	}
+	for _, name := range stateFileEnvVars {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return workspaceStateFileName(currentWorkspace())
+}
+
+// Determine the selected terraform workspace the way terraform does: from
+// $TF_WORKSPACE, or else the "environment" file in the data directory, which
+// is $TF_DATA_DIR or ".terraform". Returns "" if neither is set.
+func currentWorkspace() string {
+	if workspace := os.Getenv("TF_WORKSPACE"); workspace != "" {
+		return workspace
+	}
+	dataDir := os.Getenv("TF_DATA_DIR")
+	if dataDir == "" {
+		dataDir = ".terraform"
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dataDir, "environment"))
 	if err != nil {
-		die("Error encoding output to JSON: %s", err)
+		return ""
 	}
-	outputData = append(outputData, []byte("\n")[0])
-	err = ioutil.WriteFile(outputFileName, outputData, 0644)
+	return strings.TrimSpace(string(data))
+}
+
+// Path of the local state of workspace, relative to the working directory
+func workspaceStateFileName(workspace string) string {
+	if workspace == "" || workspace == "default" {
+		return "terraform.tfstate"
+	}
+	return filepath.Join("terraform.tfstate.d", workspace, "terraform.tfstate")
+}
+
+// Write out the tfstate to each file specified by "-o", keeping the previous
+// contents of the file in "<file>.backup", or upload it to the workspace
+// given by "--tfc-workspace". Line endings follow inputData, the state as it
+// was read.
+func writeTfStateFile(ctx context.Context, opts docopt.Opts, tfstate *terraform.State, inputData []byte) {
+	// Encode fully before touching the output file, which may be the input file
+	writeEncodedTfStateFile(ctx, opts, tfstate, encodeTfStateFile(opts, tfstate, inputData))
+}
+
+// Write out outputData, tfstate as encoded by encodeTfStateFile, like
+// writeTfStateFile
+func writeEncodedTfStateFile(ctx context.Context, opts docopt.Opts, tfstate *terraform.State, outputData []byte) {
+	outputFileNames := resolveOutputFileNames(opts)
+	decryptCommand, _ := opts.String("--decrypt-cmd")
+	encryptCommand, _ := opts.String("--encrypt-cmd")
+	if decryptCommand != "" && encryptCommand == "" {
+		for _, outputFileName := range outputFileNames {
+			if outputFileName != "-" {
+				die("Refusing to write the decrypted state to "+outputFileName+", pass --encrypt-cmd", nil)
+			}
+		}
+	}
+
+	if encryptCommand != "" {
+		var err error
+		if outputData, err = runFilterCommand(encryptCommand, bytes.NewReader(outputData)); err != nil {
+			die("%s", err)
+		}
+	}
+	exitIfTimedOut(ctx)
+	if workspace, err := tfcWorkspaceFromOpts(opts); err != nil {
+		die("%s", err)
+	} else if workspace != nil {
+		if err := writeTfStateTFC(ctx, workspace, tfstate, outputData); err != nil {
+			exitIfTimedOut(ctx)
+			die("%s", err)
+		}
+		return
+	}
+	writeOutputFiles(ctx, opts, outputData)
+}
+
+// Encode tfstate as writeTfStateFile writes it, applying "--sort-keys",
+// "--compact", "--canonical" and "--drop-unknown" from opts
+func encodeTfStateFile(opts docopt.Opts, tfstate *terraform.State, inputData []byte) []byte {
+	if sortKeys, _ := opts.Bool("--sort-keys"); sortKeys {
+		sortTfState(tfstate)
+	}
+	format := detectStateFormat(inputData)
+	format.compact, _ = opts.Bool("--compact")
+	if canonical, _ := opts.Bool("--canonical"); canonical {
+		canonicalizeTfState(tfstate)
+		unknownKeys := format.unknownKeys
+		format = defaultStateFormat
+		format.unknownKeys = unknownKeys
+	}
+	if dropUnknown, _ := opts.Bool("--drop-unknown"); dropUnknown && len(format.unknownKeys) > 0 {
+		warnf("dropping unknown top-level key(s) %s", stateKeyNames(format.unknownKeys))
+		format.unknownKeys = nil
+	}
+	var encoded bytes.Buffer
+	if err := writeTfState(&encoded, tfstate, format); err != nil {
+		die("%s", err)
+	}
+	return encoded.Bytes()
+}
+
+// Write outputData to each file specified by "-o", keeping the previous
+// contents of the file in "<file>.backup"
+func writeOutputFiles(ctx context.Context, opts docopt.Opts, outputData []byte) {
+	// Once the first output is written, the rest are too despite an
+	// interruption, so they don't disagree
+	writeCtx := ctx
+	for _, outputFileName := range resolveOutputFileNames(opts) {
+		if outputFileName == "-" {
+			if _, err := os.Stdout.Write(outputData); err != nil {
+				die("Error writing output file: %s", err)
+			}
+			writeCtx = context.Background()
+			continue
+		}
+		if err := backupFile(outputFileName); err != nil {
+			die("Error backing up output file: %s", err)
+		}
+		err := writeFileAtomic(writeCtx, outputFileName, outputData, 0644)
+		if err != nil {
+			exitIfTimedOut(writeCtx)
+			die("Error writing output file: %s", err)
+		}
+		writeCtx = context.Background()
+	}
+}
+
+// Copy fileName to "<fileName>.backup" if it's an existing regular file
+func backupFile(fileName string) error {
+	info, err := os.Stat(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	// Copied without reading it all in, as the state may be large
+	input, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	backup, err := os.OpenFile(fileName+".backup", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
 	if err != nil {
-		die("Error writing output file: %s", err)
+		return err
+	}
+	if _, err := io.Copy(backup, input); err != nil {
+		backup.Close()
+		return err
+	}
+	if err := backup.Close(); err != nil {
+		return err
 	}
+	metrics.BackupCreated = true
+	return nil
 }
 
-// Modify the given tfstate by adding the volume attachment specified in opts
-func injectVolumeAttachment(opts docopt.Opts, tfstate *terraform.State) {
-	instanceName, _ := opts.String("<inst-name>")
-	volumeName, _ := opts.String("<vol-name>")
-	attachmentName, _ := opts.String("<att-name>")
-	deviceName, _ := opts.String("<dev>")
+// Put the modules of tfstate in the order terraform uses, by path length and
+// then path, and sort their and their resources' dependencies
+func sortTfState(tfstate *terraform.State) {
+	sort.SliceStable(tfstate.Modules, func(i, j int) bool {
+		a, b := tfstate.Modules[i].Path, tfstate.Modules[j].Path
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return strings.Join(a, ".") < strings.Join(b, ".")
+	})
+	for _, moduleState := range tfstate.Modules {
+		sort.Strings(moduleState.Dependencies)
+		for _, resourceState := range moduleState.Resources {
+			sort.Strings(resourceState.Dependencies)
+		}
+	}
+}
 
-	// Locate our instance and volume
-	instanceResourceID := "aws_instance." + instanceName
-	volumeResourceID := "aws_ebs_volume." + volumeName
+// Bring tfstate into the form terraform's own WriteState produces: the
+// current version, sorted as by sortTfState and with no null lists or maps
+func canonicalizeTfState(tfstate *terraform.State) {
+	tfstate.Version = terraform.StateVersion
+	if tfstate.Modules == nil {
+		tfstate.Modules = []*terraform.ModuleState{}
+	}
 	for _, moduleState := range tfstate.Modules {
-		//fmt.Printf("moduleState[%d]: %+v\n", i, moduleState)
+		if moduleState.Path == nil {
+			moduleState.Path = terraform.RootModulePath
+		}
+		if moduleState.Outputs == nil {
+			moduleState.Outputs = map[string]*terraform.OutputState{}
+		}
+		if moduleState.Resources == nil {
+			moduleState.Resources = map[string]*terraform.ResourceState{}
+		}
+		if moduleState.Dependencies == nil {
+			moduleState.Dependencies = []string{}
+		}
+		for _, resourceState := range moduleState.Resources {
+			if resourceState.Dependencies == nil {
+				resourceState.Dependencies = []string{}
+			}
+			if resourceState.Deposed == nil {
+				resourceState.Deposed = []*terraform.InstanceState{}
+			}
+			if resourceState.Primary == nil {
+				resourceState.Primary = &terraform.InstanceState{}
+			}
+			for _, instanceState := range append([]*terraform.InstanceState{resourceState.Primary},
+				resourceState.Deposed...) {
+				if instanceState.Attributes == nil {
+					instanceState.Attributes = map[string]string{}
+				}
+				if instanceState.Meta == nil {
+					instanceState.Meta = map[string]interface{}{}
+				}
+			}
+		}
+	}
+	sortTfState(tfstate)
+}
+
+// Line ending conventions of a state file, and what it has beyond what
+// terraform.State models
+type stateFormat struct {
+	newline         string // "\n" or "\r\n"
+	trailingNewline bool
+	compact         bool       // no indentation or newlines within the JSON
+	unknownKeys     []stateKey // top-level keys carried over from the input
+}
+
+// Format used for new state files, the same as terraform's
+var defaultStateFormat = stateFormat{newline: "\n", trailingNewline: true}
+
+// Work out the line endings used in data and its unknown top-level keys,
+// falling back to defaultStateFormat if it's empty
+func detectStateFormat(data []byte) stateFormat {
+	if len(data) == 0 {
+		return defaultStateFormat
+	}
+	format := stateFormat{newline: "\n"}
+	if i := bytes.IndexByte(data, '\n'); i > 0 && data[i-1] == '\r' {
+		format.newline = "\r\n"
+	}
+	format.trailingNewline = bytes.HasSuffix(data, []byte("\n"))
+	format.unknownKeys = unknownStateKeys(data)
+	return format
+}
+
+// Write out the tfstate to w as indented JSON with the given line endings,
+// followed by any unknown keys carried over in format
+func writeTfState(w io.Writer, tfstate *terraform.State, format stateFormat) error {
+	var outputData []byte
+	var err error
+	if format.compact {
+		outputData, err = json.Marshal(tfstate)
+	} else {
+		outputData, err = json.MarshalIndent(tfstate, "", "    ")
+	}
+	if err == nil {
+		outputData, err = appendStateKeys(outputData, format.unknownKeys, format.compact)
+	}
+	if err != nil {
+		return fmt.Errorf("Error encoding output to JSON: %s", err)
+	}
+	// Encoded strings never contain a raw newline, so this only touches
+	// the indentation
+	if format.newline != "\n" {
+		outputData = bytes.Replace(outputData, []byte("\n"), []byte(format.newline), -1)
+	}
+	if format.trailingNewline {
+		outputData = append(outputData, format.newline...)
+	}
+	if _, err = w.Write(outputData); err != nil {
+		return fmt.Errorf("Error writing output file: %s", err)
+	}
+	return nil
+}
+
+// Parameters describing the volume attachment to inject into a tfstate
+type injectParams struct {
+	instanceName   string
+	volumeName     string
+	attachmentName string
+	deviceName     string
+	skipAttached   bool
+	provider       string
+	instanceID     string // overrides the ID of the matched instance if set
+	volumeID       string // overrides the ID of the matched volume if set
+	types          resourceTypes
+	force          bool              // add the attachment even if its device is in use
+	attributes     map[string]string // extra attributes, overriding calculated ones
+	under          string            // only search modules under this path, e.g. "root.app1"
+	allowTainted   bool              // attach to a tainted instance or volume
+	attachmentID   string            // overrides the calculated "vai-" ID if set
+	rootOnly       bool              // only search the root module
+	nameRegex      bool              // instanceName and volumeName are regular expressions
+	extraDeps      []string          // added to the attachment's dependencies
+}
+
+// Key of the attachment resource within its module
+func (params injectParams) attachmentResourceID() string {
+	return params.types.withDefaults().attachment + "." + params.attachmentName
+}
+
+// Collect the injectParams from the positional arguments and options in opts,
+// one for each pair of names in the comma-separated <att-name> and <dev>, one
+// for each "--attach", or with "--from-tags" one whose <att-name> and <dev>
+// are read from the volume's tags in tfstate
+func newInjectParams(opts docopt.Opts, tfstate *terraform.State) []injectParams {
+	var paramsList []injectParams
+	if fromTags, _ := opts.Bool("--from-tags"); fromTags {
+		params := injectParams{}
+		params.instanceName, _ = opts.String("<inst-name>")
+		volumeName, err := stateResourceName(opts["<vol-name>"].(string))
+		if err != nil {
+			die("%s", err)
+		}
+		params.volumeName = volumeName
+		params.types = resourceTypesFromOpts(opts)
+		params.under, _ = opts.String("--under")
+		keys := volumeTagKeys{}
+		keys.device, _ = opts.String("--device-tag")
+		keys.attachment, _ = opts.String("--name-tag")
+		params, err = injectParamsFromTags(params, keys, tfstate)
+		if err != nil {
+			die("%s", err)
+		}
+		paramsList = append(paramsList, params)
+	} else if groups, _ := opts["--attach"].([]string); len(groups) > 0 {
+		var err error
+		if paramsList, err = parseAttachGroups(groups); err != nil {
+			die("%s", err)
+		}
+	} else {
+		attachmentArg, _ := opts.String("<att-name>")
+		deviceArg, _ := opts.String("<dev>")
+		attachmentNames, deviceNames, err := splitAttachmentDevices(attachmentArg, deviceArg)
+		if err != nil {
+			die("%s", err)
+		}
+		for i := range attachmentNames {
+			params := injectParams{}
+			params.instanceName, _ = opts.String("<inst-name>")
+			params.volumeName, _ = opts.String("<vol-name>")
+			params.attachmentName = attachmentNames[i]
+			params.deviceName = deviceNames[i]
+			paramsList = append(paramsList, params)
+		}
+	}
+
+	fillInjectParams(opts, paramsList)
+	return paramsList
+}
+
+// Complete paramsList, which has just the four positional values set, with
+// the options in opts that apply to every attachment
+func fillInjectParams(opts docopt.Opts, paramsList []injectParams) {
+	if attachmentID, _ := opts.String("--attachment-id"); attachmentID != "" && len(paramsList) > 1 {
+		die("--attachment-id can only be given when adding a single attachment", nil)
+	}
+	for i := range paramsList {
+		params := &paramsList[i]
+		attachmentName, err := stateResourceName(params.attachmentName)
+		if err != nil {
+			die("%s", err)
+		}
+		params.attachmentName = attachmentName
+		params.deviceName = normalizeDeviceNameFromOpts(opts, params.deviceName)
+		if strict, _ := opts.Bool("--strict-device"); strict {
+			allowReserved, _ := opts.Bool("--allow-reserved-device")
+			if err := checkReservedDevice(params.deviceName, allowReserved); err != nil {
+				die("%s", err)
+			}
+		}
+		params.skipAttached, _ = opts.Bool("--skip-attached")
+		params.provider, _ = opts.String("--provider")
+		params.instanceID, _ = opts.String("--instance-id")
+		params.volumeID, _ = opts.String("--volume-id")
+		params.types = resourceTypesFromOpts(opts)
+		params.force, _ = opts.Bool("--force")
+		params.attributes = attributesFromOpts(opts)
+		params.extraDeps = extraDepsFromOpts(opts)
+		params.under, _ = opts.String("--under")
+		params.allowTainted, _ = opts.Bool("--allow-tainted")
+		params.attachmentID, _ = opts.String("--attachment-id")
+		params.rootOnly, _ = opts.Bool("--root-only")
+		params.nameRegex, _ = opts.Bool("--name-regex")
+		if params.nameRegex {
+			for _, pattern := range []string{params.instanceName, params.volumeName} {
+				if _, err := regexp.Compile(pattern); err != nil {
+					die(fmt.Sprintf("Invalid --name-regex pattern \"%s\": %s", pattern, err), nil)
+				}
+			}
+		} else if params.volumeName, err = stateResourceName(params.volumeName); err != nil {
+			die("%s", err)
+		}
+	}
+}
+
+// Parse "--attach" groups of the form "inst-name:vol-name:att-name:dev" into
+// injectParams with just those four fields set
+func parseAttachGroups(groups []string) ([]injectParams, error) {
+	var paramsList []injectParams
+	seen := make(map[string]bool)
+	for _, group := range groups {
+		parts := strings.Split(group, ":")
+		if len(parts) != 4 || parts[0] == "" || parts[1] == "" || parts[2] == "" || parts[3] == "" {
+			return nil, fmt.Errorf("Malformed --attach \"%s\", expected \"inst-name:vol-name:att-name:dev\"", group)
+		}
+		if seen[parts[2]] {
+			return nil, fmt.Errorf("Attachment name \"%s\" given more than once", parts[2])
+		}
+		seen[parts[2]] = true
+
+		paramsList = append(paramsList, injectParams{
+			instanceName:   parts[0],
+			volumeName:     parts[1],
+			attachmentName: parts[2],
+			deviceName:     parts[3],
+		})
+	}
+	return paramsList, nil
+}
+
+// Split the comma-separated <att-name> and <dev> arguments into lists of the
+// same length, pairing each attachment with a device
+func splitAttachmentDevices(attachmentArg, deviceArg string) ([]string, []string, error) {
+	attachmentNames := strings.Split(attachmentArg, ",")
+	deviceNames := strings.Split(deviceArg, ",")
+	if len(attachmentNames) != len(deviceNames) {
+		return nil, nil, fmt.Errorf("Got %d attachment name(s) but %d device name(s), they must pair up",
+			len(attachmentNames), len(deviceNames))
+	}
+
+	seen := make(map[string]bool)
+	for i := range attachmentNames {
+		if attachmentNames[i] == "" || deviceNames[i] == "" {
+			return nil, nil, fmt.Errorf("Empty attachment or device name in \"%s\" / \"%s\"",
+				attachmentArg, deviceArg)
+		}
+		if seen[attachmentNames[i]] {
+			return nil, nil, fmt.Errorf("Attachment name \"%s\" given more than once", attachmentNames[i])
+		}
+		seen[attachmentNames[i]] = true
+	}
+	return attachmentNames, deviceNames, nil
+}
+
+// Modify the given tfstate by adding the volume attachment described by params,
+// returning the module it was added to
+func injectVolumeAttachment(params injectParams, tfstate *terraform.State) (*terraform.ModuleState, error) {
+	// Locate our instance and volume
+	types := params.types.withDefaults()
+	instanceResourceID := types.instance + "." + params.instanceName
+	volumeResourceID := types.volume + "." + params.volumeName
+	attachmentResourceID := params.attachmentResourceID()
+	instanceFound, attachedFound := false, false
+	var candidates []string // for --name-regex, resources in modules without a match
+	modules := tfstate.Modules
+	if params.rootOnly {
+		modules = nil
+		for _, moduleState := range tfstate.Modules {
+			if reflect.DeepEqual(moduleState.Path, terraform.RootModulePath) {
+				modules = []*terraform.ModuleState{moduleState}
+				break
+			}
+		}
+	}
+	for i, moduleState := range modules {
+		metrics.ModulesScanned++
+		modulePath := strings.Join(moduleState.Path, ".")
+		if params.under != "" && !modulePathHasPrefix(moduleState.Path, params.under) {
+			verbosef("checking module %s: not under %s", modulePath, params.under)
+			continue
+		}
+		// With --name-regex, the names are patterns to match in each module
+		instanceName, volumeName := params.instanceName, params.volumeName
+		if params.nameRegex {
+			var err error
+			if instanceName, err = matchResourceName(moduleState.Resources, types.instance, params.instanceName); err != nil {
+				return nil, fmt.Errorf("%s in module %s", err, modulePath)
+			}
+			if volumeName, err = matchResourceName(moduleState.Resources, types.volume, params.volumeName); err != nil {
+				return nil, fmt.Errorf("%s in module %s", err, modulePath)
+			}
+			if instanceName == "" || volumeName == "" {
+				candidates = append(candidates, resourceNamesOfType(moduleState, types.instance, types.volume)...)
+			}
+		}
+		instanceResourceID := types.instance + "." + instanceName
+		volumeResourceID := types.volume + "." + volumeName
+
 		instanceState, found := moduleState.Resources[instanceResourceID]
 		if !found {
+			verbosef("checking module %s: instance not found", modulePath)
+			continue
+		}
+		instanceFound = true
+		// With --skip-attached, walk past modules that already have the attachment
+		if _, attached := moduleState.Resources[attachmentResourceID]; attached && params.skipAttached {
+			verbosef("checking module %s: instance found, already attached", modulePath)
+			attachedFound = true
 			continue
 		}
 		volumeState, found := moduleState.Resources[volumeResourceID]
-		if found {
-			moduleState.Resources["aws_volume_attachment."+attachmentName] =
-				newAwsVolumeAttachmentState(instanceState.Primary.ID, volumeName, volumeState.Primary.ID, deviceName)
-			return
+		if !found {
+			verbosef("checking module %s: instance found, volume not found", modulePath)
+			continue
+		}
+		verbosef("checking module %s: instance found, volume found", modulePath)
+		verbosef("scanned %d of %d modules", i+1, len(modules))
+
+		// A resource without a primary instance was never applied, so there's
+		// no ID to attach. A tainted one is replaced on the next apply, leaving
+		// the attachment's ID referring to the old one.
+		for _, resource := range []struct {
+			id    string
+			state *terraform.ResourceState
+		}{{instanceResourceID, instanceState}, {volumeResourceID, volumeState}} {
+			if resource.state.Primary == nil {
+				return nil, fmt.Errorf("%s in module %s has no primary instance in state; "+
+					"run terraform apply first: %w", resource.id, modulePath, errResourceNotApplied)
+			}
+			if !resource.state.Primary.Tainted {
+				continue
+			}
+			if !params.allowTainted {
+				return nil, fmt.Errorf("%s in module %s is tainted and will be replaced, so \"%s\" would "+
+					"refer to an ID about to be destroyed (use --allow-tainted to add it anyway): %w",
+					resource.id, modulePath, attachmentResourceID, errResourceTainted)
+			}
+			warnf("%s in module %s is tainted and will be replaced", resource.id, modulePath)
+		}
+
+		// The attachment must be managed by the same provider as its instance
+		provider := instanceState.Provider
+		if provider == "" {
+			provider = params.provider
+		}
+		instanceID, volumeID := instanceState.Primary.ID, volumeState.Primary.ID
+		if params.instanceID != "" {
+			verbosef("using instance ID %s instead of \"%s\"", params.instanceID, instanceID)
+			instanceID = params.instanceID
+		}
+		if params.volumeID != "" {
+			verbosef("using volume ID %s instead of \"%s\"", params.volumeID, volumeID)
+			volumeID = params.volumeID
+		}
+		attachmentState, err := newVolumeAttachmentState(types, instanceName,
+			instanceID, volumeName, volumeID, params.deviceName, provider)
+		if err != nil {
+			// An empty primary ID usually means the resource was never applied
+			return nil, fmt.Errorf("Error adding \"%s\" to module %s: %s (have \"%s\" and \"%s\" been applied?)",
+				attachmentResourceID, modulePath, err, instanceResourceID, volumeResourceID)
+		}
+		if params.attachmentID != "" {
+			applyAttachmentID(attachmentResourceID, attachmentState, params.attachmentID)
+		}
+		applyAttributes(attachmentResourceID, attachmentState, params.attributes)
+		applyExtraDeps(attachmentState, params.extraDeps)
+
+		// Re-running the same import leaves an identical attachment alone
+		if existing, found := moduleState.Resources[attachmentResourceID]; found {
+			if sameInstanceState(existing.Primary, attachmentState.Primary) {
+				verbosef("%s already present in module %s with the same ID and attributes",
+					attachmentResourceID, modulePath)
+				return moduleState, nil
+			}
+			if !params.force {
+				return nil, fmt.Errorf("\"%s\" already exists in module %s with a different ID or attributes "+
+					"(use --force to replace it): %w", attachmentResourceID, modulePath, errResourceExists)
+			}
+			warnf("replacing %s in module %s", attachmentResourceID, modulePath)
+		}
+		for _, warning := range checkVolumeAttachedElsewhere(moduleState, types, volumeResourceID,
+			volumeID, instanceID, attachmentResourceID) {
+			warnf("%s", warning)
+		}
+		// The same attachment under another name would be managed twice
+		duplicates := checkSameAttachmentElsewhere(tfstate, types.attachment, moduleState.Path,
+			attachmentResourceID, instanceID, volumeID, params.deviceName)
+		if len(duplicates) > 0 && !params.force {
+			return nil, fmt.Errorf("%s already attaches %s to %s as %s, adding \"%s\" would duplicate it "+
+				"(use --force to add it anyway): %w", strings.Join(duplicates, ", "), volumeID, instanceID,
+				params.deviceName, attachmentResourceID, errDuplicateAttachment)
+		}
+		for _, duplicate := range duplicates {
+			warnf("%s already attaches %s to %s as %s", duplicate, volumeID, instanceID, params.deviceName)
 		}
+		// AWS rejects attaching two volumes as the same device
+		conflicts := checkDeviceInUse(moduleState, types.attachment, instanceResourceID, instanceID, params.deviceName,
+			attachmentResourceID)
+		if len(conflicts) > 0 && !params.force {
+			return nil, fmt.Errorf("Device %s is already in use: %s (use --force to add \"%s\" anyway)",
+				params.deviceName, strings.Join(conflicts, "; "), attachmentResourceID)
+		}
+		for _, conflict := range conflicts {
+			warnf("%s", conflict)
+		}
+		if mismatch := checkAvailabilityZones(instanceResourceID, instanceState, volumeResourceID,
+			volumeState); mismatch != "" {
+			if !params.force {
+				return nil, fmt.Errorf("Availability zones differ: %s (use --force to add \"%s\" anyway)",
+					mismatch, attachmentResourceID)
+			}
+			warnf("%s", mismatch)
+		}
+		// A module whose "resources" is null in hand-edited state has no map
+		if moduleState.Resources == nil {
+			moduleState.Resources = make(map[string]*terraform.ResourceState)
+		}
+		moduleState.Resources[attachmentResourceID] = attachmentState
+		metrics.ResourcesAdded++
+		verbosef("added %s to module %s", attachmentResourceID, modulePath)
+		return moduleState, nil
+	}
+	verbosef("scanned %d modules, none matched", len(modules))
+
+	where := "tfstate"
+	if params.under != "" {
+		where = "tfstate under " + params.under
+	}
+
+	notFound := errInstanceNotFound
+	if attachedFound {
+		notFound = errResourceExists
+	} else if instanceFound {
+		notFound = errVolumeNotFound
+	}
+	hint := ""
+	if params.nameRegex && len(candidates) > 0 {
+		sort.Strings(candidates)
+		hint = " (candidates: " + strings.Join(candidates, ", ") + ")"
+	}
+	if params.rootOnly {
+		return nil, fmt.Errorf("The root module doesn't contain (\"%s\", \"%s\"), and with --root-only "+
+			"no other module is searched%s: %w", instanceResourceID, volumeResourceID, hint, notFound)
+	}
+	if params.skipAttached {
+		return nil, fmt.Errorf("Could not locate module in %s containing (\"%s\", \"%s\") without \"%s\"%s: %w",
+			where, instanceResourceID, volumeResourceID, attachmentResourceID, hint, notFound)
 	}
-	die(fmt.Sprintf("Could not locate module in tfstate containing (\"%s\", \"%s\")",
-		instanceResourceID, volumeResourceID), nil)
+	return nil, fmt.Errorf("Could not locate module in %s containing (\"%s\", \"%s\")%s: %w",
+		where, instanceResourceID, volumeResourceID, hint, notFound)
+}
+
+// Whether the module path starts with prefix, given as a "."-separated path
+// such as "root.app1". A prefix matches whole path elements only, so
+// "root.app" doesn't match "root.app1".
+func modulePathHasPrefix(path []string, prefix string) bool {
+	prefixParts := strings.Split(prefix, ".")
+	if len(prefixParts) > len(path) {
+		return false
+	}
+	for i, part := range prefixParts {
+		if path[i] != part {
+			return false
+		}
+	}
+	return true
+}
+
+// Modify the given tfstate by deleting the volume attachment attachmentName,
+// returning the module it was removed from. If modulePath (e.g. "root.app1")
+// is empty, the attachment must exist in exactly one module.
+func removeVolumeAttachment(attachmentType, attachmentName, modulePath string,
+	tfstate *terraform.State) (*terraform.ModuleState, error) {
+
+	attachmentResourceID := attachmentType + "." + attachmentName
+
+	var matches []*terraform.ModuleState
+	for _, moduleState := range tfstate.Modules {
+		metrics.ModulesScanned++
+		if modulePath != "" && strings.Join(moduleState.Path, ".") != modulePath {
+			continue
+		}
+		if _, found := moduleState.Resources[attachmentResourceID]; found {
+			matches = append(matches, moduleState)
+		}
+	}
+
+	switch {
+	case len(matches) == 0 && modulePath != "":
+		return nil, fmt.Errorf("Could not locate \"%s\" in module \"%s\"", attachmentResourceID, modulePath)
+	case len(matches) == 0:
+		return nil, fmt.Errorf("Could not locate \"%s\" in tfstate", attachmentResourceID)
+	case len(matches) > 1:
+		paths := make([]string, len(matches))
+		for i, moduleState := range matches {
+			paths[i] = strings.Join(moduleState.Path, ".")
+		}
+		return nil, fmt.Errorf("\"%s\" exists in several modules (%s), use --module to pick one",
+			attachmentResourceID, strings.Join(paths, ", "))
+	}
+
+	delete(matches[0].Resources, attachmentResourceID)
+	metrics.ResourcesRemoved++
+	return matches[0], nil
+}
+
+// Inject params into tfstate as injectVolumeAttachment does, also returning
+// whether that changed the state, i.e. the attachment wasn't already there
+// as it is. Cheaper than comparing encodings of a large state before and
+// after.
+func injectVolumeAttachmentChanged(params injectParams, tfstate *terraform.State) (*terraform.ModuleState, bool, error) {
+	attachmentResourceID := params.attachmentResourceID()
+	existing := resourcesNamed(tfstate, attachmentResourceID)
+	moduleState, err := injectVolumeAttachment(params, tfstate)
+	if err != nil {
+		return nil, false, err
+	}
+	return moduleState, !existing[moduleState.Resources[attachmentResourceID]], nil
+}
+
+// The pointers to every resource named resourceID in tfstate, to tell which
+// ones an import replaced or added
+func resourcesNamed(tfstate *terraform.State, resourceID string) map[*terraform.ResourceState]bool {
+	resources := make(map[*terraform.ResourceState]bool)
+	for _, moduleState := range tfstate.Modules {
+		if resourceState := moduleState.Resources[resourceID]; resourceState != nil {
+			resources[resourceState] = true
+		}
+	}
+	return resources
+}
+
+// Whether a and b have the same ID and attributes
+func sameInstanceState(a, b *terraform.InstanceState) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.ID == b.ID && reflect.DeepEqual(a.Attributes, b.Attributes)
 }
 
 // Generate a new ResourceState describing our volume attachment
-func newAwsVolumeAttachmentState(instanceID, volumeName, volumeID, deviceName string) *terraform.ResourceState {
+func newAwsVolumeAttachmentState(instanceID, volumeName, volumeID, deviceName, provider string) (*terraform.ResourceState, error) {
+	return newVolumeAttachmentState(defaultResourceTypes, "", instanceID, volumeName, volumeID, deviceName, provider)
+}
+
+// Like newAwsVolumeAttachmentState, but with the resource types taken from
+// types. If instanceName is set, the instance is added to the dependencies
+// along with the volume, as terraform does for an attachment referencing
+// both. That makes terraform detach the volume before destroying either.
+// Dependencies are relative to the module, as in any version 3 state.
+func newVolumeAttachmentState(types resourceTypes, instanceName, instanceID, volumeName, volumeID, deviceName,
+	provider string) (*terraform.ResourceState, error) {
+
+	attachmentID, err := volumeAttachmentID(deviceName, volumeID, instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	dependencies := []string{fmt.Sprintf("%s.%s", types.volume, volumeName)}
+	if instanceName != "" {
+		dependencies = append(dependencies, fmt.Sprintf("%s.%s", types.instance, instanceName))
+		sort.Strings(dependencies)
+	}
+
 	return &terraform.ResourceState{
-		Type: "aws_volume_attachment",
-		Dependencies: []string{
-			fmt.Sprintf("aws_ebs_volume.%s", volumeName),
-		},
+		Type:         types.attachment,
+		Dependencies: dependencies,
 		Primary: &terraform.InstanceState{
-			ID: volumeAttachmentID(deviceName, volumeID, instanceID),
+			ID: attachmentID,
 			Attributes: map[string]string{
-				"id":          volumeAttachmentID(deviceName, volumeID, instanceID),
+				"id":          attachmentID,
 				"device_name": deviceName,
 				"instance_id": instanceID,
 				"volume_id":   volumeID,
@@ -254,17 +1880,63 @@ func newAwsVolumeAttachmentState(instanceID, volumeName, volumeID, deviceName st
 			Meta:    make(map[string]interface{}),
 			Tainted: false,
 		},
-		Deposed: []*terraform.InstanceState{},
+		Deposed:  []*terraform.InstanceState{},
+		Provider: provider,
+	}, nil
+}
+
+// Print the intermediate values of the "vai-xxx" calculation, so the result can
+// be cross-checked against other tools
+func explainVolumeAttachmentID(w io.Writer, name, volumeID, instanceID string) error {
+	attachmentID, err := volumeAttachmentID(name, volumeID, instanceID)
+	if err != nil {
+		return err
 	}
+
+	buf := volumeAttachmentIDBuffer(name, volumeID, instanceID)
+	fmt.Fprintf(w, "buffer: %s\n", buf)
+	fmt.Fprintf(w, "hash:   %d\n", volumeAttachmentIDHash(buf))
+	fmt.Fprintf(w, "id:     %s\n", attachmentID)
+	return nil
 }
 
 // Calculate the "vai-xxx" value
 // From https://github.com/foxsy/tfvolattid/blob/master/tfvolattid.go
-func volumeAttachmentID(name, volumeID, instanceID string) string {
+func volumeAttachmentID(name, volumeID, instanceID string) (string, error) {
+	// A degenerate buffer would still hash to a plausible looking ID
+	for _, component := range []struct{ description, value string }{
+		{"device name", name},
+		{"volume ID", volumeID},
+		{"instance ID", instanceID},
+	} {
+		if component.value == "" {
+			return "", fmt.Errorf("Can't calculate attachment ID, the %s is empty", component.description)
+		}
+	}
+
+	buf := volumeAttachmentIDBuffer(name, volumeID, instanceID)
+	hash := volumeAttachmentIDHash(buf)
+	if debugHash {
+		fmt.Fprintf(verboseOutput, "debug-hash: buffer %q (%d bytes), hash %d\n", buf, len(buf), hash)
+	}
+	return fmt.Sprintf("vai-%d", hash), nil
+}
+
+// Hash buf the way hashcode.String does in 64-bit builds of the AWS provider,
+// where the CRC-32 always fits in an int unchanged. In a 32-bit build
+// hashcode.String would negate values of 2^31 and up, giving different IDs, so
+// the CRC is used directly regardless of the width of int.
+func volumeAttachmentIDHash(buf string) uint32 {
+	return crc32.ChecksumIEEE([]byte(buf))
+}
+
+// Build the string that gets hashed into the "vai-xxx" value
+func volumeAttachmentIDBuffer(name, volumeID, instanceID string) string {
+	components := map[string]string{"device": name, "instance": instanceID, "volume": volumeID}
 	var buf bytes.Buffer
-	buf.WriteString(fmt.Sprintf("%s-", name))
-	buf.WriteString(fmt.Sprintf("%s-", instanceID))
-	buf.WriteString(fmt.Sprintf("%s-", volumeID))
+	for _, component := range idComponentOrder {
+		buf.WriteString(fmt.Sprintf("%s-", components[component]))
+	}
 
-	return fmt.Sprintf("vai-%d", hashcode.String(buf.String()))
+	return buf.String()
 }
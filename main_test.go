@@ -0,0 +1,1321 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/docopt/docopt-go"
+	"github.com/hashicorp/terraform/helper/hashcode"
+	"github.com/hashicorp/terraform/terraform"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Rewrite the testdata/*.golden files with the current output instead of
+// comparing against them: go test -run Golden -update
+var update = flag.Bool("update", false, "update .golden files")
+
+// Compare got with testdata/<name>, or write it there with -update
+func checkGolden(t *testing.T, name string, got []byte) {
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	golden, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, golden) {
+		t.Errorf("output differs from %s:\n%s", path, got)
+	}
+}
+
+// Device/volume/instance triples for the golden ID tests, made up to cover
+// short IDs, the long (17 hex digit) format and device names with and
+// without "/dev/". They aren't taken from real state files.
+var attachmentTriples = []struct {
+	deviceName, volumeID, instanceID string
+}{
+	{"/dev/sdg", "vol-123abc", "i-abc123"},
+	{"/dev/sdh", "vol-1a2b3c4d", "i-1a2b3c4d"},
+	{"/dev/xvdf", "vol-049df61146c4d7901", "i-0598c7d356eba48d7"},
+	{"/dev/sdf", "vol-0a1b2c3d4e5f67890", "i-0123456789abcdef0"},
+	{"xvdh", "vol-0d5e0f9c1b2a3e4f5", "i-0fedcba9876543210"},
+}
+
+func TestExplainVolumeAttachmentID(t *testing.T) {
+	var out bytes.Buffer
+	for _, tt := range attachmentTriples {
+		if err := explainVolumeAttachmentID(&out, tt.deviceName, tt.volumeID, tt.instanceID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkGolden(t, "explain-id.golden", out.Bytes())
+}
+
+// Read one of the testdata/*.tfstate fixtures
+func loadTfState(t *testing.T, name string) *terraform.State {
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tfstate, _, err := readTfState(f, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tfstate
+}
+
+// Locate a resource in tfstate, returning it and the path of its module
+func findResource(tfstate *terraform.State, resourceID string) (*terraform.ResourceState, []string) {
+	for _, moduleState := range tfstate.Modules {
+		if resourceState, found := moduleState.Resources[resourceID]; found {
+			return resourceState, moduleState.Path
+		}
+	}
+	return nil, nil
+}
+
+// Option descriptions are easily misread by docopt, e.g. when a continuation
+// line starts with an option name
+func TestUsage(t *testing.T) {
+	parser := &docopt.Parser{HelpHandler: docopt.NoHelpHandler}
+	for _, argv := range [][]string{
+		{"import", "--in-place", "mysrv", "mysrv_dsk0", "mysrv_dsk0_attch", "/dev/sdg"},
+		{"diff", "-i", "-", "mysrv", "mysrv_dsk0", "mysrv_dsk0_attch", "/dev/sdg"},
+		{"remove", "mysrv_dsk0_attch"},
+		{"audit", "-i", "app.tfstate"},
+		{"show", "i-abc123", "mysrv_dsk0", "vol-123abc", "mysrv_dsk0_attch", "/dev/sdg"},
+		{"plan-diff", "--chdir", "infra", "mysrv", "mysrv_dsk0", "mysrv_dsk0_attch", "/dev/sdg"},
+		{"import", "--multi-doc", "-i", "backup.json", "mysrv", "mysrv_dsk0", "mysrv_dsk0_attch", "/dev/sdg"},
+		{"diff", "--emit-both", "--diff-only-new", "mysrv", "mysrv_dsk0", "mysrv_dsk0_attch", "/dev/sdg"},
+		{"diff", "--compare-aws", "--profile", "prod-sso", "--region", "eu-west-1"},
+		{"show", "--by-private-ip", "--profile", "prod", "10.0.1.23", "mysrv_dsk0", "vol-123abc", "mysrv_dsk0_attch", "/dev/sdg"},
+		{"import", "--by-private-ip", "--instance-id", "ip-10-0-1-23.ec2.internal", "mysrv", "mysrv_dsk0", "mysrv_dsk0_attch", "/dev/sdg"},
+	} {
+		if _, err := parser.ParseArgs(usage, argv, ""); err != nil {
+			t.Errorf("parsing %v: %s", argv, err)
+		}
+	}
+}
+
+func TestInjectVolumeAttachment(t *testing.T) {
+	tests := []struct {
+		name       string
+		fixture    string
+		params     injectParams
+		wantErr    error
+		wantPath   []string
+		instanceID string
+		volumeID   string
+	}{
+		{
+			name:    "single module match",
+			fixture: "single-module.tfstate",
+			params: injectParams{
+				instanceName: "mysrv", volumeName: "mysrv_dsk0",
+				attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+			},
+			wantPath:   []string{"root"},
+			instanceID: "i-0598c7d356eba48d7",
+			volumeID:   "vol-049df61146c4d7901",
+		},
+		{
+			name:    "module with null resources",
+			fixture: "nil-resources.tfstate",
+			params: injectParams{
+				instanceName: "mysrv", volumeName: "mysrv_dsk0",
+				attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+			},
+			wantPath:   []string{"root"},
+			instanceID: "i-0598c7d356eba48d7",
+			volumeID:   "vol-049df61146c4d7901",
+		},
+		{
+			name:    "only a module with null resources",
+			fixture: "nil-resources.tfstate",
+			params: injectParams{
+				instanceName: "mysrv", volumeName: "mysrv_dsk0",
+				attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg", under: "root.app1",
+			},
+			wantErr: errInstanceNotFound,
+		},
+		{
+			name:    "first of several modules",
+			fixture: "multi-module.tfstate",
+			params: injectParams{
+				instanceName: "srv", volumeName: "dsk",
+				attachmentName: "dsk_attch", deviceName: "/dev/sdh",
+			},
+			wantPath:   []string{"root", "app1"},
+			instanceID: "i-0a11b22c33d44e55f",
+			volumeID:   "vol-0f1e2d3c4b5a69788",
+		},
+		{
+			name:    "names matched with --name-regex",
+			fixture: "multi-module.tfstate",
+			params: injectParams{
+				instanceName: "s.v", volumeName: "d[a-z]+",
+				attachmentName: "dsk_attch", deviceName: "/dev/sdh", nameRegex: true,
+			},
+			wantPath:   []string{"root", "app1"},
+			instanceID: "i-0a11b22c33d44e55f",
+			volumeID:   "vol-0f1e2d3c4b5a69788",
+		},
+		{
+			name:    "--name-regex matches whole names only",
+			fixture: "multi-module.tfstate",
+			params: injectParams{
+				instanceName: "sr", volumeName: "dsk",
+				attachmentName: "dsk_attch", deviceName: "/dev/sdh", nameRegex: true,
+			},
+			wantErr: errInstanceNotFound,
+		},
+		{
+			name:    "restricted with --under",
+			fixture: "multi-module.tfstate",
+			params: injectParams{
+				instanceName: "srv", volumeName: "dsk",
+				attachmentName: "dsk_attch", deviceName: "/dev/sdh", under: "root.app2",
+			},
+			wantPath:   []string{"root", "app2"},
+			instanceID: "i-0b22c33d44e55f66a",
+			volumeID:   "vol-0e2d3c4b5a6978899",
+		},
+		{
+			name:    "nothing under the prefix",
+			fixture: "multi-module.tfstate",
+			params: injectParams{
+				instanceName: "srv", volumeName: "dsk",
+				attachmentName: "dsk_attch", deviceName: "/dev/sdh", under: "root.app",
+			},
+			wantErr: errInstanceNotFound,
+		},
+		{
+			name:    "root module with --root-only",
+			fixture: "single-module.tfstate",
+			params: injectParams{
+				instanceName: "mysrv", volumeName: "mysrv_dsk0",
+				attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg", rootOnly: true,
+			},
+			wantPath:   []string{"root"},
+			instanceID: "i-0598c7d356eba48d7",
+			volumeID:   "vol-049df61146c4d7901",
+		},
+		{
+			name:    "nested module ignored with --root-only",
+			fixture: "multi-module.tfstate",
+			params: injectParams{
+				instanceName: "srv", volumeName: "dsk",
+				attachmentName: "dsk_attch", deviceName: "/dev/sdh", rootOnly: true,
+			},
+			wantErr: errInstanceNotFound,
+		},
+		{
+			name:    "no match",
+			fixture: "single-module.tfstate",
+			params: injectParams{
+				instanceName: "othersrv", volumeName: "mysrv_dsk0",
+				attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+			},
+			wantErr: errInstanceNotFound,
+		},
+		{
+			name:    "instance without volume",
+			fixture: "single-module.tfstate",
+			params: injectParams{
+				instanceName: "mysrv", volumeName: "otherdsk",
+				attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+			},
+			wantErr: errVolumeNotFound,
+		},
+		{
+			name:    "differing duplicate resource is refused",
+			fixture: "attached.tfstate",
+			params: injectParams{
+				instanceName: "mysrv", volumeName: "mysrv_dsk0",
+				attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+			},
+			wantErr: errResourceExists,
+		},
+		{
+			name:    "differing duplicate resource is replaced with --force",
+			fixture: "attached.tfstate",
+			params: injectParams{
+				instanceName: "mysrv", volumeName: "mysrv_dsk0",
+				attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg", force: true,
+			},
+			wantPath:   []string{"root"},
+			instanceID: "i-0598c7d356eba48d7",
+			volumeID:   "vol-049df61146c4d7901",
+		},
+		{
+			name:    "duplicate resource with --skip-attached",
+			fixture: "attached.tfstate",
+			params: injectParams{
+				instanceName: "mysrv", volumeName: "mysrv_dsk0",
+				attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg", skipAttached: true,
+			},
+			wantErr: errResourceExists,
+		},
+		{
+			name:    "instance never applied",
+			fixture: "unapplied.tfstate",
+			params: injectParams{
+				instanceName: "mysrv", volumeName: "mysrv_dsk0",
+				attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+			},
+			wantErr: errResourceNotApplied,
+		},
+		{
+			name:    "tainted instance is refused",
+			fixture: "tainted.tfstate",
+			params: injectParams{
+				instanceName: "mysrv", volumeName: "mysrv_dsk0",
+				attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+			},
+			wantErr: errResourceTainted,
+		},
+		{
+			name:    "tainted instance with --allow-tainted",
+			fixture: "tainted.tfstate",
+			params: injectParams{
+				instanceName: "mysrv", volumeName: "mysrv_dsk0",
+				attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg", allowTainted: true,
+			},
+			wantPath:   []string{"root"},
+			instanceID: "i-0598c7d356eba48d7",
+			volumeID:   "vol-049df61146c4d7901",
+		},
+		{
+			name:    "empty state",
+			fixture: "empty.tfstate",
+			params: injectParams{
+				instanceName: "mysrv", volumeName: "mysrv_dsk0",
+				attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+			},
+			wantErr: errInstanceNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tfstate := loadTfState(t, tt.fixture)
+			moduleState, err := injectVolumeAttachment(tt.params, tfstate)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resourceState, path := findResource(tfstate, "aws_volume_attachment."+tt.params.attachmentName)
+			if resourceState == nil {
+				t.Fatal("attachment not found in state")
+			}
+			if !reflect.DeepEqual(path, tt.wantPath) {
+				t.Errorf("attachment injected into module %v, want %v", path, tt.wantPath)
+			}
+			if !reflect.DeepEqual(moduleState.Path, tt.wantPath) {
+				t.Errorf("returned module %v, want %v", moduleState.Path, tt.wantPath)
+			}
+			wantID, err := volumeAttachmentID(tt.params.deviceName, tt.volumeID, tt.instanceID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resourceState.Primary.ID != wantID {
+				t.Errorf("Primary.ID = %q, want %q", resourceState.Primary.ID, wantID)
+			}
+			wantAttributes := map[string]string{
+				"id":          wantID,
+				"device_name": tt.params.deviceName,
+				"instance_id": tt.instanceID,
+				"volume_id":   tt.volumeID,
+			}
+			if !reflect.DeepEqual(resourceState.Primary.Attributes, wantAttributes) {
+				t.Errorf("Attributes = %v, want %v", resourceState.Primary.Attributes, wantAttributes)
+			}
+		})
+	}
+}
+
+func TestInjectVolumeAttachmentTaintedWarning(t *testing.T) {
+	var warnings bytes.Buffer
+	verboseOutput = &warnings
+	defer func() { verboseOutput = os.Stderr }()
+
+	tfstate := loadTfState(t, "tainted.tfstate")
+	params := injectParams{
+		instanceName: "mysrv", volumeName: "mysrv_dsk0",
+		attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg", allowTainted: true,
+	}
+	if _, err := injectVolumeAttachment(params, tfstate); err != nil {
+		t.Fatal(err)
+	}
+	want := "Warning: aws_instance.mysrv in module root is tainted and will be replaced\n"
+	if warnings.String() != want {
+		t.Errorf("warnings = %q, want %q", warnings.String(), want)
+	}
+}
+
+func TestInjectVolumeAttachmentSkipAttached(t *testing.T) {
+	tfstate := loadTfState(t, "multi-module.tfstate")
+	params := injectParams{
+		instanceName: "srv", volumeName: "dsk",
+		attachmentName: "dsk_attch", deviceName: "/dev/sdh", skipAttached: true,
+	}
+
+	for _, wantPath := range [][]string{{"root", "app1"}, {"root", "app2"}} {
+		if _, err := injectVolumeAttachment(params, tfstate); err != nil {
+			t.Fatal(err)
+		}
+		if _, found := findModule(tfstate, wantPath).Resources["aws_volume_attachment.dsk_attch"]; !found {
+			t.Errorf("attachment not injected into module %v", wantPath)
+		}
+	}
+
+	if _, err := injectVolumeAttachment(params, tfstate); err == nil {
+		t.Error("expected an error once every module is attached")
+	}
+}
+
+// Locate the module with the given path in tfstate
+func findModule(tfstate *terraform.State, path []string) *terraform.ModuleState {
+	for _, moduleState := range tfstate.Modules {
+		if reflect.DeepEqual(moduleState.Path, path) {
+			return moduleState
+		}
+	}
+	return &terraform.ModuleState{}
+}
+
+func TestInjectVolumeAttachmentKeyedVolume(t *testing.T) {
+	tests := []struct {
+		fixture    string
+		volumeName string
+		wantDep    string
+	}{
+		{"count-volume.tfstate", "disks[1]", "aws_ebs_volume.disks.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			tfstate := loadTfState(t, tt.fixture)
+			volumeName, err := stateResourceName(tt.volumeName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			params := injectParams{
+				instanceName: "mysrv", volumeName: volumeName,
+				attachmentName: "logs_attch", deviceName: "/dev/sdg",
+			}
+			moduleState, err := injectVolumeAttachment(params, tfstate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resourceState := moduleState.Resources["aws_volume_attachment.logs_attch"]
+			if got := resourceState.Primary.Attributes["volume_id"]; got != "vol-0b2c3d4e5f6071829" {
+				t.Errorf("volume_id = %q, want the second volume's", got)
+			}
+			wantDeps := []string{tt.wantDep, "aws_instance.mysrv"}
+			if !reflect.DeepEqual(resourceState.Dependencies, wantDeps) {
+				t.Errorf("Dependencies = %v, want %v", resourceState.Dependencies, wantDeps)
+			}
+		})
+	}
+}
+
+func TestReadWriteTfState(t *testing.T) {
+	input, err := ioutil.ReadFile("testdata/single-module.tfstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tfstate, inputData, err := readTfState(bytes.NewReader(input), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(inputData, input) {
+		t.Error("readTfState didn't return the raw input")
+	}
+
+	var output bytes.Buffer
+	if err := writeTfState(&output, tfstate, defaultStateFormat); err != nil {
+		t.Fatal(err)
+	}
+	if output.String() != string(input) {
+		t.Errorf("round trip changed the state:\n%s", output.String())
+	}
+}
+
+func TestReadTfStateInvalid(t *testing.T) {
+	if _, _, err := readTfState(strings.NewReader(`{"version": 3,`), false); err == nil {
+		t.Error("expected an error for truncated JSON")
+	}
+}
+
+// "--only-if-exists" relies on a missing file being told apart from other
+// errors, such as invalid JSON
+func TestReadTfStatePathMissing(t *testing.T) {
+	_, _, err := readTfStatePath(filepath.Join("testdata", "missing.tfstate"), false)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got error %v, want one wrapping os.ErrNotExist", err)
+	}
+	dir, err := ioutil.TempDir("", "tf-ebs-attach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	invalid := filepath.Join(dir, "terraform.tfstate")
+	if err := ioutil.WriteFile(invalid, []byte(`{"version": 3,`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readTfStatePath(invalid, false); err == nil || errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got error %v for invalid JSON, want one not wrapping os.ErrNotExist", err)
+	}
+}
+
+func TestInjectVolumeAttachmentProvider(t *testing.T) {
+	tests := []struct {
+		name             string
+		instanceProvider string
+		wantProvider     string
+	}{
+		{"copied from instance", "provider.aws", "provider.aws"},
+		{"copied from aliased instance", "provider.aws.frankfurt", "provider.aws.frankfurt"},
+		{"default when instance has none", "", "provider.aws.default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tfstate := loadTfState(t, "single-module.tfstate")
+			instanceState, _ := findResource(tfstate, "aws_instance.mysrv")
+			instanceState.Provider = tt.instanceProvider
+
+			params := injectParams{
+				instanceName: "mysrv", volumeName: "mysrv_dsk0",
+				attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+				provider: "provider.aws.default",
+			}
+			if _, err := injectVolumeAttachment(params, tfstate); err != nil {
+				t.Fatal(err)
+			}
+
+			attachmentState, _ := findResource(tfstate, "aws_volume_attachment.mysrv_dsk0_attch")
+			if attachmentState.Provider != tt.wantProvider {
+				t.Errorf("Provider = %q, want %q", attachmentState.Provider, tt.wantProvider)
+			}
+			if tt.instanceProvider != "" && attachmentState.Provider != instanceState.Provider {
+				t.Errorf("attachment provider %q differs from instance provider %q",
+					attachmentState.Provider, instanceState.Provider)
+			}
+		})
+	}
+}
+
+func TestRemoveVolumeAttachment(t *testing.T) {
+	tests := []struct {
+		name       string
+		fixture    string
+		attachment string
+		modulePath string
+		wantErr    bool
+		wantPath   []string
+	}{
+		{"existing attachment", "attached.tfstate", "mysrv_dsk0_attch", "", false, []string{"root"}},
+		{"existing attachment in module", "attached.tfstate", "mysrv_dsk0_attch", "root", false, []string{"root"}},
+		{"missing attachment", "single-module.tfstate", "mysrv_dsk0_attch", "", true, nil},
+		{"wrong module", "attached.tfstate", "mysrv_dsk0_attch", "root.app1", true, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tfstate := loadTfState(t, tt.fixture)
+			moduleState, err := removeVolumeAttachment("aws_volume_attachment", tt.attachment, tt.modulePath, tfstate)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(moduleState.Path, tt.wantPath) {
+				t.Errorf("removed from module %v, want %v", moduleState.Path, tt.wantPath)
+			}
+			if resourceState, _ := findResource(tfstate, "aws_volume_attachment."+tt.attachment); resourceState != nil {
+				t.Error("attachment still present in state")
+			}
+		})
+	}
+}
+
+func TestRemoveVolumeAttachmentSeveralModules(t *testing.T) {
+	tfstate := loadTfState(t, "multi-module.tfstate")
+	params := injectParams{
+		instanceName: "srv", volumeName: "dsk",
+		attachmentName: "dsk_attch", deviceName: "/dev/sdh", skipAttached: true,
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := injectVolumeAttachment(params, tfstate); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := removeVolumeAttachment("aws_volume_attachment", "dsk_attch", "", tfstate); err == nil {
+		t.Error("expected an error when the attachment is in several modules")
+	}
+	if _, err := removeVolumeAttachment("aws_volume_attachment", "dsk_attch", "root.app2", tfstate); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := findModule(tfstate, []string{"root", "app1"}).Resources["aws_volume_attachment.dsk_attch"]; !found {
+		t.Error("attachment removed from the wrong module")
+	}
+}
+
+func TestRemoveVolumeAttachmentType(t *testing.T) {
+	tfstate := loadTfState(t, "attached.tfstate")
+	moduleState := tfstate.Modules[0]
+	moduleState.Resources["wrapped_attachment.mysrv_dsk0_attch"] = moduleState.Resources["aws_volume_attachment.mysrv_dsk0_attch"]
+	delete(moduleState.Resources, "aws_volume_attachment.mysrv_dsk0_attch")
+
+	if _, err := removeVolumeAttachment("aws_volume_attachment", "mysrv_dsk0_attch", "", tfstate); err == nil {
+		t.Error("expected an error removing the default type")
+	}
+	if _, err := removeVolumeAttachment("wrapped_attachment", "mysrv_dsk0_attch", "", tfstate); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := moduleState.Resources["wrapped_attachment.mysrv_dsk0_attch"]; found {
+		t.Error("attachment still present in state")
+	}
+}
+
+func TestBackupFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-ebs-attach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "terraform.tfstate")
+	if err := backupFile(fileName); err != nil {
+		t.Fatalf("backing up a missing file: %s", err)
+	}
+	if _, err := os.Stat(fileName + ".backup"); !os.IsNotExist(err) {
+		t.Error("backup created for a missing file")
+	}
+
+	if err := ioutil.WriteFile(fileName, []byte("old state\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupFile(fileName); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := ioutil.ReadFile(fileName + ".backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(backup) != "old state\n" {
+		t.Errorf("backup contains %q", backup)
+	}
+}
+
+func TestCheckStateVersion(t *testing.T) {
+	for _, version := range []int{1, 2, 4} {
+		if err := checkStateVersion(version); err == nil {
+			t.Errorf("checkStateVersion(%d): expected an error", version)
+		}
+	}
+	if err := checkStateVersion(3); err != nil {
+		t.Errorf("checkStateVersion(3): %s", err)
+	}
+	// Asking for the new format points at terraform's own upgrade
+	if err := checkStateVersion(4); err == nil || !strings.Contains(err.Error(), "upgrade") {
+		t.Errorf("checkStateVersion(4): got %v, want a pointer to terraform's upgrade", err)
+	}
+}
+
+// The IDs must come out the same on every platform. The second hash is above
+// 2^31, which a 32-bit int can't hold.
+func TestVolumeAttachmentIDWidth(t *testing.T) {
+	tests := []struct {
+		deviceName, volumeID, instanceID string
+		want                             string
+	}{
+		{"/dev/sdg", "vol-123abc", "i-abc123", "vai-1474069414"},
+		{"/dev/sdh", "vol-123abc", "i-abc123", "vai-2336660454"},
+	}
+
+	for _, tt := range tests {
+		got, err := volumeAttachmentID(tt.deviceName, tt.volumeID, tt.instanceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("volumeAttachmentID(%q, %q, %q) = %s, want %s",
+				tt.deviceName, tt.volumeID, tt.instanceID, got, tt.want)
+		}
+
+		// Same as the provider's own calculation in a 64-bit build
+		if strconv.IntSize == 64 {
+			buf := volumeAttachmentIDBuffer(tt.deviceName, tt.volumeID, tt.instanceID)
+			if want := fmt.Sprintf("vai-%d", hashcode.String(buf)); got != want {
+				t.Errorf("got %s, hashcode.String gives %s", got, want)
+			}
+		}
+	}
+}
+
+func TestVolumeAttachmentIDDebugHash(t *testing.T) {
+	var output bytes.Buffer
+	verboseOutput = &output
+	defer func() { verboseOutput = os.Stderr }()
+
+	// Off by default
+	if _, err := volumeAttachmentID("/dev/sdg", "vol-123abc", "i-abc123"); err != nil {
+		t.Fatal(err)
+	}
+	if output.Len() != 0 {
+		t.Errorf("wrote %q without --debug-hash", output.String())
+	}
+
+	debugHash = true
+	defer func() { debugHash = false }()
+	if _, err := volumeAttachmentID("/dev/sdg", "vol-123abc", "i-abc123"); err != nil {
+		t.Fatal(err)
+	}
+	want := "debug-hash: buffer \"/dev/sdg-i-abc123-vol-123abc-\" (29 bytes), hash 1474069414\n"
+	if output.String() != want {
+		t.Errorf("got %q, want %q", output.String(), want)
+	}
+}
+
+func TestVolumeAttachmentIDEmptyComponent(t *testing.T) {
+	tests := []struct {
+		deviceName, volumeID, instanceID string
+		wantMessage                      string
+	}{
+		{"", "vol-123abc", "i-abc123", "device name is empty"},
+		{"/dev/sdg", "", "i-abc123", "volume ID is empty"},
+		{"/dev/sdg", "vol-123abc", "", "instance ID is empty"},
+	}
+
+	for _, tt := range tests {
+		_, err := volumeAttachmentID(tt.deviceName, tt.volumeID, tt.instanceID)
+		if err == nil || !strings.Contains(err.Error(), tt.wantMessage) {
+			t.Errorf("volumeAttachmentID(%q, %q, %q): error %v, want %q",
+				tt.deviceName, tt.volumeID, tt.instanceID, err, tt.wantMessage)
+		}
+	}
+}
+
+func TestInjectVolumeAttachmentUnappliedInstance(t *testing.T) {
+	tfstate := loadTfState(t, "single-module.tfstate")
+	instanceState, _ := findResource(tfstate, "aws_instance.mysrv")
+	instanceState.Primary.ID = ""
+
+	params := injectParams{
+		instanceName: "mysrv", volumeName: "mysrv_dsk0",
+		attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+	}
+	_, err := injectVolumeAttachment(params, tfstate)
+	if err == nil || !strings.Contains(err.Error(), "instance ID is empty") {
+		t.Errorf("expected an empty instance ID error, got %v", err)
+	}
+	if resourceState, _ := findResource(tfstate, "aws_volume_attachment.mysrv_dsk0_attch"); resourceState != nil {
+		t.Error("attachment injected despite the empty instance ID")
+	}
+}
+
+func TestInjectVolumeAttachmentVerbose(t *testing.T) {
+	var trace bytes.Buffer
+	verbose, verboseOutput = true, &trace
+	defer func() { verbose, verboseOutput = false, os.Stderr }()
+
+	tfstate := loadTfState(t, "multi-module.tfstate")
+	delete(findModule(tfstate, []string{"root", "app1"}).Resources, "aws_ebs_volume.dsk")
+	params := injectParams{
+		instanceName: "srv", volumeName: "dsk",
+		attachmentName: "dsk_attch", deviceName: "/dev/sdh",
+	}
+	if _, err := injectVolumeAttachment(params, tfstate); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "checking module root: instance not found\n" +
+		"checking module root.app1: instance found, volume not found\n" +
+		"checking module root.app2: instance found, volume found\n" +
+		"scanned 3 of 3 modules\n" +
+		"added aws_volume_attachment.dsk_attch to module root.app2\n"
+	if trace.String() != want {
+		t.Errorf("trace:\n%s\nwant:\n%s", trace.String(), want)
+	}
+}
+
+func TestResolveStateFileName(t *testing.T) {
+	defer os.Setenv("TF_EBS_ATTACH_STATE", os.Getenv("TF_EBS_ATTACH_STATE"))
+	defer os.Setenv("TF_STATE", os.Getenv("TF_STATE"))
+
+	tests := []struct {
+		name, flag, ebsAttachState, tfState string
+		want                                string
+	}{
+		{"default", "", "", "", "terraform.tfstate"},
+		{"TF_STATE", "", "", "tf.tfstate", "tf.tfstate"},
+		{"TF_EBS_ATTACH_STATE", "", "attach.tfstate", "tf.tfstate", "attach.tfstate"},
+		{"flag", "flag.tfstate", "attach.tfstate", "tf.tfstate", "flag.tfstate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("TF_EBS_ATTACH_STATE", tt.ebsAttachState)
+			os.Setenv("TF_STATE", tt.tfState)
+			if got := resolveStateFileName(tt.flag); got != tt.want {
+				t.Errorf("resolveStateFileName(%q) = %q, want %q", tt.flag, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCurrentWorkspace(t *testing.T) {
+	defer os.Setenv("TF_WORKSPACE", os.Getenv("TF_WORKSPACE"))
+	defer os.Setenv("TF_DATA_DIR", os.Getenv("TF_DATA_DIR"))
+	dir, err := ioutil.TempDir("", "tf-ebs-attach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, dataDir := range []string{".terraform", "data"} {
+		if err := os.Mkdir(dataDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(".terraform/environment", []byte("staging"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("data/environment", []byte("prod\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, tfWorkspace, tfDataDir string
+		want                         string
+	}{
+		{"environment file", "", "", "staging"},
+		{"TF_DATA_DIR", "", "data", "prod"},
+		{"TF_WORKSPACE", "dev", "data", "dev"},
+		{"no environment file", "", "missing", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("TF_WORKSPACE", tt.tfWorkspace)
+			os.Setenv("TF_DATA_DIR", tt.tfDataDir)
+			if got := currentWorkspace(); got != tt.want {
+				t.Errorf("currentWorkspace() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	for workspace, want := range map[string]string{
+		"":        "terraform.tfstate",
+		"default": "terraform.tfstate",
+		"staging": filepath.Join("terraform.tfstate.d", "staging", "terraform.tfstate"),
+	} {
+		if got := workspaceStateFileName(workspace); got != want {
+			t.Errorf("workspaceStateFileName(%q) = %q, want %q", workspace, got, want)
+		}
+	}
+}
+
+func TestResolveOutputFileNames(t *testing.T) {
+	defer os.Setenv("TF_EBS_ATTACH_STATE", os.Getenv("TF_EBS_ATTACH_STATE"))
+	defer os.Setenv("TF_STATE", os.Getenv("TF_STATE"))
+	os.Setenv("TF_EBS_ATTACH_STATE", "")
+	os.Setenv("TF_STATE", "")
+
+	tests := []struct {
+		name    string
+		input   interface{}
+		output  []string
+		inPlace bool
+		want    []string
+	}{
+		{"defaults", nil, nil, false, []string{"terraform.tfstate.new"}},
+		{"defaults in place", nil, nil, true, []string{"terraform.tfstate"}},
+		{"same file", "a.tfstate", []string{"./a.tfstate"}, false, []string{"./a.tfstate.new"}},
+		{"same file in place", "a.tfstate", []string{"a.tfstate"}, true, []string{"a.tfstate"}},
+		{"different file", "a.tfstate", []string{"b.tfstate"}, false, []string{"b.tfstate"}},
+		{"stdout", "-", []string{"-"}, false, []string{"-"}},
+		{"file and stdout", "a.tfstate", []string{"b.tfstate", "-", "b.tfstate"}, false, []string{"b.tfstate", "-"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := docopt.Opts{"-i": tt.input, "-o": tt.output, "--in-place": tt.inPlace}
+			if got := resolveOutputFileNames(opts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveOutputFileNames() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadWriteTfStateCRLF(t *testing.T) {
+	input, err := ioutil.ReadFile("testdata/single-module-crlf.tfstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, trim := range []bool{false, true} {
+		if trim {
+			input = bytes.TrimRight(input, "\r\n")
+		}
+		tfstate, inputData, err := readTfState(bytes.NewReader(input), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var output bytes.Buffer
+		if err := writeTfState(&output, tfstate, detectStateFormat(inputData)); err != nil {
+			t.Fatal(err)
+		}
+		if output.String() != string(input) {
+			t.Errorf("round trip (trailing newline trimmed: %v) changed the state:\n%q", trim, output.String())
+		}
+	}
+}
+
+func TestDetectStateFormat(t *testing.T) {
+	tests := []struct {
+		data string
+		want stateFormat
+	}{
+		{"", defaultStateFormat},
+		{"{}", stateFormat{newline: "\n"}},
+		{"{\n}\n", stateFormat{newline: "\n", trailingNewline: true}},
+		{"{\r\n}\r\n", stateFormat{newline: "\r\n", trailingNewline: true}},
+		{"{\r\n}", stateFormat{newline: "\r\n"}},
+	}
+	for _, test := range tests {
+		if got := detectStateFormat([]byte(test.data)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("detectStateFormat(%q) = %+v, want %+v", test.data, got, test.want)
+		}
+	}
+}
+
+func TestWriteTfStateCompact(t *testing.T) {
+	tfstate := loadTfState(t, "single-module.tfstate")
+
+	var output bytes.Buffer
+	format := stateFormat{newline: "\n", trailingNewline: true, compact: true}
+	if err := writeTfState(&output, tfstate, format); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(output.String(), "\n"); n != 1 {
+		t.Errorf("compact output has %d newlines, want only the trailing one", n)
+	}
+
+	reread, _, err := readTfState(&output, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reread.Modules[0].Resources, tfstate.Modules[0].Resources) {
+		t.Error("compact output doesn't decode to the same resources")
+	}
+}
+
+func TestSplitAttachmentDevices(t *testing.T) {
+	attachmentNames, deviceNames, err := splitAttachmentDevices("a,b", "/dev/sdg,sdh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(attachmentNames, []string{"a", "b"}) ||
+		!reflect.DeepEqual(deviceNames, []string{"/dev/sdg", "sdh"}) {
+		t.Errorf("got %v / %v", attachmentNames, deviceNames)
+	}
+
+	for _, args := range [][2]string{
+		{"a,b", "/dev/sdg"},
+		{"a", "/dev/sdg,/dev/sdh"},
+		{"a,", "/dev/sdg,/dev/sdh"},
+		{"a,a", "/dev/sdg,/dev/sdh"},
+	} {
+		if _, _, err := splitAttachmentDevices(args[0], args[1]); err == nil {
+			t.Errorf("expected an error for %q / %q", args[0], args[1])
+		}
+	}
+}
+
+func TestInjectVolumeAttachmentIDOverrides(t *testing.T) {
+	tfstate := loadTfState(t, "multi-module.tfstate")
+	params := injectParams{
+		instanceName: "srv", volumeName: "dsk",
+		attachmentName: "dsk_attch", deviceName: "/dev/sdh",
+		instanceID: "i-0new", volumeID: "vol-0new",
+	}
+	moduleState, err := injectVolumeAttachment(params, tfstate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(moduleState.Path, ".") != "root.app1" {
+		t.Errorf("added to module %v, want root.app1", moduleState.Path)
+	}
+
+	attributes := moduleState.Resources["aws_volume_attachment.dsk_attch"].Primary.Attributes
+	if attributes["instance_id"] != "i-0new" || attributes["volume_id"] != "vol-0new" {
+		t.Errorf("overrides not used: %v", attributes)
+	}
+	wantID, _ := volumeAttachmentID("/dev/sdh", "vol-0new", "i-0new")
+	if attributes["id"] != wantID {
+		t.Errorf("id = %s, want %s", attributes["id"], wantID)
+	}
+}
+
+func TestReadTfStateNewerVersion(t *testing.T) {
+	input := `{"version": 4, "serial": 1, "modules": []}`
+	_, _, err := readTfState(strings.NewReader(input), false)
+	if err == nil || !strings.Contains(err.Error(), "upgrade") {
+		t.Errorf("expected an error asking to upgrade, got %v", err)
+	}
+	if !errors.Is(err, errUnsupportedStateVersion) {
+		t.Errorf("error %v doesn't wrap errUnsupportedStateVersion", err)
+	}
+
+	var warnings bytes.Buffer
+	forceVersion, verboseOutput = true, &warnings
+	defer func() { forceVersion, verboseOutput = false, os.Stderr }()
+	if _, _, err := readTfState(strings.NewReader(input), false); err != nil {
+		t.Errorf("unexpected error with --force-version: %s", err)
+	}
+	if !strings.Contains(warnings.String(), "Warning: state version 4") {
+		t.Errorf("missing warning, got %q", warnings.String())
+	}
+}
+
+func TestInjectVolumeAttachmentResourceTypes(t *testing.T) {
+	tfstate := loadTfState(t, "single-module.tfstate")
+	moduleState := tfstate.Modules[0]
+	moduleState.Resources["wrapped_instance.mysrv"] = moduleState.Resources["aws_instance.mysrv"]
+	moduleState.Resources["wrapped_volume.mysrv_dsk0"] = moduleState.Resources["aws_ebs_volume.mysrv_dsk0"]
+	delete(moduleState.Resources, "aws_instance.mysrv")
+	delete(moduleState.Resources, "aws_ebs_volume.mysrv_dsk0")
+
+	params := injectParams{
+		instanceName: "mysrv", volumeName: "mysrv_dsk0",
+		attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+		types: resourceTypes{instance: "wrapped_instance", volume: "wrapped_volume", attachment: "wrapped_attachment"},
+	}
+	if _, err := injectVolumeAttachment(params, tfstate); err != nil {
+		t.Fatal(err)
+	}
+
+	attachmentState := moduleState.Resources["wrapped_attachment.mysrv_dsk0_attch"]
+	if attachmentState == nil {
+		t.Fatal("attachment not added under its custom type")
+	}
+	if attachmentState.Type != "wrapped_attachment" ||
+		!reflect.DeepEqual(attachmentState.Dependencies, []string{"wrapped_instance.mysrv", "wrapped_volume.mysrv_dsk0"}) {
+		t.Errorf("Type = %s, Dependencies = %v", attachmentState.Type, attachmentState.Dependencies)
+	}
+}
+
+func TestSortTfState(t *testing.T) {
+	tfstate := loadTfState(t, "multi-module.tfstate")
+	fleet := findModule(tfstate, []string{"root"}).Resources["aws_security_group.fleet"]
+	fleet.Dependencies = []string{"aws_vpc.a", "aws_vpc.b", "aws_vpc.c"}
+	var want bytes.Buffer
+	if err := writeTfState(&want, tfstate, defaultStateFormat); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reverse the modules and shuffle some dependencies
+	modules := tfstate.Modules
+	for i, j := 0, len(modules)-1; i < j; i, j = i+1, j-1 {
+		modules[i], modules[j] = modules[j], modules[i]
+	}
+	for _, moduleState := range modules {
+		for _, resourceState := range moduleState.Resources {
+			deps := resourceState.Dependencies
+			for i, j := 0, len(deps)-1; i < j; i, j = i+1, j-1 {
+				deps[i], deps[j] = deps[j], deps[i]
+			}
+		}
+	}
+
+	sortTfState(tfstate)
+	if got := strings.Join(tfstate.Modules[0].Path, "."); got != "root" {
+		t.Errorf("first module is %s, want root", got)
+	}
+	var got bytes.Buffer
+	if err := writeTfState(&got, tfstate, defaultStateFormat); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != want.String() {
+		t.Errorf("sorted state differs from the original:\n%s", got.String())
+	}
+}
+
+// terraform-written.tfstate is laid out exactly as terraform 0.11 writes it
+func TestCanonicalizeTfState(t *testing.T) {
+	want, err := ioutil.ReadFile("testdata/terraform-written.tfstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reverse the modules and dependencies and leave out empty fields
+	tfstate := loadTfState(t, "terraform-written.tfstate")
+	modules := tfstate.Modules
+	modules[0], modules[1] = modules[1], modules[0]
+	for _, moduleState := range modules {
+		moduleState.Dependencies = nil
+		if len(moduleState.Outputs) == 0 {
+			moduleState.Outputs = nil
+		}
+		for _, resourceState := range moduleState.Resources {
+			deps := resourceState.Dependencies
+			for i, j := 0, len(deps)-1; i < j; i, j = i+1, j-1 {
+				deps[i], deps[j] = deps[j], deps[i]
+			}
+			resourceState.Deposed = nil
+			if len(resourceState.Primary.Meta) == 0 {
+				resourceState.Primary.Meta = nil
+			}
+		}
+	}
+	var compact bytes.Buffer
+	if err := writeTfState(&compact, tfstate, stateFormat{newline: "\r\n", compact: true}); err != nil {
+		t.Fatal(err)
+	}
+	tfstate, _, err = readTfState(&compact, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	canonicalizeTfState(tfstate)
+	var got bytes.Buffer
+	if err := writeTfState(&got, tfstate, defaultStateFormat); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != string(want) {
+		t.Errorf("canonical state differs from terraform's:\n%s", got.String())
+	}
+}
+
+func TestParseAttachGroups(t *testing.T) {
+	paramsList, err := parseAttachGroups([]string{"web:web_dsk:web_att:/dev/sdf", "db:db_dsk:db_att:sdg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []injectParams{
+		{instanceName: "web", volumeName: "web_dsk", attachmentName: "web_att", deviceName: "/dev/sdf"},
+		{instanceName: "db", volumeName: "db_dsk", attachmentName: "db_att", deviceName: "sdg"},
+	}
+	if !reflect.DeepEqual(paramsList, want) {
+		t.Errorf("got %+v, want %+v", paramsList, want)
+	}
+
+	for _, groups := range [][]string{
+		{"web:web_dsk:web_att"},
+		{"web:web_dsk:web_att:/dev/sdf:extra"},
+		{"web::web_att:/dev/sdf"},
+		{"web:web_dsk:att:/dev/sdf", "db:db_dsk:att:/dev/sdg"},
+	} {
+		_, err := parseAttachGroups(groups)
+		if err == nil {
+			t.Errorf("expected an error for %q", groups)
+		}
+	}
+
+	_, err = parseAttachGroups([]string{"ok:ok:ok:/dev/sdf", "bad:group"})
+	if err == nil || !strings.Contains(err.Error(), "\"bad:group\"") {
+		t.Errorf("error doesn't name the malformed group: %v", err)
+	}
+}
+
+// The attachment must depend on both the instance and the volume, so that
+// terraform destroys it (detaching the volume) before either of them. Within
+// a module, dependencies don't carry the module path.
+func TestInjectVolumeAttachmentDependencies(t *testing.T) {
+	tfstate := loadTfState(t, "multi-module.tfstate")
+	params := injectParams{
+		instanceName: "srv", volumeName: "dsk",
+		attachmentName: "dsk_attch", deviceName: "/dev/sdh",
+	}
+	moduleState, err := injectVolumeAttachment(params, tfstate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(moduleState.Path, ".") != "root.app1" {
+		t.Fatalf("added to module %v, want root.app1", moduleState.Path)
+	}
+
+	want := []string{"aws_ebs_volume.dsk", "aws_instance.srv"}
+	got := moduleState.Resources["aws_volume_attachment.dsk_attch"].Dependencies
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Dependencies = %v, want %v", got, want)
+	}
+	for _, dependency := range got {
+		if _, found := moduleState.Resources[dependency]; !found {
+			t.Errorf("dependency %s doesn't name a resource in module %v", dependency, moduleState.Path)
+		}
+	}
+}
+
+// Feed the captured output of "terraform state pull" through a pipe, the way
+// "-i -" receives it, in small chunks
+func TestReadTfStateStatePull(t *testing.T) {
+	input, err := ioutil.ReadFile("testdata/state-pull.tfstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w := io.Pipe()
+	go func() {
+		for data := input; len(data) > 0; {
+			n := 64
+			if n > len(data) {
+				n = len(data)
+			}
+			w.Write(data[:n])
+			data = data[n:]
+		}
+		w.Close()
+	}()
+
+	tfstate, inputData, err := readTfState(r, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(inputData, input) {
+		t.Error("readTfState didn't return the whole stream")
+	}
+	if tfstate.Version != 3 || tfstate.Serial != 27 {
+		t.Errorf("version %d serial %d, want 3 and 27", tfstate.Version, tfstate.Serial)
+	}
+
+	params := injectParams{
+		instanceName: "db", volumeName: "db_data",
+		attachmentName: "db_data_attch", deviceName: "/dev/sdf",
+	}
+	if _, err := injectVolumeAttachment(params, tfstate); err != nil {
+		t.Fatal(err)
+	}
+	var output bytes.Buffer
+	if err := writeTfState(&output, tfstate, detectStateFormat(inputData)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(output.String(), "}\n") || strings.HasSuffix(output.String(), "\n\n") {
+		t.Errorf("output doesn't end with exactly one newline like the input")
+	}
+}
+
+func TestReadTfStateEmpty(t *testing.T) {
+	for _, input := range []string{"", "\n", "  \r\n"} {
+		_, _, err := readTfState(strings.NewReader(input), false)
+		if err == nil || !strings.Contains(err.Error(), "empty") {
+			t.Errorf("readTfState(%q) = %v, want an error about empty input", input, err)
+		}
+	}
+}
+
+// A version 4 state must be rejected outright, not read as a state without
+// modules, even with --force-version
+func TestReadTfStateV4Layout(t *testing.T) {
+	input, err := ioutil.ReadFile("testdata/v4.tfstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var warnings bytes.Buffer
+	forceVersion, verboseOutput = true, &warnings
+	defer func() { forceVersion, verboseOutput = false, os.Stderr }()
+	_, _, err = readTfState(bytes.NewReader(input), false)
+	if err == nil || !strings.Contains(err.Error(), "top level") {
+		t.Errorf("expected an error about the version 4 layout, got %v", err)
+	}
+	if !errors.Is(err, errUnsupportedStateVersion) {
+		t.Errorf("error %v doesn't wrap errUnsupportedStateVersion", err)
+	}
+
+	if _, _, err := readTfState(strings.NewReader(`{"version": 3, "modules": []}`), false); err != nil {
+		t.Errorf("unexpected error for a state without modules: %s", err)
+	}
+}
+
+// Repeating an import must leave the state exactly as the first one did
+func TestInjectVolumeAttachmentIdempotent(t *testing.T) {
+	tfstate := loadTfState(t, "single-module.tfstate")
+	params := injectParams{
+		instanceName: "mysrv", volumeName: "mysrv_dsk0",
+		attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+	}
+	if _, err := injectVolumeAttachment(params, tfstate); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := findResource(tfstate, "aws_volume_attachment.mysrv_dsk0_attch")
+
+	if _, err := injectVolumeAttachment(params, tfstate); err != nil {
+		t.Fatalf("re-running the same import failed: %s", err)
+	}
+	second, _ := findResource(tfstate, "aws_volume_attachment.mysrv_dsk0_attch")
+	if first != second {
+		t.Error("the existing attachment was replaced")
+	}
+}
+
+// Import into the root module of a large state, the common case: read,
+// inject and write it out again as importMode does
+func BenchmarkInject(b *testing.B) {
+	tfstate, _, err := readTfState(bytes.NewReader(largeTfState(b, 10000)), false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	root := &terraform.ModuleState{Path: terraform.RootModulePath, Resources: tfstate.Modules[0].Resources}
+	tfstate.Modules = append([]*terraform.ModuleState{root}, tfstate.Modules...)
+	var input bytes.Buffer
+	if err := writeTfState(&input, tfstate, defaultStateFormat); err != nil {
+		b.Fatal(err)
+	}
+	params := injectParams{instanceName: "srv", volumeName: "dsk", attachmentName: "dsk_attch", deviceName: "/dev/sdh"}
+
+	b.SetBytes(int64(input.Len()))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tfstate, inputData, err := readTfState(bytes.NewReader(input.Bytes()), false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, changed, err := injectVolumeAttachmentChanged(params, tfstate); err != nil {
+			b.Fatal(err)
+		} else if !changed {
+			b.Fatal("attachment not added")
+		}
+		var output bytes.Buffer
+		if err := writeTfState(&output, tfstate, detectStateFormat(inputData)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
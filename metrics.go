@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Counters reported on stderr as a single JSON object with "--metrics"
+type runMetrics struct {
+	Mode             string `json:"mode"`
+	ModulesScanned   int    `json:"modules_scanned"`
+	ResourcesAdded   int    `json:"resources_added"`
+	ResourcesRemoved int    `json:"resources_removed"`
+	DurationMs       int64  `json:"duration_ms"`
+	BackupCreated    bool   `json:"backup_created"`
+	Error            string `json:"error,omitempty"`
+}
+
+var (
+	// Set by "--metrics"
+	metricsEnabled bool
+	metrics        runMetrics
+	metricsStart   time.Time
+)
+
+// Start collecting metrics for the given mode
+func startMetrics(enabled bool, mode string) {
+	metricsEnabled = enabled
+	metrics = runMetrics{Mode: mode}
+	metricsStart = time.Now()
+}
+
+// Write the metrics line to stderr if "--metrics" was given. errMessage is the
+// reason the run failed, if it did.
+func emitMetrics(errMessage string) {
+	if !metricsEnabled {
+		return
+	}
+	metrics.DurationMs = int64(time.Since(metricsStart) / time.Millisecond)
+	metrics.Error = errMessage
+
+	line, err := json.Marshal(metrics)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(os.Stderr, string(line))
+}
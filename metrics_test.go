@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMetricsCounters(t *testing.T) {
+	startMetrics(false, "import")
+
+	tfstate := loadTfState(t, "multi-module.tfstate")
+	params := injectParams{
+		instanceName: "srv", volumeName: "dsk",
+		attachmentName: "dsk_attch", deviceName: "/dev/sdh",
+	}
+	if _, err := injectVolumeAttachment(params, tfstate); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := removeVolumeAttachment("aws_volume_attachment", "dsk_attch", "", tfstate); err != nil {
+		t.Fatal(err)
+	}
+
+	// inject stops at root.app1, remove scans all three modules
+	want := runMetrics{Mode: "import", ModulesScanned: 5, ResourcesAdded: 1, ResourcesRemoved: 1}
+	if metrics != want {
+		t.Errorf("metrics = %+v, want %+v", metrics, want)
+	}
+}
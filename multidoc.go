@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/docopt/docopt-go"
+	"github.com/hashicorp/terraform/terraform"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A state document read from a stream of several, with its bytes as read
+type stateDocument struct {
+	tfstate *terraform.State
+	data    []byte
+	changed bool
+}
+
+// Import the attachments in opts like importMode, into an input made of
+// several state documents one after the other, as some backup tools write
+// them. Each attachment goes into the one document containing its instance
+// and volume, and all documents are written back out in their order.
+func multiDocImportMode(ctx context.Context, opts docopt.Opts) {
+	for _, option := range []string{"--tfc-workspace", "--decrypt-cmd", "--encrypt-cmd", "--lenient",
+		"--show-diff", "--from-tags"} {
+		if value := opts[option]; value != nil && value != false {
+			die(option+" isn't supported with --multi-doc", nil)
+		}
+	}
+	inputFileName, _ := opts.String("-i")
+	inputFileName = resolveStateFileName(inputFileName)
+	var input io.Reader = os.Stdin
+	if isStateURL(inputFileName) {
+		die("Reading state from a URL isn't supported with --multi-doc", nil)
+	} else if inputFileName != "-" {
+		inputFile, err := os.Open(inputFileName)
+		if err != nil {
+			exitIfInputMissing(opts, inputFileName, err)
+			die("Error reading input file: %s", err)
+		}
+		defer inputFile.Close()
+		input = inputFile
+	}
+	documents, err := readStateDocuments(input)
+	if err != nil {
+		die("%s", err)
+	}
+	for _, document := range documents {
+		if err := checkStateLimits(document.tfstate, stateLimitsFromOpts(opts)); err != nil {
+			die("%s", err)
+		}
+	}
+
+	added := make(map[string]*terraform.ResourceState)
+	var descriptions []string
+	var changelog []changelogEntry
+	for _, params := range newInjectParams(opts, nil) {
+		i, moduleState, changed, err := injectVolumeAttachmentDocuments(params, documents)
+		if err != nil {
+			die("%s", err)
+		}
+		attachmentResourceID := params.attachmentResourceID()
+		added[attachmentResourceID] = moduleState.Resources[attachmentResourceID]
+		if changed {
+			documents[i].changed = true
+			changelog = append(changelog, newChangelogEntry(moduleState, attachmentResourceID))
+		}
+		descriptions = append(descriptions, fmt.Sprintf("%s to module %s of document %d",
+			attachmentResourceID, strings.Join(moduleState.Path, "."), i+1))
+	}
+
+	if printOnly, _ := opts.Bool("--print-resource"); printOnly {
+		compact, _ := opts.Bool("--compact")
+		printResources(added, compact)
+		return
+	}
+	if len(changelog) == 0 {
+		var resourceIDs []string
+		for resourceID := range added {
+			resourceIDs = append(resourceIDs, resourceID)
+		}
+		sort.Strings(resourceIDs)
+		fmt.Fprintf(os.Stderr, "%s already present, no changes\n", strings.Join(resourceIDs, ", "))
+		return
+	}
+
+	// Documents without a new attachment are copied through unchanged
+	var output bytes.Buffer
+	for _, document := range documents {
+		if document.changed {
+			prepareOutputState(opts, document.tfstate)
+			document.data = bytes.TrimRight(encodeTfStateFile(opts, document.tfstate, document.data), "\r\n")
+		}
+		output.Write(document.data)
+		output.WriteString(detectStateFormat(document.data).newline)
+	}
+
+	confirmWrite(opts, "Adding "+strings.Join(descriptions, ", "), true)
+	exitIfTimedOut(ctx)
+	writeOutputFiles(ctx, opts, output.Bytes())
+	recordChangelog(opts, changelog)
+}
+
+// Read the state documents in r, which follow each other separated by
+// whitespace, typically a newline
+func readStateDocuments(r io.Reader) ([]*stateDocument, error) {
+	decoder := json.NewDecoder(r)
+	var documents []*stateDocument
+	for {
+		var data json.RawMessage
+		err := decoder.Decode(&data)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Error parsing document %d of the input as JSON: %s", len(documents)+1, err)
+		}
+		tfstate, _, err := readTfState(bytes.NewReader(data), false)
+		if err != nil {
+			return nil, fmt.Errorf("Document %d of the input: %w", len(documents)+1, err)
+		}
+		documents = append(documents, &stateDocument{tfstate: tfstate, data: data})
+	}
+	if len(documents) == 0 {
+		return nil, fmt.Errorf("Input is empty, there is no state to modify")
+	}
+	verbosef("read %d state documents", len(documents))
+	return documents, nil
+}
+
+// Inject the attachment described by params into the one document that
+// contains its instance and volume, returning that document's index along
+// with what injectVolumeAttachmentChanged returns. It's an error for the
+// instance and volume to be found in more than one document. With
+// "--skip-attached", documents that already have the attachment are skipped
+// like the modules within each one.
+func injectVolumeAttachmentDocuments(params injectParams, documents []*stateDocument) (int,
+	*terraform.ModuleState, bool, error) {
+
+	found := -1
+	var foundModuleState *terraform.ModuleState
+	var foundChanged bool
+	var notFound error
+	for i, document := range documents {
+		// A document without the instance and volume is left untouched, and
+		// finding them twice is fatal, so nothing needs to be undone
+		moduleState, changed, err := injectVolumeAttachmentChanged(params, document.tfstate)
+		if isNotInModule(err, params) {
+			verbosef("document %d: %s", i+1, err)
+			// An attachment already present explains best why none was added
+			if notFound == nil || (errors.Is(err, errResourceExists) && !errors.Is(notFound, errResourceExists)) {
+				notFound = err
+			}
+			continue
+		} else if err != nil {
+			return 0, nil, false, fmt.Errorf("Document %d: %w", i+1, err)
+		}
+		if found >= 0 {
+			return 0, nil, false, fmt.Errorf("Both documents %d and %d contain the instance and volume of \"%s\", "+
+				"can't tell which one to add it to", found+1, i+1, params.attachmentResourceID())
+		}
+		found, foundModuleState, foundChanged = i, moduleState, changed
+	}
+	if found < 0 {
+		return 0, nil, false, fmt.Errorf("%w (searched all %d documents)", notFound, len(documents))
+	}
+	return found, foundModuleState, foundChanged, nil
+}
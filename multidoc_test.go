@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// The named fixtures concatenated, one per line
+func concatFixtures(t *testing.T, names ...string) []byte {
+	var data []byte
+	for _, name := range names {
+		fixture, err := ioutil.ReadFile("testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, bytes.TrimSpace(fixture)...)
+		data = append(data, '\n')
+	}
+	return data
+}
+
+func TestReadStateDocuments(t *testing.T) {
+	data := concatFixtures(t, "single-module.tfstate", "count-volume.tfstate")
+	documents, err := readStateDocuments(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(documents) != 2 {
+		t.Fatalf("got %d documents, want 2", len(documents))
+	}
+	if !bytes.HasPrefix(data, documents[0].data) {
+		t.Error("first document isn't kept as read")
+	}
+
+	if _, err := readStateDocuments(strings.NewReader(" \n")); err == nil {
+		t.Error("expected an error for empty input")
+	}
+	if _, err := readStateDocuments(bytes.NewReader(append(data, "{"...))); err == nil ||
+		!strings.Contains(err.Error(), "document 3") {
+		t.Errorf("truncated third document: got %v", err)
+	}
+}
+
+func TestInjectVolumeAttachmentDocuments(t *testing.T) {
+	params := injectParams{
+		instanceName: "mysrv", volumeName: "mysrv_dsk0",
+		attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+	}
+	documents, err := readStateDocuments(bytes.NewReader(
+		concatFixtures(t, "count-volume.tfstate", "single-module.tfstate")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, moduleState, changed, err := injectVolumeAttachmentDocuments(params, documents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 1 || !changed || moduleState.Resources["aws_volume_attachment.mysrv_dsk0_attch"] == nil {
+		t.Errorf("got document %d, changed %v, want the attachment added to document 1", i, changed)
+	}
+	if resource, _ := findResource(documents[0].tfstate, "aws_volume_attachment.mysrv_dsk0_attch"); resource != nil {
+		t.Error("attachment also added to document 0")
+	}
+
+	// The same pair in two documents is ambiguous
+	documents, err = readStateDocuments(bytes.NewReader(
+		concatFixtures(t, "single-module.tfstate", "single-module.tfstate")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := injectVolumeAttachmentDocuments(params, documents); err == nil ||
+		!strings.Contains(err.Error(), "documents 1 and 2") {
+		t.Errorf("pair in both documents: got %v", err)
+	}
+
+	params.volumeName = "nosuchvolume"
+	if _, _, _, err := injectVolumeAttachmentDocuments(params, documents); !errors.Is(err, errVolumeNotFound) {
+		t.Errorf("pair in no document: got %v", err)
+	}
+}
+
+func TestInjectVolumeAttachmentDocumentsSkipAttached(t *testing.T) {
+	params := injectParams{
+		instanceName: "mysrv", volumeName: "mysrv_dsk0",
+		attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg", skipAttached: true,
+	}
+	documents, err := readStateDocuments(bytes.NewReader(
+		concatFixtures(t, "attached.tfstate", "single-module.tfstate")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, _, changed, err := injectVolumeAttachmentDocuments(params, documents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 1 || !changed {
+		t.Errorf("got document %d, changed %v, want the attachment added to document 1", i, changed)
+	}
+
+	// Without --skip-attached the differing attachment is an error, as it
+	// is in a single document
+	params.skipAttached = false
+	documents, err = readStateDocuments(bytes.NewReader(
+		concatFixtures(t, "attached.tfstate", "single-module.tfstate")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := injectVolumeAttachmentDocuments(params, documents); !errors.Is(err, errResourceExists) {
+		t.Errorf("without --skip-attached: got %v, want errResourceExists", err)
+	}
+
+	// Attached in every document
+	params.skipAttached = true
+	documents, err = readStateDocuments(bytes.NewReader(concatFixtures(t, "attached.tfstate")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := injectVolumeAttachmentDocuments(params, documents); !errors.Is(err, errResourceExists) {
+		t.Errorf("attached everywhere: got %v, want errResourceExists", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/terraform/terraform"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// An indexed resource name like `web[0]` or `web["a"]`
+var indexedNamePattern = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_-]*)\[(.*)\]$`)
+
+// Translate a resource name given in terraform's address syntax, e.g.
+// "dsk_attch[1]", to the form used for keys in a version 3 state, e.g.
+// "dsk_attch.1". Names without brackets are returned as they are. Only count
+// indexes exist in version 3; for_each keys like `dsk_attch["a"]` were
+// introduced with the version 4 format, which this tool can't edit yet.
+func stateResourceName(name string) (string, error) {
+	if !strings.ContainsAny(name, "[]") {
+		return name, nil
+	}
+	match := indexedNamePattern.FindStringSubmatch(name)
+	if match == nil {
+		return "", fmt.Errorf("Malformed resource name \"%s\", expected \"name\" or \"name[index]\"", name)
+	}
+	index := match[2]
+	if strings.HasPrefix(index, "\"") && strings.HasSuffix(index, "\"") && len(index) >= 2 {
+		return "", fmt.Errorf("Can't use the for_each key in \"%s\": version 3 states only index resources "+
+			"by count, e.g. \"%s[0]\"", name, match[1])
+	}
+	if index == "" || strings.Trim(index, "0123456789") != "" || (len(index) > 1 && index[0] == '0') {
+		return "", fmt.Errorf("Malformed index in resource name \"%s\", expected a number or a quoted key", name)
+	}
+	return match[1] + "." + index, nil
+}
+
+// Find the name of the one resource of resourceType in resources whose whole
+// name matches the regular expression pattern, for "--name-regex". Returns
+// "" if none does, and an error listing them if several do.
+func matchResourceName(resources map[string]*terraform.ResourceState, resourceType, pattern string) (string, error) {
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return "", fmt.Errorf("Invalid --name-regex pattern \"%s\": %s", pattern, err)
+	}
+	var matches []string
+	for resourceID := range resources {
+		if name := strings.TrimPrefix(resourceID, resourceType+"."); name != resourceID && re.MatchString(name) {
+			matches = append(matches, name)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", nil
+	case 1:
+		return matches[0], nil
+	}
+	sort.Strings(matches)
+	return "", fmt.Errorf("Pattern \"%s\" matches %d %s resources: %s",
+		pattern, len(matches), resourceType, strings.Join(matches, ", "))
+}
+
+// The keys of the resources of the given types in moduleState, prefixed with
+// "module.x." outside the root module
+func resourceNamesOfType(moduleState *terraform.ModuleState, resourceTypes ...string) []string {
+	var names []string
+	for resourceID := range moduleState.Resources {
+		for _, resourceType := range resourceTypes {
+			if strings.HasPrefix(resourceID, resourceType+".") {
+				names = append(names, resourceAddress(moduleState.Path, resourceID))
+			}
+		}
+	}
+	return names
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/hashicorp/terraform/terraform"
+	"strings"
+	"testing"
+)
+
+func TestStateResourceName(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"dsk_attch", "dsk_attch", false},
+		{"dsk_attch.1", "dsk_attch.1", false},
+		{"dsk_attch[0]", "dsk_attch.0", false},
+		{"dsk_attch[12]", "dsk_attch.12", false},
+		{`dsk_attch["a"]`, "", true},
+		{"dsk_attch[]", "", true},
+		{"dsk_attch[01]", "", true},
+		{"dsk_attch[a]", "", true},
+		{"dsk_attch[0", "", true},
+		{"dsk_attch]0[", "", true},
+		{"[0]", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := stateResourceName(tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("stateResourceName(%q): err = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("stateResourceName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMatchResourceName(t *testing.T) {
+	resources := map[string]*terraform.ResourceState{
+		"aws_instance.web_3f9a":    {},
+		"aws_instance.web_b071":    {},
+		"aws_instance.db_1c2d":     {},
+		"aws_ebs_volume.web_3f9a":  {},
+		"aws_security_group.web_0": {},
+	}
+	tests := []struct {
+		pattern string
+		want    string
+		wantErr string
+	}{
+		{"db_.*", "db_1c2d", ""},
+		{"web_3f.*", "web_3f9a", ""},
+		{"web_[0-9a-f]+", "", `Pattern "web_[0-9a-f]+" matches 2 aws_instance resources: web_3f9a, web_b071`},
+		{"web", "", ""}, // the whole name must match
+		{"web_0", "", ""},
+		{"(", "", `Invalid --name-regex pattern "("`},
+	}
+	for _, tt := range tests {
+		got, err := matchResourceName(resources, "aws_instance", tt.pattern)
+		if tt.wantErr != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("%q: got error %v, want %q", tt.pattern, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %q, %v, want %q", tt.pattern, got, err, tt.want)
+		}
+	}
+}
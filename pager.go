@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"github.com/docopt/docopt-go"
+	"github.com/mattn/go-isatty"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Pager used when neither "--pager" nor $PAGER is set. As with git, $LESS
+// defaults to "FRX" so output that fits on the screen is just printed.
+const defaultPager = "less -R"
+
+// Work out the pager command for diff output from "--pager", then $PAGER,
+// then defaultPager. Returns "" if paging is off, with "--no-pager" or a pager
+// of "" or "cat".
+func pagerCommand(opts docopt.Opts, lookupEnv func(string) (string, bool)) string {
+	if noPager, _ := opts.Bool("--no-pager"); noPager {
+		return ""
+	}
+	pager, _ := opts.String("--pager")
+	if pager == "" {
+		if value, set := lookupEnv("PAGER"); set {
+			pager = value
+		} else {
+			pager = defaultPager
+		}
+	}
+	if pager = strings.TrimSpace(pager); pager == "cat" {
+		return ""
+	}
+	return pager
+}
+
+// Print text to stdout, through the pager from pagerCommand when stdout is a
+// terminal. Falls back to printing it directly if the pager can't be run.
+func printPaged(opts docopt.Opts, text string) {
+	pager := pagerCommand(opts, os.LookupEnv)
+	if pager == "" || !isatty.IsTerminal(os.Stdout.Fd()) {
+		fmt.Print(text)
+		return
+	}
+	if err := runPager(pager, text, os.Stdout); err != nil {
+		verbosef("not paging output: %s", err)
+		fmt.Print(text)
+	}
+}
+
+// Exit status of the shell when it can't find the command to run
+const commandNotFoundExitCode = 127
+
+// Run pager as a shell command with text as its input and its output going
+// to w. It's an error if the pager's program can't be found, so the caller
+// can print text itself.
+func runPager(pager, text string, w io.Writer) error {
+	// Skip any leading "NAME=value" assignments to find the program
+	for _, word := range strings.Fields(pager) {
+		if strings.Contains(word, "=") {
+			continue
+		}
+		if _, err := exec.LookPath(word); err != nil {
+			return err
+		}
+		break
+	}
+	cmd := exec.Command("sh", "-c", pager)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout, cmd.Stderr = w, os.Stderr
+	if _, set := os.LookupEnv("LESS"); !set {
+		cmd.Env = append(os.Environ(), "LESS=FRX")
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// The user quitting the pager early isn't an error, but the shell not
+	// finding it is
+	err := cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == commandNotFoundExitCode {
+		return fmt.Errorf("pager \"%s\" not found", pager)
+	}
+	return nil
+}
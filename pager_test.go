@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"github.com/docopt/docopt-go"
+	"testing"
+)
+
+func TestPagerCommand(t *testing.T) {
+	env := func(pager string, set bool) func(string) (string, bool) {
+		return func(name string) (string, bool) {
+			if name == "PAGER" && set {
+				return pager, true
+			}
+			return "", false
+		}
+	}
+	tests := []struct {
+		name   string
+		opts   docopt.Opts
+		lookup func(string) (string, bool)
+		want   string
+	}{
+		{"default", docopt.Opts{}, env("", false), defaultPager},
+		{"$PAGER", docopt.Opts{}, env("more", true), "more"},
+		{"--pager over $PAGER", docopt.Opts{"--pager": "most"}, env("more", true), "most"},
+		{"empty $PAGER", docopt.Opts{}, env("", true), ""},
+		{"cat", docopt.Opts{}, env("cat", true), ""},
+		{"--no-pager", docopt.Opts{"--no-pager": true, "--pager": nil}, env("more", true), ""},
+	}
+	for _, tt := range tests {
+		if got := pagerCommand(tt.opts, tt.lookup); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRunPager(t *testing.T) {
+	var output bytes.Buffer
+	if err := runPager("tr a-z A-Z", "some diff\n", &output); err != nil {
+		t.Fatal(err)
+	}
+	if output.String() != "SOME DIFF\n" {
+		t.Errorf("got %q", output.String())
+	}
+}
+
+func TestRunPagerNotFound(t *testing.T) {
+	for _, pager := range []string{
+		"tf-ebs-attach-no-such-pager -R",
+		"LESS=R tf-ebs-attach-no-such-pager",
+		"true && tf-ebs-attach-no-such-pager",
+	} {
+		var output bytes.Buffer
+		if err := runPager(pager, "some diff\n", &output); err == nil {
+			t.Errorf("%s: expected an error so the diff is printed directly", pager)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/docopt/docopt-go"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The parts of a "terraform show -json <planfile>" document used by plan mode
+type planDocument struct {
+	FormatVersion   string               `json:"format_version"`
+	ResourceChanges []planResourceChange `json:"resource_changes"`
+}
+
+type planResourceChange struct {
+	Address      string `json:"address"`
+	Type         string `json:"type"`
+	Name         string `json:"name"`
+	ActionReason string `json:"action_reason"`
+	Change       struct {
+		Actions      []string               `json:"actions"`
+		Before       map[string]interface{} `json:"before"`
+		After        map[string]interface{} `json:"after"`
+		AfterUnknown map[string]interface{} `json:"after_unknown"`
+	} `json:"change"`
+}
+
+// Report what a plan would do to the volume attachments in it
+func planMode(opts docopt.Opts) {
+	planFileName, _ := opts.String("<plan-json>")
+	attachmentName, _ := opts.String("<att-name>")
+
+	var plan *planDocument
+	var err error
+	if planFileName == "-" {
+		plan, err = readPlan(os.Stdin)
+	} else {
+		var planFile *os.File
+		if planFile, err = os.Open(planFileName); err != nil {
+			die("Error reading plan file: %s", err)
+		}
+		defer planFile.Close()
+		plan, err = readPlan(planFile)
+	}
+	if err != nil {
+		die("%s", err)
+	}
+
+	lines := describeAttachmentChanges(plan, attachmentName)
+	if len(lines) == 0 {
+		if attachmentName != "" {
+			die("No change for aws_volume_attachment."+attachmentName+" in plan", nil)
+		}
+		die("No aws_volume_attachment changes in plan", nil)
+	}
+	fmt.Print(strings.Join(lines, "\n") + "\n")
+}
+
+// Parse the JSON representation of a plan as printed by "terraform show -json"
+func readPlan(r io.Reader) (*planDocument, error) {
+	plan := &planDocument{}
+	if err := json.NewDecoder(r).Decode(plan); err != nil {
+		return nil, fmt.Errorf("Error parsing plan file as JSON: %s", err)
+	}
+	if plan.FormatVersion == "" {
+		return nil, fmt.Errorf("Not a plan: no \"format_version\", was it produced by \"terraform show -json\"?")
+	}
+	return plan, nil
+}
+
+// Describe the planned actions for each aws_volume_attachment, limited to
+// those named attachmentName if it's set. Changed attributes are listed under
+// each attachment to show why it would be updated or replaced.
+func describeAttachmentChanges(plan *planDocument, attachmentName string) []string {
+	var lines []string
+	for _, change := range plan.ResourceChanges {
+		if change.Type != "aws_volume_attachment" {
+			continue
+		}
+		if attachmentName != "" && change.Name != attachmentName {
+			continue
+		}
+		lines = append(lines, describeResourceChange(change)...)
+	}
+	return lines
+}
+
+// Describe the planned actions for one resource, followed by its changed
+// attributes
+func describeResourceChange(change planResourceChange) []string {
+	line := fmt.Sprintf("%s: %s", change.Address, strings.Join(change.Change.Actions, ", "))
+	if change.ActionReason != "" {
+		line += " (" + change.ActionReason + ")"
+	}
+	lines := []string{line}
+
+	if change.Change.Before == nil || change.Change.After == nil {
+		return lines
+	}
+	for _, key := range changedPlanAttributes(change) {
+		after := "(known after apply)"
+		if value, found := change.Change.After[key]; found {
+			after = planValueString(value)
+		}
+		lines = append(lines, fmt.Sprintf("    %s: %s -> %s",
+			key, planValueString(change.Change.Before[key]), after))
+	}
+	return lines
+}
+
+// The address a plan gives the resource resourceID ("type.name", or
+// "type.name.N" with a count index) in the module at modulePath, e.g.
+// "module.app1.aws_volume_attachment.dsk_attch[0]"
+func planResourceAddress(modulePath []string, resourceID string) string {
+	var parts []string
+	for _, module := range modulePath[1:] {
+		parts = append(parts, "module."+module)
+	}
+	fields := strings.SplitN(resourceID, ".", 3)
+	address := strings.Join(fields[:2], ".")
+	if len(fields) == 3 {
+		address += "[" + fields[2] + "]"
+	}
+	return strings.Join(append(parts, address), ".")
+}
+
+// Sorted names of the attributes that differ between before and after
+func changedPlanAttributes(change planResourceChange) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, values := range []map[string]interface{}{change.Change.Before, change.Change.After} {
+		for key := range values {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if unknown, _ := change.Change.AfterUnknown[key].(bool); unknown {
+				keys = append(keys, key)
+				continue
+			}
+			if planValueString(change.Change.Before[key]) != planValueString(change.Change.After[key]) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Format an attribute value from a plan as JSON
+func planValueString(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
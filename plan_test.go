@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDescribeAttachmentChanges(t *testing.T) {
+	f, err := os.Open("testdata/plan.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	plan, err := readPlan(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		`aws_volume_attachment.mysrv_dsk0_attch: delete, create (replace_because_cannot_update)`,
+		`    device_name: "/dev/sdf" -> "/dev/sdg"`,
+		`    id: "vai-1234" -> (known after apply)`,
+		`module.app1.aws_volume_attachment.dsk_attch: create`,
+	}
+	if got := describeAttachmentChanges(plan, ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	if got := describeAttachmentChanges(plan, "dsk_attch"); !reflect.DeepEqual(got, want[3:]) {
+		t.Errorf("filtered by name, got:\n%s", strings.Join(got, "\n"))
+	}
+}
+
+func TestPlanResourceAddress(t *testing.T) {
+	for _, tc := range []struct {
+		modulePath []string
+		resourceID string
+		want       string
+	}{
+		{[]string{"root"}, "aws_volume_attachment.att", "aws_volume_attachment.att"},
+		{[]string{"root"}, "aws_volume_attachment.att.1", "aws_volume_attachment.att[1]"},
+		{[]string{"root", "app1"}, "my_attachment.att", "module.app1.my_attachment.att"},
+		{[]string{"root", "a", "b"}, "aws_volume_attachment.att.0", "module.a.module.b.aws_volume_attachment.att[0]"},
+	} {
+		if got := planResourceAddress(tc.modulePath, tc.resourceID); got != tc.want {
+			t.Errorf("planResourceAddress(%v, %q) = %q, want %q", tc.modulePath, tc.resourceID, got, tc.want)
+		}
+	}
+}
+
+func TestReadPlanNotAPlan(t *testing.T) {
+	if _, err := readPlan(strings.NewReader(`{"version": 3, "modules": []}`)); err == nil {
+		t.Error("expected an error for a state file")
+	}
+}
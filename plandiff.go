@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/docopt/docopt-go"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Inject the attachments in opts into a temporary copy of the state, then run
+// "terraform plan" against it in the configuration's directory and report
+// whether terraform would still change any of them. Exits with
+// diffChangesExitCode if it would.
+func planDiffMode(ctx context.Context, opts docopt.Opts) {
+	// --decrypt-cmd promises the decrypted state is only kept in memory
+	if decryptCommand, _ := opts.String("--decrypt-cmd"); decryptCommand != "" {
+		die("--decrypt-cmd can't be used with plan-diff, terraform would read the decrypted "+
+			"state from a plaintext file", nil)
+	}
+	terraformCommand, _ := opts.String("--terraform-cmd")
+	dir, _ := opts.String("--chdir")
+	if err := checkTerraformDir(ctx, terraformCommand, dir); err != nil {
+		die("%s", err)
+	}
+
+	tfstate, inputBytes := readTfStateFile(ctx, opts)
+	var addresses []string
+	for _, params := range newInjectParams(opts, tfstate) {
+		moduleState, err := injectVolumeAttachment(params, tfstate)
+		if err != nil {
+			die("%s", err)
+		}
+		addresses = append(addresses, planResourceAddress(moduleState.Path, params.attachmentResourceID()))
+	}
+	prepareOutputState(opts, tfstate)
+	var encoded bytes.Buffer
+	if err := writeTfState(&encoded, tfstate, detectStateFormat(inputBytes)); err != nil {
+		die("%s", err)
+	}
+
+	plan, err := planWithState(ctx, terraformCommand, dir, encoded.Bytes())
+	if err != nil {
+		exitIfTimedOut(ctx)
+		die("%s", err)
+	}
+
+	var pending []string
+	for _, address := range addresses {
+		lines := pendingAttachmentChanges(plan, address)
+		if len(lines) == 0 {
+			fmt.Fprintf(os.Stderr, "%s: no changes\n", address)
+		}
+		pending = append(pending, lines...)
+	}
+	if len(pending) == 0 {
+		fmt.Fprint(os.Stderr, "Plan is clean, terraform wouldn't change the imported attachments\n")
+		return
+	}
+	fmt.Print(strings.Join(pending, "\n") + "\n")
+	emitMetrics("")
+	os.Exit(diffChangesExitCode)
+}
+
+// Make sure terraformCommand runs and dir has been initialized with
+// "terraform init", so a failed plan isn't mistaken for a bad import
+func checkTerraformDir(ctx context.Context, terraformCommand, dir string) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", terraformCommand+" version")
+	cmd.Dir = dir
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Can't run \"%s version\", is terraform installed? %s: %s",
+			terraformCommand, err, strings.TrimSpace(string(output)))
+	}
+	if info, err := os.Stat(filepath.Join(dir, ".terraform")); err != nil || !info.IsDir() {
+		return fmt.Errorf("%s has no .terraform directory, run \"terraform init\" there first", dir)
+	}
+	return nil
+}
+
+// Write stateData to a temporary file and plan against it with
+// runTerraformPlan. The file and the plan are removed afterwards.
+func planWithState(ctx context.Context, terraformCommand, dir string, stateData []byte) (*planDocument, error) {
+	tmpDir, err := ioutil.TempDir("", "tf-ebs-attach-plan")
+	if err != nil {
+		return nil, fmt.Errorf("Error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	stateFileName := filepath.Join(tmpDir, "terraform.tfstate")
+	if err := ioutil.WriteFile(stateFileName, stateData, 0600); err != nil {
+		return nil, fmt.Errorf("Error writing temporary state: %s", err)
+	}
+	return runTerraformPlan(ctx, terraformCommand, dir, stateFileName, filepath.Join(tmpDir, "tfplan"))
+}
+
+// Run "<terraformCommand> plan" in dir against the state in stateFileName,
+// saving the plan to planFileName, and return it as read by
+// "<terraformCommand> show -json". terraform's own output goes to stderr with
+// --verbose.
+func runTerraformPlan(ctx context.Context, terraformCommand, dir, stateFileName,
+	planFileName string) (*planDocument, error) {
+
+	var progress io.Writer = ioutil.Discard
+	if verbose {
+		progress = verboseOutput
+	}
+	plan := exec.CommandContext(ctx, "sh", "-c",
+		terraformCommand+` plan -input=false -lock=false -state="$1" -out="$2"`,
+		"sh", stateFileName, planFileName)
+	plan.Dir, plan.Stdout, plan.Stderr = dir, progress, os.Stderr
+	if err := plan.Run(); err != nil {
+		return nil, fmt.Errorf("Error running \"%s plan\" in %s: %s", terraformCommand, dir, err)
+	}
+
+	var output bytes.Buffer
+	show := exec.CommandContext(ctx, "sh", "-c", terraformCommand+` show -json "$1"`, "sh", planFileName)
+	show.Dir, show.Stdout, show.Stderr = dir, &output, os.Stderr
+	if err := show.Run(); err != nil {
+		return nil, fmt.Errorf("Error running \"%s show -json\" in %s: %s", terraformCommand, dir, err)
+	}
+	return readPlan(&output)
+}
+
+// Describe the changes plan would still make to the resource at address, as
+// given by planResourceAddress, leaving out "no-op"
+func pendingAttachmentChanges(plan *planDocument, address string) []string {
+	var lines []string
+	for _, change := range plan.ResourceChanges {
+		if change.Address != address {
+			continue
+		}
+		if len(change.Change.Actions) == 1 && change.Change.Actions[0] == "no-op" {
+			continue
+		}
+		lines = append(lines, describeResourceChange(change)...)
+	}
+	return lines
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlanWithState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-ebs-attach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, ".terraform"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := ioutil.ReadFile("testdata/plan.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "plan.json"), plan, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A stand-in for terraform that checks it's given the state, records
+	// where it was and prints the plan fixture
+	fakeTerraform := `f() { case "$1" in
+		plan) test "$2 $3" = "-input=false -lock=false" && grep -q serial "${4#-state=}" &&
+			echo "${4#-state=}" > state-path && touch "${5#-out=}";;
+		show) test "$2" = -json && test -f "$3" && cat plan.json;;
+		version) echo Terraform v1.5.7;;
+		*) false;;
+		esac; }; f`
+	if err := checkTerraformDir(context.Background(), fakeTerraform, dir); err != nil {
+		t.Fatal(err)
+	}
+	got, err := planWithState(context.Background(), fakeTerraform, dir, []byte(`{"serial": 5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.ResourceChanges) != 3 {
+		t.Errorf("got %d resource changes, want 3", len(got.ResourceChanges))
+	}
+
+	// The temporary state is gone afterwards
+	statePath, err := ioutil.ReadFile(filepath.Join(dir, "state-path"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(strings.TrimSpace(string(statePath))); !os.IsNotExist(err) {
+		t.Errorf("temporary state %s left behind: %v", statePath, err)
+	}
+
+	if _, err := planWithState(context.Background(), "false", dir, []byte(`{}`)); err == nil {
+		t.Error("expected an error when terraform plan fails")
+	}
+}
+
+func TestCheckTerraformDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-ebs-attach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := checkTerraformDir(context.Background(), "true", dir); err == nil ||
+		!strings.Contains(err.Error(), "terraform init") {
+		t.Errorf("uninitialized directory: got %v", err)
+	}
+	if err := checkTerraformDir(context.Background(), "tf-ebs-attach-no-such-terraform", dir); err == nil {
+		t.Error("expected an error for a missing terraform binary")
+	}
+}
+
+func TestPendingAttachmentChanges(t *testing.T) {
+	planFile, err := os.Open("testdata/plan.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer planFile.Close()
+	plan, err := readPlan(planFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := pendingAttachmentChanges(plan, "aws_volume_attachment.mysrv_dsk0_attch")
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "aws_volume_attachment.mysrv_dsk0_attch: delete, create") {
+		t.Errorf("got %q, want the replacement of mysrv_dsk0_attch", lines)
+	}
+
+	// Only the exact address matches: not another module, index or type
+	for _, address := range []string{
+		"aws_volume_attachment.dsk_attch",
+		"module.app1.aws_volume_attachment.dsk_attch[0]",
+		"module.app2.aws_volume_attachment.dsk_attch",
+		"my_attachment.mysrv_dsk0_attch",
+	} {
+		if lines := pendingAttachmentChanges(plan, address); len(lines) != 0 {
+			t.Errorf("%s: got %q, want nothing", address, lines)
+		}
+	}
+	if lines := pendingAttachmentChanges(plan, "module.app1.aws_volume_attachment.dsk_attch"); len(lines) != 1 {
+		t.Errorf("got %q, want the creation of module.app1's dsk_attch", lines)
+	}
+	custom := plan.ResourceChanges[2]
+	custom.Address, custom.Type = "my_attachment.dsk_attch[1]", "my_attachment"
+	plan.ResourceChanges = append(plan.ResourceChanges, custom)
+	if lines := pendingAttachmentChanges(plan, "my_attachment.dsk_attch[1]"); len(lines) != 1 {
+		t.Errorf("got %q, want the creation of my_attachment.dsk_attch[1]", lines)
+	}
+
+	// Once the import is right, the attachment is a no-op
+	for i := range plan.ResourceChanges {
+		plan.ResourceChanges[i].Change.Actions = []string{"no-op"}
+	}
+	if lines := pendingAttachmentChanges(plan, "aws_volume_attachment.mysrv_dsk0_attch"); len(lines) != 0 {
+		t.Errorf("got %q for a no-op, want nothing", lines)
+	}
+}
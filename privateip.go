@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docopt/docopt-go"
+	"github.com/hashicorp/terraform/terraform"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Resolve the instance given by its private IP address or private DNS name
+// for "--by-private-ip" to its ID: "<inst-id>" in show mode, "--instance-id"
+// in import mode. Returns id as it is without "--by-private-ip".
+func instanceIDFromOpts(ctx context.Context, opts docopt.Opts, tfstate *terraform.State, id string) string {
+	if byPrivateIP, _ := opts.Bool("--by-private-ip"); !byPrivateIP {
+		return id
+	}
+	if id == "" {
+		die("--by-private-ip needs the instance's private IP or DNS name in --instance-id", nil)
+	}
+	instanceID, err := lookupInstanceID(ctx, awsCLIFromOpts(opts, tfstate), id)
+	if err != nil {
+		exitIfTimedOut(ctx)
+		die("%s", err)
+	}
+	verbosef("using instance %s for %s", instanceID, id)
+	return instanceID
+}
+
+// Find the ID of the one instance whose private IP address or private DNS
+// name is address with "aws ec2 describe-instances". Terminated instances
+// are left out, and zero or several matches are an error.
+func lookupInstanceID(ctx context.Context, aws awsCLI, address string) (string, error) {
+	filter, what := "private-dns-name", "private DNS name"
+	if net.ParseIP(address) != nil {
+		filter, what = "private-ip-address", "private IP"
+	}
+	output, err := aws.run(ctx, "ec2 describe-instances", "--filters", "Name="+filter+",Values="+address)
+	if err != nil {
+		return "", err
+	}
+
+	var response struct {
+		Reservations []struct {
+			Instances []struct {
+				InstanceID string `json:"InstanceId"`
+				State      struct {
+					Name string `json:"Name"`
+				} `json:"State"`
+			} `json:"Instances"`
+		} `json:"Reservations"`
+	}
+	if err := json.Unmarshal(output, &response); err != nil {
+		return "", fmt.Errorf("Error parsing describe-instances output as JSON: %s", err)
+	}
+	var instanceIDs []string
+	for _, reservation := range response.Reservations {
+		for _, instance := range reservation.Instances {
+			if instance.State.Name != "terminated" {
+				instanceIDs = append(instanceIDs, instance.InstanceID)
+			}
+		}
+	}
+	switch len(instanceIDs) {
+	case 0:
+		return "", fmt.Errorf("No instance with %s %s in %s", what, address, aws.region)
+	case 1:
+		return instanceIDs[0], nil
+	}
+	sort.Strings(instanceIDs)
+	return "", fmt.Errorf("%d instances have %s %s in %s: %s", len(instanceIDs), what, address, aws.region,
+		strings.Join(instanceIDs, ", "))
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestLookupInstanceID(t *testing.T) {
+	// A stand-in for the AWS CLI that answers for one IP and one DNS name
+	fakeAWS := `f() { case "$*" in
+		*"Name=private-ip-address,Values=10.0.1.23") echo '{"Reservations": [{"Instances": [
+			{"InstanceId": "i-0598c7d356eba48d7", "State": {"Name": "running"}},
+			{"InstanceId": "i-0aaaaaaaaaaaaaaa1", "State": {"Name": "terminated"}}]}]}';;
+		*"Name=private-dns-name,Values=ip-10-0-1-24.ec2.internal") echo '{"Reservations": [
+			{"Instances": [{"InstanceId": "i-2", "State": {"Name": "running"}}]},
+			{"Instances": [{"InstanceId": "i-1", "State": {"Name": "stopped"}}]}]}';;
+		*) echo '{"Reservations": []}';;
+		esac; }; f`
+	aws := awsCLI{command: fakeAWS, region: "eu-west-1"}
+
+	if got, err := lookupInstanceID(context.Background(), aws, "10.0.1.23"); err != nil || got != "i-0598c7d356eba48d7" {
+		t.Errorf("by IP: got %q, %v", got, err)
+	}
+	_, err := lookupInstanceID(context.Background(), aws, "ip-10-0-1-24.ec2.internal")
+	if err == nil || !strings.Contains(err.Error(), "2 instances have private DNS name") ||
+		!strings.Contains(err.Error(), "i-1, i-2") {
+		t.Errorf("ambiguous DNS name: got %v", err)
+	}
+	_, err = lookupInstanceID(context.Background(), aws, "10.9.9.9")
+	if err == nil || !strings.Contains(err.Error(), "No instance with private IP 10.9.9.9 in eu-west-1") {
+		t.Errorf("no match: got %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docopt/docopt-go"
+	"github.com/hashicorp/terraform/terraform"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// The desired attachments read by reconcile mode, e.g.
+//
+//	{"attachments": [{"instance": "mysrv", "volume": "mysrv_dsk0",
+//	                  "attachment": "mysrv_dsk0_attch", "device": "/dev/sdg"}]}
+type attachmentManifest struct {
+	Attachments []manifestAttachment `json:"attachments"`
+}
+
+// One attachment in an attachmentManifest, named as in the positional
+// arguments of import mode
+type manifestAttachment struct {
+	Instance   string `json:"instance"`
+	Volume     string `json:"volume"`
+	Attachment string `json:"attachment"`
+	Device     string `json:"device"`
+}
+
+// Import the attachments listed in "<manifest>" that aren't in the state yet,
+// reading from "-i" and writing to "-o"
+func reconcileMode(ctx context.Context, opts docopt.Opts) {
+	tfstate, inputBytes := readTfStateFile(ctx, opts)
+
+	manifestFileName, _ := opts.String("<manifest>")
+	f, err := os.Open(manifestFileName)
+	if err != nil {
+		die("Error opening manifest: %s", err)
+	}
+	paramsList, err := readManifest(f)
+	f.Close()
+	if err != nil {
+		die(fmt.Sprintf("%s: %s", manifestFileName, err), nil)
+	}
+	fillInjectParams(opts, paramsList)
+
+	added, present, err := reconcileAttachments(paramsList, tfstate)
+	if err != nil {
+		die("%s", err)
+	}
+	for _, description := range added {
+		fmt.Fprintf(os.Stderr, "+ %s\n", description)
+	}
+	for _, description := range present {
+		fmt.Fprintf(os.Stderr, "= %s\n", description)
+	}
+	fmt.Fprintf(os.Stderr, "Will add %d, skip %d already present\n", len(added), len(present))
+
+	if dryRun, _ := opts.Bool("--dry-run"); dryRun || len(added) == 0 {
+		return
+	}
+	prepareOutputState(opts, tfstate)
+	confirmWrite(opts, fmt.Sprintf("Adding %d attachment(s)", len(added)), true)
+	writeTfStateFile(ctx, opts, tfstate, inputBytes)
+}
+
+// Parse a manifest, validated against manifest.schema.json, into injectParams
+// with just the four names set
+func readManifest(r io.Reader) ([]injectParams, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading manifest: %s", err)
+	}
+	// Check the structure first, for errors naming the exact field
+	var document interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("Error parsing manifest: %s", err)
+	}
+	if err := validateSchema(manifestSchema(), document, ""); err != nil {
+		return nil, fmt.Errorf("Invalid manifest: %s", err)
+	}
+	var manifest attachmentManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("Error parsing manifest: %s", err)
+	}
+
+	var paramsList []injectParams
+	seen := make(map[string]bool)
+	for _, attachment := range manifest.Attachments {
+		if seen[attachment.Attachment] {
+			return nil, fmt.Errorf("Attachment name \"%s\" given more than once", attachment.Attachment)
+		}
+		seen[attachment.Attachment] = true
+
+		paramsList = append(paramsList, injectParams{
+			instanceName:   attachment.Instance,
+			volumeName:     attachment.Volume,
+			attachmentName: attachment.Attachment,
+			deviceName:     attachment.Device,
+		})
+	}
+	return paramsList, nil
+}
+
+// Inject each attachment in paramsList into tfstate unless it's already there
+// unchanged. Returns descriptions of the ones added and of the ones already
+// present.
+func reconcileAttachments(paramsList []injectParams, tfstate *terraform.State) ([]string, []string, error) {
+	var added, present []string
+	for _, params := range paramsList {
+		moduleState, changed, err := injectVolumeAttachmentChanged(params, tfstate)
+		if err != nil {
+			return nil, nil, err
+		}
+		attachmentResourceID := params.attachmentResourceID()
+		modulePath := strings.Join(moduleState.Path, ".")
+		if changed {
+			added = append(added, fmt.Sprintf("%s to module %s", attachmentResourceID, modulePath))
+		} else {
+			present = append(present, fmt.Sprintf("%s in module %s", attachmentResourceID, modulePath))
+		}
+	}
+	return added, present, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadManifest(t *testing.T) {
+	paramsList, err := readManifest(strings.NewReader(`{"attachments": [
+		{"instance": "web", "volume": "web_dsk", "attachment": "web_att", "device": "/dev/sdf"},
+		{"instance": "db", "volume": "db_dsk", "attachment": "db_att", "device": "sdg"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []injectParams{
+		{instanceName: "web", volumeName: "web_dsk", attachmentName: "web_att", deviceName: "/dev/sdf"},
+		{instanceName: "db", volumeName: "db_dsk", attachmentName: "db_att", deviceName: "sdg"},
+	}
+	if !reflect.DeepEqual(paramsList, want) {
+		t.Errorf("got %+v, want %+v", paramsList, want)
+	}
+
+	for _, manifest := range []string{
+		`{"attachments": [{"instance": "web", "volume": "web_dsk", "attachment": "web_att"}]}`,
+		`{"attachments": [{"instance": "web", "volume": "web_dsk", "attachment": "a", "device": "sdf"},
+			{"instance": "db", "volume": "db_dsk", "attachment": "a", "device": "sdg"}]}`,
+		`{"attachments": [{"instance": "web", "volume": "web_dsk", "attachment": "a", "dev": "sdf"}]}`,
+		`[]`,
+	} {
+		if _, err := readManifest(strings.NewReader(manifest)); err == nil {
+			t.Errorf("expected an error for %s", manifest)
+		}
+	}
+}
+
+func TestReconcileAttachments(t *testing.T) {
+	tfstate := loadTfState(t, "single-module.tfstate")
+	existing := injectParams{
+		instanceName: "mysrv", volumeName: "mysrv_dsk0",
+		attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+	}
+	if _, err := injectVolumeAttachment(existing, tfstate); err != nil {
+		t.Fatal(err)
+	}
+
+	paramsList := []injectParams{existing, {
+		instanceName: "mysrv", volumeName: "mysrv_dsk0",
+		attachmentName: "mysrv_dsk0_attch2", deviceName: "/dev/sdh",
+	}}
+	added, present, err := reconcileAttachments(paramsList, tfstate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantAdded := []string{"aws_volume_attachment.mysrv_dsk0_attch2 to module root"}
+	wantPresent := []string{"aws_volume_attachment.mysrv_dsk0_attch in module root"}
+	if !reflect.DeepEqual(added, wantAdded) || !reflect.DeepEqual(present, wantPresent) {
+		t.Errorf("added %q, present %q, want %q and %q", added, present, wantAdded, wantPresent)
+	}
+
+	// Reconciling again finds nothing left to do
+	added, present, err = reconcileAttachments(paramsList, tfstate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 0 || len(present) != 2 {
+		t.Errorf("second run: added %q, present %q", added, present)
+	}
+}
+
+func TestReadManifestSchemaErrors(t *testing.T) {
+	tests := []struct {
+		manifest string
+		want     string
+	}{
+		{`[]`, "the manifest must be an object"},
+		{`{}`, "attachments is required"},
+		{`{"attachments": {}}`, "attachments must be an array"},
+		{`{"attachments": [], "extra": 1}`, "extra is not allowed"},
+		{`{"attachments": [
+			{"instance": "a", "volume": "b", "attachment": "c", "device": "sdf"},
+			{"instance": "a", "volume": "b", "attachment": "d", "device": "sdg"},
+			{"instance": "a", "volume": "b", "attachment": "e", "dev": "sdh"}
+		]}`, "attachments[2].device is required"},
+		{`{"attachments": [{"instance": "a", "volume": "b", "attachment": "c", "device": "sdf", "dev": "sdf"}]}`,
+			"attachments[0].dev is not allowed"},
+		{`{"attachments": [{"instance": 1, "volume": "b", "attachment": "c", "device": "sdf"}]}`,
+			"attachments[0].instance must be a string"},
+		{`{"attachments": [{"instance": "a", "volume": "", "attachment": "c", "device": "sdf"}]}`,
+			"attachments[0].volume must not be empty"},
+		{`{"attachments": ["a:b:c:sdf"]}`, "attachments[0] must be an object"},
+	}
+
+	for _, tt := range tests {
+		_, err := readManifest(strings.NewReader(tt.manifest))
+		if err == nil || err.Error() != "Invalid manifest: "+tt.want {
+			t.Errorf("%s: got error %v, want %q", tt.manifest, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Set by "--max-retries"
+var maxRetries = 3
+
+// Delay before the first retry, doubling for each one after that
+var retryBaseDelay = 500 * time.Millisecond
+
+// An error that may go away if the operation is tried again, such as a
+// timeout or a throttling response. Anything else is treated as permanent.
+type retryableError struct {
+	err error
+}
+
+func (e retryableError) Error() string {
+	return e.err.Error()
+}
+
+// Run operation, retrying it up to maxRetries times with exponential backoff
+// for as long as it fails with a retryableError and ctx isn't done. Returns
+// the last error with any retryableError wrapper removed.
+func withRetries(ctx context.Context, what string, operation func(ctx context.Context) error) error {
+	delay := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		err := operation(ctx)
+		retryable, ok := err.(retryableError)
+		if !ok {
+			return err
+		}
+		if attempt >= maxRetries {
+			return retryable.err
+		}
+
+		verbosef("%s failed (%s), retrying in %s", what, retryable.err, delay)
+		select {
+		case <-ctx.Done():
+			return retryable.err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
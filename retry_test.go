@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWithRetries(t *testing.T) {
+	defer func(delay time.Duration) { retryBaseDelay = delay }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	tests := []struct {
+		name         string
+		failures     int
+		retryable    bool
+		wantAttempts int
+		wantErr      bool
+	}{
+		{"succeeds first time", 0, true, 1, false},
+		{"succeeds after transient errors", 2, true, 3, false},
+		{"gives up after max retries", 10, true, 4, true},
+		{"doesn't retry permanent errors", 10, false, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := withRetries(context.Background(), "test", func(ctx context.Context) error {
+				attempts++
+				if attempts > tt.failures {
+					return nil
+				}
+				if tt.retryable {
+					return retryableError{errors.New("throttled")}
+				}
+				return errors.New("access denied")
+			})
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, wrapped := err.(retryableError); wrapped {
+				t.Error("retryableError wrapper leaked to the caller")
+			}
+		})
+	}
+}
+
+func TestWithRetriesCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	attempts := 0
+	err := withRetries(ctx, "test", func(ctx context.Context) error {
+		attempts++
+		return retryableError{errors.New("timeout")}
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("attempts = %d, err = %v; want 1 attempt and an error", attempts, err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/docopt/docopt-go"
+	"github.com/hashicorp/terraform/terraform"
+	"os"
+)
+
+// Print a minimal state with just the instance, volume and attachment given
+// in opts, e.g. as a fixture for tests
+func scaffoldMode(opts docopt.Opts) {
+	instanceName, _ := opts.String("<inst-name>")
+	instanceID, _ := opts.String("<inst-id>")
+	volumeID, _ := opts.String("<vol-id>")
+	attachmentName, err := stateResourceName(opts["<att-name>"].(string))
+	if err != nil {
+		die("%s", err)
+	}
+	volumeName, err := stateResourceName(opts["<vol-name>"].(string))
+	if err != nil {
+		die("%s", err)
+	}
+	deviceName := deviceNameFromOpts(opts)
+	provider, _ := opts.String("--provider")
+
+	lineage, err := newLineage()
+	if err != nil {
+		die("Error generating lineage: %s", err)
+	}
+	types := resourceTypesFromOpts(opts).withDefaults()
+	tfstate, err := newScaffoldState(types, instanceName, instanceID, volumeName, volumeID,
+		attachmentName, deviceName, provider, lineage)
+	if err != nil {
+		die("%s", err)
+	}
+	moduleState := tfstate.Modules[0]
+	applyAttributes(types.attachment+"."+attachmentName,
+		moduleState.Resources[types.attachment+"."+attachmentName], attributesFromOpts(opts))
+
+	format := defaultStateFormat
+	format.compact, _ = opts.Bool("--compact")
+	if err := writeTfState(os.Stdout, tfstate, format); err != nil {
+		die("%s", err)
+	}
+}
+
+// Build a new state with a root module holding placeholder instance and
+// volume resources, recording only their IDs, and the attachment between them
+func newScaffoldState(types resourceTypes, instanceName, instanceID, volumeName, volumeID, attachmentName,
+	deviceName, provider, lineage string) (*terraform.State, error) {
+
+	attachmentState, err := newVolumeAttachmentState(types, instanceName, instanceID, volumeName,
+		volumeID, deviceName, provider)
+	if err != nil {
+		return nil, err
+	}
+
+	tfstate := &terraform.State{
+		Version: terraform.StateVersion,
+		Serial:  1,
+		Lineage: lineage,
+		Modules: []*terraform.ModuleState{{
+			Path:    terraform.RootModulePath,
+			Outputs: map[string]*terraform.OutputState{},
+			Resources: map[string]*terraform.ResourceState{
+				types.instance + "." + instanceName:     placeholderResourceState(types.instance, instanceID, provider),
+				types.volume + "." + volumeName:         placeholderResourceState(types.volume, volumeID, provider),
+				types.attachment + "." + attachmentName: attachmentState,
+			},
+			Dependencies: []string{},
+		}},
+	}
+	return tfstate, nil
+}
+
+// A resource of the given type recording nothing but its ID
+func placeholderResourceState(resourceType, id, provider string) *terraform.ResourceState {
+	return &terraform.ResourceState{
+		Type:         resourceType,
+		Dependencies: []string{},
+		Primary: &terraform.InstanceState{
+			ID:         id,
+			Attributes: map[string]string{"id": id},
+			Meta:       make(map[string]interface{}),
+		},
+		Deposed:  []*terraform.InstanceState{},
+		Provider: provider,
+	}
+}
+
+// Generate a random lineage in the UUID format terraform uses
+func newLineage() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/hashicorp/terraform/terraform"
+	"regexp"
+	"testing"
+)
+
+func TestNewScaffoldState(t *testing.T) {
+	tfstate, err := newScaffoldState(defaultResourceTypes, "mysrv", "i-abc123", "mysrv_dsk0", "vol-123abc",
+		"mysrv_dsk0_attch", "/dev/sdg", "provider.aws", "8e7a7a39-8b4c-4e5a-9f5b-3c1bd1f3a0a2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The scaffold must read back as a valid state
+	var out bytes.Buffer
+	if err := writeTfState(&out, tfstate, defaultStateFormat); err != nil {
+		t.Fatal(err)
+	}
+	readBack, _, err := readTfState(&out, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readBack.Version != 3 || readBack.Serial != 1 || readBack.Lineage != tfstate.Lineage {
+		t.Errorf("version %d, serial %d, lineage %q", readBack.Version, readBack.Serial, readBack.Lineage)
+	}
+
+	// ... in which importing the same attachment changes nothing
+	before := snapshotTfState(readBack)
+	params := injectParams{
+		instanceName: "mysrv", volumeName: "mysrv_dsk0",
+		attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg", provider: "provider.aws",
+	}
+	if _, err := injectVolumeAttachment(params, readBack); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, snapshotTfState(readBack)) {
+		t.Error("importing into the scaffold changed it")
+	}
+}
+
+func TestNewLineage(t *testing.T) {
+	pattern := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	a, err := newLineage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newLineage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pattern.MatchString(a) || a == b {
+		t.Errorf("lineages %q and %q", a, b)
+	}
+}
+
+// Encode tfstate for comparing it before and after a change
+func snapshotTfState(tfstate *terraform.State) []byte {
+	data, err := json.Marshal(tfstate)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
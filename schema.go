@@ -0,0 +1,103 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// JSON Schema of the manifest read by reconcile mode
+//
+//go:embed manifest.schema.json
+var manifestSchemaJSON []byte
+
+// The subset of JSON Schema used by manifest.schema.json, which is all
+// validateSchema checks
+type jsonSchema struct {
+	Type                 string                 `json:"type"`
+	Required             []string               `json:"required"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	MinLength            int                    `json:"minLength"`
+}
+
+// Check value, as decoded by encoding/json into an interface{}, against
+// schema, returning the first violation found. path names value in the
+// message, e.g. "attachments[2].device is required".
+func validateSchema(schema *jsonSchema, value interface{}, path string) error {
+	name := path
+	if name == "" {
+		name = "the manifest"
+	}
+
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an object", name)
+		}
+		for _, key := range schema.Required {
+			if _, found := object[key]; !found {
+				return fmt.Errorf("%s is required", joinSchemaPath(path, key))
+			}
+		}
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			property, found := schema.Properties[key]
+			if !found {
+				if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+					return fmt.Errorf("%s is not allowed", joinSchemaPath(path, key))
+				}
+				continue
+			}
+			if err := validateSchema(property, object[key], joinSchemaPath(path, key)); err != nil {
+				return err
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an array", name)
+		}
+		if schema.Items == nil {
+			return nil
+		}
+		for i, item := range array {
+			if err := validateSchema(schema.Items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", name)
+		}
+		if len(str) < schema.MinLength {
+			return fmt.Errorf("%s must not be empty", name)
+		}
+	}
+	return nil
+}
+
+// Name the property key of the value at path
+func joinSchemaPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// Parse the embedded manifest schema
+func manifestSchema() *jsonSchema {
+	var schema jsonSchema
+	if err := json.Unmarshal(manifestSchemaJSON, &schema); err != nil {
+		die("Internal error parsing the manifest schema: %s", err)
+	}
+	return &schema
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"github.com/docopt/docopt-go"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Show mode command lines, each with its expected output in testdata/<golden>
+var showTests = []struct {
+	golden string
+	args   []string
+}{
+	{"show-basic.golden", []string{"i-abc123", "mysrv_dsk0", "vol-123abc", "mysrv_dsk0_attch", "/dev/sdg"}},
+	{"show-real-ids.golden", []string{"i-0598c7d356eba48d7", "data", "vol-049df61146c4d7901", "data_attch",
+		"/dev/xvdf"}},
+	{"show-provider-alias.golden", []string{"--provider", "provider.aws.west", "i-1a2b3c4d", "logs", "vol-1a2b3c4d",
+		"logs_attch", "/dev/sdh"}},
+	{"show-compact.golden", []string{"--compact", "i-abc123", "mysrv_dsk0", "vol-123abc", "mysrv_dsk0_attch",
+		"/dev/sdg"}},
+}
+
+// Parse "show" followed by args as main does, run showMode and return what
+// it printed
+func runShowMode(t *testing.T, args ...string) []byte {
+	t.Helper()
+	parser := &docopt.Parser{HelpHandler: docopt.NoHelpHandler}
+	opts, err := parser.ParseArgs(usage, append([]string{"show"}, args...), "")
+	if err != nil {
+		t.Fatalf("parsing %v: %s", args, err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	output := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		output <- data
+	}()
+	stdout := os.Stdout
+	os.Stdout = w
+	func() {
+		defer func() { os.Stdout = stdout }()
+		showMode(context.Background(), opts)
+	}()
+	w.Close()
+	return <-output
+}
+
+func TestShowGolden(t *testing.T) {
+	for _, tt := range showTests {
+		checkGolden(t, tt.golden, runShowMode(t, tt.args...))
+	}
+}
+
+func TestShowTfShowGolden(t *testing.T) {
+	var out []byte
+	for _, args := range [][]string{
+		{"--output-format", "tfshow", "i-abc123", "mysrv_dsk0", "vol-123abc", "mysrv_dsk0_attch", "/dev/sdg"},
+		{"--output-format", "tfshow", "--attribute", "force_detach=true", "i-abc123", "mysrv_dsk0", "vol-123abc",
+			"data_attch[1]", "/dev/sdg"},
+	} {
+		out = append(out, runShowMode(t, args...)...)
+	}
+	checkGolden(t, "show-tfshow.golden", out)
+}
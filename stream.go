@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/docopt/docopt-go"
+	"github.com/hashicorp/terraform/terraform"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Import the attachments in opts like importMode, but copy the state through
+// a temporary file one module at a time instead of holding all of it in
+// memory, for states too large to parse in one go
+func streamImportMode(ctx context.Context, opts docopt.Opts) {
+	paramsList := newInjectParams(opts, nil)
+
+	inputFileName, _ := opts.String("-i")
+	inputFileName = resolveStateFileName(inputFileName)
+	var input io.Reader = os.Stdin
+	if isStateURL(inputFileName) {
+		die("Reading state from a URL isn't supported with --stream", nil)
+	} else if inputFileName != "-" {
+		inputFile, err := os.Open(inputFileName)
+		if err != nil {
+			exitIfInputMissing(opts, inputFileName, err)
+			die("Error reading input file: %s", err)
+		}
+		defer inputFile.Close()
+		input = inputFile
+	}
+
+	// The serial is written before we know whether anything was added, so
+	// the result is only copied to the outputs once it's complete
+	tmp, err := ioutil.TempFile("", "tf-ebs-attach-stream")
+	if err != nil {
+		die("Error creating temporary file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	compact, _ := opts.Bool("--compact")
+	descriptions, changed, err := streamInjectVolumeAttachments(ctx, input, tmp, paramsList, compact)
+	if err != nil {
+		exitIfTimedOut(ctx)
+		die("%s", err)
+	}
+	if !changed {
+		var resourceIDs []string
+		for _, params := range paramsList {
+			resourceIDs = append(resourceIDs, params.attachmentResourceID())
+		}
+		sort.Strings(resourceIDs)
+		fmt.Fprintf(os.Stderr, "%s already present, no changes\n", strings.Join(resourceIDs, ", "))
+		return
+	}
+
+	confirmWrite(opts, "Adding "+strings.Join(descriptions, ", "), true)
+	exitIfTimedOut(ctx)
+	// As in writeTfStateFile, an interruption only stops the first output
+	writeCtx := ctx
+	for _, outputFileName := range resolveOutputFileNames(opts) {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			die("Error reading temporary file: %s", err)
+		}
+		if outputFileName == "-" {
+			if _, err := io.Copy(os.Stdout, tmp); err != nil {
+				die("Error writing output file: %s", err)
+			}
+			writeCtx = context.Background()
+			continue
+		}
+		if err := backupFile(outputFileName); err != nil {
+			die("Error backing up output file: %s", err)
+		}
+		err := writeFileAtomicFunc(writeCtx, outputFileName, 0644, func(w io.Writer) error {
+			_, err := io.Copy(w, tmp)
+			return err
+		})
+		if err != nil {
+			exitIfTimedOut(writeCtx)
+			die("Error writing output file: %s", err)
+		}
+		writeCtx = context.Background()
+	}
+}
+
+// Copy the version 3 state in r to w, adding the attachments in paramsList to
+// the first module each can go in as injectVolumeAttachment would and
+// incrementing the serial. Only one module is decoded at a time. The output
+// is indented as terraform writes it, or compact. Returns a description of
+// each attachment and whether any of them was new. The output is only
+// complete once this returns without an error, since attachments that
+// duplicate one in another module are only known at the end.
+func streamInjectVolumeAttachments(ctx context.Context, r io.Reader, w io.Writer,
+	paramsList []injectParams, compact bool) ([]string, bool, error) {
+
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	output := bufio.NewWriter(w)
+	if token, err := decoder.Token(); err == io.EOF {
+		return nil, false, fmt.Errorf("Input is empty, there is no state to modify")
+	} else if err != nil || token != json.Delim('{') {
+		return nil, false, fmt.Errorf("Error parsing input file as JSON: expected an object")
+	}
+
+	stream := &stateStream{output: output, compact: compact}
+	stream.writeString("{")
+	pending := make([]error, len(paramsList))
+	descriptions := make([]string, len(paramsList))
+	changed := false
+	// Every attachment seen in any module, to find the ones added twice
+	index := make(attachmentIndex)
+	attachmentTypes := make(map[string]bool)
+	for _, params := range paramsList {
+		attachmentTypes[params.types.withDefaults().attachment] = true
+	}
+	var added []indexedAttachment
+	sawSerial := false
+	for first := true; decoder.More(); first = false {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, false, fmt.Errorf("Error parsing input file as JSON: %s", err)
+		}
+		key := token.(string)
+		if !first {
+			stream.writeString(",")
+		}
+		stream.newline(1)
+		stream.writeValue(key, 1)
+		stream.writeString(":")
+		if !compact {
+			stream.writeString(" ")
+		}
+
+		switch key {
+		case "modules":
+			if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+				return nil, false, fmt.Errorf("Error parsing input file as JSON: expected a list of modules")
+			}
+			stream.writeString("[")
+			modules := 0
+			for ; decoder.More(); modules++ {
+				if err := ctx.Err(); err != nil {
+					return nil, false, err
+				}
+				var moduleState terraform.ModuleState
+				if err := decoder.Decode(&moduleState); err != nil {
+					return nil, false, fmt.Errorf("Error parsing input file as JSON: %s", err)
+				}
+				for i, params := range paramsList {
+					if descriptions[i] != "" {
+						continue
+					}
+					isNew, err := streamInjectModule(params, &moduleState)
+					if err != nil && !isNotInModule(err, params) {
+						return nil, false, err
+					} else if err != nil {
+						pending[i] = strongerNotFound(pending[i], err)
+						continue
+					}
+					descriptions[i] = fmt.Sprintf("%s to module %s",
+						params.attachmentResourceID(), strings.Join(moduleState.Path, "."))
+					if isNew {
+						attachmentType := params.types.withDefaults().attachment
+						attachment := newIndexedAttachment(&moduleState, attachmentType,
+							params.attachmentResourceID())
+						attachment.force = params.force
+						added = append(added, attachment)
+						changed = true
+					}
+				}
+				index.add(&moduleState, attachmentTypes)
+				if modules > 0 {
+					stream.writeString(",")
+				}
+				stream.newline(2)
+				stream.writeValue(&moduleState, 2)
+			}
+			if _, err := decoder.Token(); err != nil {
+				return nil, false, fmt.Errorf("Error parsing input file as JSON: %s", err)
+			}
+			if modules > 0 {
+				stream.newline(1)
+			}
+			stream.writeString("]")
+		case "serial":
+			var serial int64
+			if err := decoder.Decode(&serial); err != nil {
+				return nil, false, fmt.Errorf("Error parsing input file as JSON: %s", err)
+			}
+			stream.writeValue(serial+1, 1)
+			sawSerial = true
+		default:
+			var value json.RawMessage
+			if err := decoder.Decode(&value); err != nil {
+				return nil, false, fmt.Errorf("Error parsing input file as JSON: %s", err)
+			}
+			if key == "version" {
+				var version int
+				if err := json.Unmarshal(value, &version); err == nil && version > maxSupportedVersion {
+					return nil, false, fmt.Errorf("State version %d is newer than this tool supports (%d): %w",
+						version, maxSupportedVersion, errUnsupportedStateVersion)
+				}
+			} else if key == "resources" {
+				return nil, false, fmt.Errorf("This state lists its resources at the top level, "+
+					"as terraform 0.12+ does, and can't be edited by this tool yet: %w",
+					errUnsupportedStateVersion)
+			}
+			stream.writeRaw(value, 1)
+		}
+	}
+	// A state without a serial is read as serial 0, as readTfState does
+	if !sawSerial {
+		stream.writeString(",")
+		stream.newline(1)
+		stream.writeValue("serial", 1)
+		stream.writeString(":")
+		if !compact {
+			stream.writeString(" ")
+		}
+		stream.writeValue(1, 1)
+	}
+	stream.newline(0)
+	stream.writeString("}\n")
+
+	for i, params := range paramsList {
+		if descriptions[i] == "" {
+			notFound := pending[i]
+			if notFound == nil {
+				notFound = errInstanceNotFound
+			}
+			return nil, false, fmt.Errorf("Could not locate module in tfstate containing (\"%s\", \"%s\"): %w",
+				params.types.withDefaults().instance+"."+params.instanceName,
+				params.types.withDefaults().volume+"."+params.volumeName, notFound)
+		}
+	}
+	// injectVolumeAttachment only saw the attachment's own module, so check
+	// the others as it would for the whole state
+	for _, attachment := range added {
+		if err := index.checkDuplicates(attachment); err != nil {
+			return nil, false, err
+		}
+	}
+	if stream.err != nil {
+		return nil, false, fmt.Errorf("Error writing output file: %s", stream.err)
+	}
+	if err := output.Flush(); err != nil {
+		return nil, false, fmt.Errorf("Error writing output file: %s", err)
+	}
+	return descriptions, changed, nil
+}
+
+// Inject params into moduleState alone, returning whether the attachment
+// was added rather than already present
+func streamInjectModule(params injectParams, moduleState *terraform.ModuleState) (bool, error) {
+	attachmentResourceID := params.attachmentResourceID()
+	existing := moduleState.Resources[attachmentResourceID]
+	_, err := injectVolumeAttachment(params, &terraform.State{Modules: []*terraform.ModuleState{moduleState}})
+	if err != nil {
+		return false, err
+	}
+	return moduleState.Resources[attachmentResourceID] != existing, nil
+}
+
+// The instance, volume and device an attachment joins, which identify it
+// regardless of its name
+type attachmentTriple struct {
+	attachmentType, instanceID, volumeID, deviceName string
+}
+
+// An attachment at address in the module at modulePath
+type indexedAttachment struct {
+	attachmentTriple
+	modulePath []string
+	address    string
+	force      bool
+}
+
+// Attachments by what they attach, across all the modules streamed so far
+type attachmentIndex map[attachmentTriple][]indexedAttachment
+
+// Describe resourceID of attachmentType in moduleState for the index
+func newIndexedAttachment(moduleState *terraform.ModuleState, attachmentType,
+	resourceID string) indexedAttachment {
+
+	attributes := moduleState.Resources[resourceID].Primary.Attributes
+	return indexedAttachment{
+		attachmentTriple: attachmentTriple{attachmentType, attributes["instance_id"], attributes["volume_id"],
+			attributes["device_name"]},
+		modulePath: moduleState.Path,
+		address:    resourceAddress(moduleState.Path, resourceID),
+	}
+}
+
+// Record the attachments in moduleState whose type is in attachmentTypes
+func (index attachmentIndex) add(moduleState *terraform.ModuleState, attachmentTypes map[string]bool) {
+	for resourceID, resourceState := range moduleState.Resources {
+		if !attachmentTypes[resourceState.Type] || resourceState.Primary == nil {
+			continue
+		}
+		attachment := newIndexedAttachment(moduleState, resourceState.Type, resourceID)
+		index[attachment.attachmentTriple] = append(index[attachment.attachmentTriple], attachment)
+	}
+}
+
+// Reject attachment if another module already attaches the same volume to
+// the same instance as the same device, as checkSameAttachmentElsewhere does
+// for the whole state. Its own module was checked when it was added.
+func (index attachmentIndex) checkDuplicates(attachment indexedAttachment) error {
+	var addresses []string
+	for _, other := range index[attachment.attachmentTriple] {
+		if !reflect.DeepEqual(other.modulePath, attachment.modulePath) {
+			addresses = append(addresses, other.address)
+		}
+	}
+	if len(addresses) == 0 {
+		return nil
+	}
+	sort.Strings(addresses)
+	if !attachment.force {
+		return fmt.Errorf("%s already attaches %s to %s as %s, adding \"%s\" would duplicate it "+
+			"(use --force to add it anyway): %w", strings.Join(addresses, ", "), attachment.volumeID,
+			attachment.instanceID, attachment.deviceName, attachment.address, errDuplicateAttachment)
+	}
+	for _, address := range addresses {
+		warnf("%s already attaches %s to %s as %s", address, attachment.volumeID, attachment.instanceID,
+			attachment.deviceName)
+	}
+	return nil
+}
+
+// Whether err only means params didn't match this module, or this document
+// of several, so a later one should be tried
+func isNotInModule(err error, params injectParams) bool {
+	return errors.Is(err, errInstanceNotFound) || errors.Is(err, errVolumeNotFound) ||
+		(params.skipAttached && errors.Is(err, errResourceExists))
+}
+
+// The more specific of two reasons for not finding a module, as
+// injectVolumeAttachment reports them for the whole state
+func strongerNotFound(a, b error) error {
+	for _, notFound := range []error{errResourceExists, errVolumeNotFound} {
+		if errors.Is(a, notFound) {
+			return notFound
+		}
+		if errors.Is(b, notFound) {
+			return notFound
+		}
+	}
+	return errInstanceNotFound
+}
+
+// Writer of an indented or compact JSON document piece by piece. The first
+// error is kept and later writes are skipped.
+type stateStream struct {
+	output  *bufio.Writer
+	compact bool
+	err     error
+}
+
+func (s *stateStream) writeString(str string) {
+	if s.err == nil {
+		_, s.err = s.output.WriteString(str)
+	}
+}
+
+// Start a new line indented to depth, unless writing compact JSON
+func (s *stateStream) newline(depth int) {
+	if !s.compact {
+		s.writeString("\n" + strings.Repeat("    ", depth))
+	}
+}
+
+// Encode value as JSON starting at the given depth of indentation
+func (s *stateStream) writeValue(value interface{}, depth int) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		s.err = err
+		return
+	}
+	s.writeRaw(data, depth)
+}
+
+// Reformat the JSON in data to start at the given depth of indentation
+func (s *stateStream) writeRaw(data []byte, depth int) {
+	if s.err != nil {
+		return
+	}
+	var formatted bytes.Buffer
+	if s.compact {
+		s.err = json.Compact(&formatted, data)
+	} else {
+		s.err = json.Indent(&formatted, data, strings.Repeat("    ", depth), "    ")
+	}
+	if s.err == nil {
+		_, s.err = s.output.Write(formatted.Bytes())
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/terraform/terraform"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Import params in the fixture both ways and compare the results
+func TestStreamInjectMatchesImport(t *testing.T) {
+	tests := []struct {
+		fixture    string
+		paramsList []injectParams
+	}{
+		{"single-module.tfstate", []injectParams{{
+			instanceName: "mysrv", volumeName: "mysrv_dsk0",
+			attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+		}}},
+		{"multi-module.tfstate", []injectParams{{
+			instanceName: "srv", volumeName: "dsk",
+			attachmentName: "dsk_attch", deviceName: "/dev/sdh",
+		}, {
+			instanceName: "srv", volumeName: "dsk",
+			attachmentName: "dsk_attch", deviceName: "/dev/sdh", skipAttached: true,
+		}}},
+		{"multi-module.tfstate", []injectParams{{
+			instanceName: "srv", volumeName: "dsk",
+			attachmentName: "dsk_attch", deviceName: "/dev/sdh", under: "root.app2",
+		}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			tfstate := loadTfState(t, tt.fixture)
+			var wantDescriptions []string
+			for _, params := range tt.paramsList {
+				moduleState, err := injectVolumeAttachment(params, tfstate)
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantDescriptions = append(wantDescriptions, fmt.Sprintf("%s to module %s",
+					params.attachmentResourceID(), strings.Join(moduleState.Path, ".")))
+			}
+			tfstate.Serial++
+			var want bytes.Buffer
+			if err := writeTfState(&want, tfstate, defaultStateFormat); err != nil {
+				t.Fatal(err)
+			}
+
+			input, err := os.Open("testdata/" + tt.fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer input.Close()
+			var got bytes.Buffer
+			descriptions, changed, err := streamInjectVolumeAttachments(context.Background(), input, &got,
+				tt.paramsList, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !changed {
+				t.Error("changed = false, want true")
+			}
+			if strings.Join(descriptions, "\n") != strings.Join(wantDescriptions, "\n") {
+				t.Errorf("descriptions = %q, want %q", descriptions, wantDescriptions)
+			}
+			if got.String() != want.String() {
+				t.Errorf("streamed state:\n%s\nwant:\n%s", got.String(), want.String())
+			}
+		})
+	}
+}
+
+func TestStreamInjectCompact(t *testing.T) {
+	// The attachment is already present, so only the serial changes
+	tfstate := loadTfState(t, "single-module.tfstate")
+	params := injectParams{
+		instanceName: "mysrv", volumeName: "mysrv_dsk0",
+		attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+	}
+	if _, err := injectVolumeAttachment(params, tfstate); err != nil {
+		t.Fatal(err)
+	}
+	var input, want, got bytes.Buffer
+	if err := writeTfState(&input, tfstate, defaultStateFormat); err != nil {
+		t.Fatal(err)
+	}
+	tfstate.Serial++
+	if err := writeTfState(&want, tfstate, stateFormat{newline: "\n", trailingNewline: true, compact: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, changed, err := streamInjectVolumeAttachments(context.Background(), &input, &got,
+		[]injectParams{params}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Error("changed = true for an attachment already present")
+	}
+	if got.String() != want.String() {
+		t.Errorf("streamed state:\n%s\nwant:\n%s", got.String(), want.String())
+	}
+}
+
+func TestStreamInjectErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		params  injectParams
+		wantErr error
+	}{
+		{"no match", "single-module.tfstate", injectParams{
+			instanceName: "othersrv", volumeName: "mysrv_dsk0",
+			attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+		}, errInstanceNotFound},
+		{"instance without volume", "multi-module.tfstate", injectParams{
+			instanceName: "srv", volumeName: "otherdsk",
+			attachmentName: "dsk_attch", deviceName: "/dev/sdh",
+		}, errVolumeNotFound},
+		{"differing duplicate", "attached.tfstate", injectParams{
+			instanceName: "mysrv", volumeName: "mysrv_dsk0",
+			attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+		}, errResourceExists},
+		{"tainted", "tainted.tfstate", injectParams{
+			instanceName: "mysrv", volumeName: "mysrv_dsk0",
+			attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+		}, errResourceTainted},
+		{"version 4", "v4.tfstate", injectParams{
+			instanceName: "mysrv", volumeName: "mysrv_dsk0",
+			attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+		}, errUnsupportedStateVersion},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input, err := os.Open("testdata/" + tt.fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer input.Close()
+			var output bytes.Buffer
+			_, _, err = streamInjectVolumeAttachments(context.Background(), input, &output,
+				[]injectParams{tt.params}, false)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, _, err := streamInjectVolumeAttachments(context.Background(), strings.NewReader(""),
+		&bytes.Buffer{}, nil, false); err == nil {
+		t.Error("expected an error for empty input")
+	}
+}
+
+// An attachment in one module that duplicates one in another is rejected, as
+// it is when importing the whole state
+func TestStreamInjectDuplicateElsewhere(t *testing.T) {
+	tfstate := loadTfState(t, "multi-module.tfstate")
+	params := injectParams{
+		instanceName: "srv", volumeName: "dsk",
+		attachmentName: "dsk_attch", deviceName: "/dev/sdh", skipAttached: true,
+	}
+	if _, err := injectVolumeAttachment(params, tfstate); err != nil {
+		t.Fatal(err)
+	}
+	// Both modules refer to the same instance and volume
+	app1 := findModule(tfstate, []string{"root", "app1"})
+	app2 := findModule(tfstate, []string{"root", "app2"})
+	for _, resourceID := range []string{"aws_instance.srv", "aws_ebs_volume.dsk"} {
+		app2.Resources[resourceID].Primary.ID = app1.Resources[resourceID].Primary.ID
+		app2.Resources[resourceID].Primary.Attributes["id"] = app1.Resources[resourceID].Primary.ID
+	}
+	var input bytes.Buffer
+	if err := writeTfState(&input, tfstate, defaultStateFormat); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := injectVolumeAttachment(params, tfstate); !errors.Is(err, errDuplicateAttachment) {
+		t.Fatalf("import: got %v, want errDuplicateAttachment", err)
+	}
+
+	_, _, err := streamInjectVolumeAttachments(context.Background(), bytes.NewReader(input.Bytes()),
+		&bytes.Buffer{}, []injectParams{params}, false)
+	if !errors.Is(err, errDuplicateAttachment) {
+		t.Fatalf("stream: got %v, want errDuplicateAttachment", err)
+	}
+	if !strings.Contains(err.Error(), "module.app1.aws_volume_attachment.dsk_attch already attaches") {
+		t.Errorf("error doesn't name the existing attachment: %s", err)
+	}
+
+	var warnings bytes.Buffer
+	verboseOutput = &warnings
+	defer func() { verboseOutput = os.Stderr }()
+	params.force = true
+	if _, _, err := streamInjectVolumeAttachments(context.Background(), bytes.NewReader(input.Bytes()),
+		&bytes.Buffer{}, []injectParams{params}, false); err != nil {
+		t.Fatalf("unexpected error with --force: %s", err)
+	}
+	if !strings.Contains(warnings.String(), "already attaches") {
+		t.Errorf("missing warning, got %q", warnings.String())
+	}
+}
+
+func TestStreamInjectMissingSerial(t *testing.T) {
+	tfstate := loadTfState(t, "single-module.tfstate")
+	var input bytes.Buffer
+	if err := writeTfState(&input, tfstate, defaultStateFormat); err != nil {
+		t.Fatal(err)
+	}
+	data := strings.Replace(input.String(), fmt.Sprintf(`"serial": %d,`, tfstate.Serial), "", 1)
+	if data == input.String() {
+		t.Fatal("fixture has no serial to remove")
+	}
+
+	params := injectParams{
+		instanceName: "mysrv", volumeName: "mysrv_dsk0",
+		attachmentName: "mysrv_dsk0_attch", deviceName: "/dev/sdg",
+	}
+	var output bytes.Buffer
+	if _, _, err := streamInjectVolumeAttachments(context.Background(), strings.NewReader(data), &output,
+		[]injectParams{params}, false); err != nil {
+		t.Fatal(err)
+	}
+	streamed, _, err := readTfState(&output, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamed.Serial != 1 {
+		t.Errorf("Serial = %d, want 1", streamed.Serial)
+	}
+}
+
+// A state with the given number of modules, each with an instance and volume
+func largeTfState(t testing.TB, modules int) []byte {
+	tfstate := &terraform.State{Version: 3, Serial: 1, Lineage: "bench"}
+	for i := 0; i < modules; i++ {
+		resource := func(resourceType, id string) *terraform.ResourceState {
+			return &terraform.ResourceState{
+				Type: resourceType,
+				Primary: &terraform.InstanceState{ID: id, Attributes: map[string]string{
+					"id": id, "availability_zone": "eu-west-1a", "tags.%": "1", "tags.Name": id,
+				}},
+				Provider: "provider.aws",
+			}
+		}
+		tfstate.Modules = append(tfstate.Modules, &terraform.ModuleState{
+			Path: []string{"root", fmt.Sprintf("app%d", i)},
+			Resources: map[string]*terraform.ResourceState{
+				"aws_instance.srv":   resource("aws_instance", fmt.Sprintf("i-%017x", i)),
+				"aws_ebs_volume.dsk": resource("aws_ebs_volume", fmt.Sprintf("vol-%017x", i)),
+			},
+		})
+	}
+	var data bytes.Buffer
+	if err := writeTfState(&data, tfstate, defaultStateFormat); err != nil {
+		t.Fatal(err)
+	}
+	return data.Bytes()
+}
+
+// The attachment goes in the last module, so every module is read
+var benchParams = []injectParams{{
+	instanceName: "srv", volumeName: "dsk", attachmentName: "dsk_attch",
+	deviceName: "/dev/sdh", under: "root.app9999",
+}}
+
+// Run f b.N times, reporting the largest heap seen while it runs as
+// "peak-MB", which is what --stream reduces
+func reportPeakHeap(b *testing.B, f func()) {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapAlloc
+
+	done := make(chan uint64)
+	stop := make(chan struct{})
+	go func() {
+		var peak uint64
+		for {
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > peak {
+				peak = stats.HeapAlloc
+			}
+			select {
+			case <-stop:
+				done <- peak
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f()
+	}
+	b.StopTimer()
+	close(stop)
+	if peak := <-done; peak > baseline {
+		b.ReportMetric(float64(peak-baseline)/1e6, "peak-MB")
+	}
+}
+
+func BenchmarkImportLargeState(b *testing.B) {
+	input := largeTfState(b, 10000)
+	b.SetBytes(int64(len(input)))
+	reportPeakHeap(b, func() {
+		tfstate, inputData, err := readTfState(bytes.NewReader(input), false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := injectVolumeAttachment(benchParams[0], tfstate); err != nil {
+			b.Fatal(err)
+		}
+		var output bytes.Buffer
+		if err := writeTfState(&output, tfstate, detectStateFormat(inputData)); err != nil {
+			b.Fatal(err)
+		}
+	})
+}
+
+// The output goes to a temporary file in streamImportMode, so isn't counted
+func BenchmarkStreamImportLargeState(b *testing.B) {
+	input := largeTfState(b, 10000)
+	b.SetBytes(int64(len(input)))
+	reportPeakHeap(b, func() {
+		if _, _, err := streamInjectVolumeAttachments(context.Background(), bytes.NewReader(input),
+			ioutil.Discard, benchParams, false); err != nil {
+			b.Fatal(err)
+		}
+	})
+}
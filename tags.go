@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/terraform/terraform"
+	"strings"
+)
+
+// Names of the volume tags "--from-tags" reads the attachment from
+type volumeTagKeys struct {
+	device     string // the device name, e.g. "/dev/sdg"
+	attachment string // the name of the attachment resource
+}
+
+// Complete params, which has just instanceName and volumeName set, from the
+// tags recorded on the volume in tfstate. The volume is looked up as
+// injectVolumeAttachment would, in the first module (under params.under)
+// that also has the instance. All missing tags are listed in the error.
+func injectParamsFromTags(params injectParams, keys volumeTagKeys, tfstate *terraform.State) (injectParams, error) {
+	types := params.types.withDefaults()
+	instanceResourceID := types.instance + "." + params.instanceName
+	volumeResourceID := types.volume + "." + params.volumeName
+	for _, moduleState := range tfstate.Modules {
+		if params.under != "" && !modulePathHasPrefix(moduleState.Path, params.under) {
+			continue
+		}
+		volumeState := moduleState.Resources[volumeResourceID]
+		if moduleState.Resources[instanceResourceID] == nil || volumeState == nil || volumeState.Primary == nil {
+			continue
+		}
+
+		attributes := volumeState.Primary.Attributes
+		var missing []string
+		for _, tag := range []struct {
+			key   string
+			value *string
+		}{{keys.device, &params.deviceName}, {keys.attachment, &params.attachmentName}} {
+			if *tag.value = attributes["tags."+tag.key]; *tag.value == "" {
+				missing = append(missing, "\""+tag.key+"\"")
+			}
+		}
+		if len(missing) > 0 {
+			return params, fmt.Errorf("%s in module %s is missing the tag(s) %s",
+				volumeResourceID, strings.Join(moduleState.Path, "."), strings.Join(missing, ", "))
+		}
+		verbosef("read device %s and attachment name %s from the tags of %s",
+			params.deviceName, params.attachmentName, volumeResourceID)
+		return params, nil
+	}
+	return params, fmt.Errorf("Could not locate module in tfstate containing (\"%s\", \"%s\") to read "+
+		"the tags of: %w", instanceResourceID, volumeResourceID, errInstanceNotFound)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestInjectParamsFromTags(t *testing.T) {
+	keys := volumeTagKeys{device: "DeviceName", attachment: "AttachmentName"}
+	params := injectParams{instanceName: "mysrv", volumeName: "mysrv_dsk0"}
+
+	got, err := injectParamsFromTags(params, keys, loadTfState(t, "tagged.tfstate"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.deviceName != "sdg" || got.attachmentName != "mysrv_dsk0_attch" {
+		t.Errorf("got device %q and attachment %q", got.deviceName, got.attachmentName)
+	}
+
+	// Every missing tag is listed
+	_, err = injectParamsFromTags(params, keys, loadTfState(t, "single-module.tfstate"))
+	if err == nil || !strings.Contains(err.Error(), `"DeviceName", "AttachmentName"`) {
+		t.Errorf("got error %v, want both tags listed", err)
+	}
+	_, err = injectParamsFromTags(params, volumeTagKeys{device: "DeviceName", attachment: "Other"},
+		loadTfState(t, "tagged.tfstate"))
+	if err == nil || !strings.HasSuffix(err.Error(), `missing the tag(s) "Other"`) {
+		t.Errorf("got error %v, want only \"Other\" listed", err)
+	}
+
+	params.volumeName = "otherdsk"
+	if _, err := injectParamsFromTags(params, keys, loadTfState(t, "tagged.tfstate")); !errors.Is(err, errInstanceNotFound) {
+		t.Errorf("got error %v, want %v", err, errInstanceNotFound)
+	}
+}
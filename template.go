@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/hashicorp/terraform/terraform"
+	"io"
+	"text/template"
+)
+
+// Fields of an attachment available to --output-template
+type showFields struct {
+	ID             string
+	DeviceName     string
+	InstanceID     string
+	VolumeID       string
+	AttachmentName string
+}
+
+// Collect the template fields of attachmentState, named attachmentName
+func newShowFields(attachmentName string, attachmentState *terraform.ResourceState) showFields {
+	attributes := attachmentState.Primary.Attributes
+	return showFields{
+		ID:             attachmentState.Primary.ID,
+		DeviceName:     attributes["device_name"],
+		InstanceID:     attributes["instance_id"],
+		VolumeID:       attributes["volume_id"],
+		AttachmentName: attachmentName,
+	}
+}
+
+// Execute the text/template text with fields and write the result to w,
+// adding a final newline if the template doesn't end with one. Nothing is
+// written if the template fails.
+func writeOutputTemplate(w io.Writer, text string, fields showFields) error {
+	tmpl, err := template.New("output").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return fmt.Errorf("Error parsing --output-template \"%s\": %s", text, err)
+	}
+	var output bytes.Buffer
+	if err := tmpl.Execute(&output, fields); err != nil {
+		return fmt.Errorf("Error executing --output-template \"%s\": %s", text, err)
+	}
+	if output.Len() == 0 || output.Bytes()[output.Len()-1] != '\n' {
+		output.WriteByte('\n')
+	}
+	_, err = w.Write(output.Bytes())
+	return err
+}
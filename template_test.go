@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteOutputTemplate(t *testing.T) {
+	attachmentState, err := newAwsVolumeAttachmentState("i-abc123", "mysrv_dsk0", "vol-123abc", "/dev/sdg", "provider.aws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := newShowFields("mysrv_dsk0_attch", attachmentState)
+
+	tests := []struct {
+		text    string
+		want    string
+		wantErr string
+	}{
+		{"{{.ID}}", attachmentState.Primary.ID + "\n", ""},
+		{"{{.AttachmentName}},{{.InstanceID}},{{.VolumeID}},{{.DeviceName}}\n",
+			"mysrv_dsk0_attch,i-abc123,vol-123abc,/dev/sdg\n", ""},
+		{"{{.ID", "", `Error parsing --output-template "{{.ID"`},
+		{"{{.Bogus}}", "", `Error executing --output-template "{{.Bogus}}"`},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		err := writeOutputTemplate(&out, tt.text, fields)
+		if tt.wantErr != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("%q: got error %v, want %q", tt.text, err, tt.wantErr)
+			}
+			if out.Len() != 0 {
+				t.Errorf("%q: wrote %q despite the error", tt.text, out.String())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tt.text, err)
+		} else if out.String() != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.text, out.String(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/docopt/docopt-go"
+	"github.com/hashicorp/terraform/terraform"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// A Terraform Cloud or Enterprise workspace whose state is read and written
+// through the API instead of a local file, as given by "--tfc-workspace"
+type tfcWorkspace struct {
+	baseURL      string // e.g. "https://app.terraform.io"
+	organization string
+	name         string
+	token        string
+	id           string // e.g. "ws-abc123", looked up on first use
+}
+
+// The workspace named by "--tfc-workspace" in opts, or nil if it isn't given.
+// The token comes from "--tfc-token" or $TFE_TOKEN.
+func tfcWorkspaceFromOpts(opts docopt.Opts) (*tfcWorkspace, error) {
+	workspaceArg, _ := opts.String("--tfc-workspace")
+	if workspaceArg == "" {
+		return nil, nil
+	}
+	parts := strings.Split(workspaceArg, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("Invalid --tfc-workspace \"%s\", expected \"organization/workspace\"", workspaceArg)
+	}
+	if outputFileNames, _ := opts["-o"].([]string); len(outputFileNames) > 0 {
+		return nil, fmt.Errorf("-o can't be used with --tfc-workspace, the state is written back to the workspace")
+	}
+	decryptCommand, _ := opts.String("--decrypt-cmd")
+	encryptCommand, _ := opts.String("--encrypt-cmd")
+	if decryptCommand != "" || encryptCommand != "" {
+		return nil, fmt.Errorf("--decrypt-cmd and --encrypt-cmd can't be used with --tfc-workspace")
+	}
+
+	token, _ := opts.String("--tfc-token")
+	if token == "" {
+		token = os.Getenv("TFE_TOKEN")
+	}
+	if token == "" {
+		return nil, fmt.Errorf("--tfc-workspace needs an API token, pass --tfc-token or set TFE_TOKEN")
+	}
+	host, _ := opts.String("--tfc-host")
+	baseURL := strings.TrimSuffix(host, "/")
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "https://" + baseURL
+	}
+	return &tfcWorkspace{baseURL: baseURL, organization: parts[0], name: parts[1], token: token}, nil
+}
+
+func (w *tfcWorkspace) String() string {
+	return "workspace " + w.organization + "/" + w.name
+}
+
+// Download the workspace's current state version
+func readTfStateTFC(ctx context.Context, w *tfcWorkspace, lenient bool) (*terraform.State, []byte, error) {
+	if err := w.lookupID(ctx); err != nil {
+		return nil, nil, err
+	}
+	var stateVersion struct {
+		Data struct {
+			Attributes struct {
+				DownloadURL string `json:"hosted-state-download-url"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+	if err := w.get(ctx, w.baseURL+"/api/v2/workspaces/"+w.id+"/current-state-version", &stateVersion); err != nil {
+		return nil, nil, err
+	}
+	if stateVersion.Data.Attributes.DownloadURL == "" {
+		return nil, nil, fmt.Errorf("Terraform Cloud returned no download URL for the state of %s", w)
+	}
+	var body []byte
+	err := withRetries(ctx, "fetching the state of "+w.String(), func(ctx context.Context) error {
+		request, err := w.newRequest(ctx, "GET", stateVersion.Data.Attributes.DownloadURL, nil)
+		if err != nil {
+			return err
+		}
+		body, err = fetchURL(request)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return readTfState(bytes.NewReader(body), lenient)
+}
+
+// How long unlocking the workspace may take once ctx has been cancelled
+const tfcUnlockTimeout = 30 * time.Second
+
+// Upload data, the encoding of tfstate, as a new state version of the
+// workspace. The workspace is locked while doing so, and Terraform Cloud
+// itself rejects a serial that isn't newer than the current one.
+func writeTfStateTFC(ctx context.Context, w *tfcWorkspace, tfstate *terraform.State, data []byte) (err error) {
+	if err := w.lookupID(ctx); err != nil {
+		return err
+	}
+	workspaceURL := w.baseURL + "/api/v2/workspaces/" + w.id
+	if err := w.post(ctx, workspaceURL+"/actions/lock", map[string]string{"reason": "tf-ebs-attach"}); err != nil {
+		return fmt.Errorf("Error locking %s: %s", w, err)
+	}
+	// Unlock even after a timeout or an interruption cancelled ctx, or the
+	// workspace stays locked
+	defer func() {
+		unlockCtx, cancel := context.WithTimeout(context.Background(), tfcUnlockTimeout)
+		defer cancel()
+		unlockErr := w.post(unlockCtx, workspaceURL+"/actions/unlock", nil)
+		if unlockErr == nil {
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("The state was uploaded, but %s is still locked, unlock it in Terraform Cloud: %s",
+				w, unlockErr)
+			return
+		}
+		warnf("%s is still locked, unlock it in Terraform Cloud: %s", w, unlockErr)
+	}()
+
+	checksum := md5.Sum(data)
+	stateVersion := map[string]interface{}{
+		"data": map[string]interface{}{
+			"type": "state-versions",
+			"attributes": map[string]interface{}{
+				"serial":  tfstate.Serial,
+				"md5":     hex.EncodeToString(checksum[:]),
+				"lineage": tfstate.Lineage,
+				"state":   base64.StdEncoding.EncodeToString(data),
+			},
+		},
+	}
+	if err := w.post(ctx, workspaceURL+"/state-versions", stateVersion); err != nil {
+		return fmt.Errorf("Error uploading the state of %s: %s", w, err)
+	}
+	return nil
+}
+
+// Resolve the organization and workspace names to the workspace ID
+func (w *tfcWorkspace) lookupID(ctx context.Context) error {
+	if w.id != "" {
+		return nil
+	}
+	var workspace struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := w.get(ctx, w.baseURL+"/api/v2/organizations/"+w.organization+"/workspaces/"+w.name, &workspace); err != nil {
+		return err
+	}
+	if workspace.Data.ID == "" {
+		return fmt.Errorf("Terraform Cloud returned no ID for %s", w)
+	}
+	w.id = workspace.Data.ID
+	return nil
+}
+
+// Decode the JSON:API document at url into result, retrying as
+// readTfStateURL does
+func (w *tfcWorkspace) get(ctx context.Context, url string, result interface{}) error {
+	var body []byte
+	err := withRetries(ctx, "fetching "+url, func(ctx context.Context) error {
+		request, err := w.newRequest(ctx, "GET", url, nil)
+		if err != nil {
+			return err
+		}
+		body, err = fetchURL(request)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, result); err != nil {
+		return fmt.Errorf("Error parsing response from %s: %s", url, err)
+	}
+	return nil
+}
+
+// Send document to url as JSON. Not retried, as the request may have taken
+// effect even if the response was lost.
+func (w *tfcWorkspace) post(ctx context.Context, url string, document interface{}) error {
+	var body []byte
+	if document != nil {
+		var err error
+		if body, err = json.Marshal(document); err != nil {
+			return err
+		}
+	}
+	request, err := w.newRequest(ctx, "POST", url, body)
+	if err != nil {
+		return err
+	}
+	response, err := (&http.Client{Timeout: httpStateTimeout}).Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("%s%s", response.Status, tfcErrorDetail(response))
+	}
+	return nil
+}
+
+// A request to the API authenticated with the workspace's token
+func (w *tfcWorkspace) newRequest(ctx context.Context, method, url string, body []byte) (*http.Request, error) {
+	request, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+w.token)
+	request.Header.Set("Content-Type", "application/vnd.api+json")
+	return request.WithContext(ctx), nil
+}
+
+// The details of a JSON:API error response, formatted as ": detail; ...",
+// or "" if there are none
+func tfcErrorDetail(response *http.Response) string {
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return ""
+	}
+	var document struct {
+		Errors []struct {
+			Title  string `json:"title"`
+			Detail string `json:"detail"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(body, &document) != nil {
+		return ""
+	}
+	var details []string
+	for _, e := range document.Errors {
+		if e.Detail != "" {
+			details = append(details, e.Detail)
+		} else if e.Title != "" {
+			details = append(details, e.Title)
+		}
+	}
+	if len(details) == 0 {
+		return ""
+	}
+	return ": " + strings.Join(details, "; ")
+}
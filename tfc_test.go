@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A stand-in for the parts of the Terraform Cloud API used, recording the
+// requests it receives and the uploaded state version
+type fakeTFC struct {
+	state    []byte
+	requests []string
+	uploaded map[string]interface{}
+	locked   bool
+	onUpload func() // called when a state version is posted
+}
+
+func (f *fakeTFC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		http.Error(w, `{"errors":[{"status":"401","title":"unauthorized"}]}`, http.StatusUnauthorized)
+		return
+	}
+	switch r.Method + " " + r.URL.Path {
+	case "GET /api/v2/organizations/acme/workspaces/prod":
+		w.Write([]byte(`{"data": {"id": "ws-123", "type": "workspaces"}}`))
+	case "GET /api/v2/workspaces/ws-123/current-state-version":
+		w.Write([]byte(`{"data": {"attributes": {"hosted-state-download-url": "http://` + r.Host + `/state/sv-1"}}}`))
+	case "GET /state/sv-1":
+		w.Write(f.state)
+	case "POST /api/v2/workspaces/ws-123/actions/lock":
+		f.locked = true
+		w.Write([]byte(`{}`))
+	case "POST /api/v2/workspaces/ws-123/actions/unlock":
+		f.locked = false
+		w.Write([]byte(`{}`))
+	case "POST /api/v2/workspaces/ws-123/state-versions":
+		if f.onUpload != nil {
+			f.onUpload()
+		}
+		if !f.locked {
+			http.Error(w, `{"errors":[{"detail":"workspace not locked"}]}`, http.StatusConflict)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var document struct {
+			Data struct {
+				Attributes map[string]interface{} `json:"attributes"`
+			} `json:"data"`
+		}
+		json.Unmarshal(body, &document)
+		f.uploaded = document.Data.Attributes
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestTFCWorkspaceRoundTrip(t *testing.T) {
+	state, err := ioutil.ReadFile("testdata/single-module.tfstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeTFC{state: state}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	workspace := &tfcWorkspace{baseURL: server.URL, organization: "acme", name: "prod", token: "secret"}
+
+	tfstate, data, err := readTfStateTFC(context.Background(), workspace, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tfstate.Serial != 4 || string(data) != string(state) {
+		t.Fatalf("read serial %d, want 4", tfstate.Serial)
+	}
+
+	tfstate.Serial++
+	if err := writeTfStateTFC(context.Background(), workspace, tfstate, []byte("new state")); err != nil {
+		t.Fatal(err)
+	}
+	if fake.locked {
+		t.Error("workspace left locked")
+	}
+	if fake.uploaded["serial"] != float64(5) || fake.uploaded["lineage"] != tfstate.Lineage {
+		t.Errorf("uploaded serial %v, lineage %v", fake.uploaded["serial"], fake.uploaded["lineage"])
+	}
+	if fake.uploaded["state"] != base64.StdEncoding.EncodeToString([]byte("new state")) ||
+		fake.uploaded["md5"] != "ae1c8b12d54cc3be494a55564c1b88ff" {
+		t.Errorf("uploaded state %v, md5 %v", fake.uploaded["state"], fake.uploaded["md5"])
+	}
+	// The workspace ID is only looked up once
+	if lookups := strings.Count(strings.Join(fake.requests, "\n"), "/organizations/"); lookups != 1 {
+		t.Errorf("looked up the workspace ID %d times, want 1", lookups)
+	}
+}
+
+func TestTFCWorkspaceUnlockAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fake := &fakeTFC{onUpload: cancel}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	workspace := &tfcWorkspace{baseURL: server.URL, organization: "acme", name: "prod", token: "secret"}
+
+	// Interrupted during the upload, the workspace is still unlocked
+	writeTfStateTFC(ctx, workspace, loadTfState(t, "single-module.tfstate"), []byte("new state"))
+	if fake.locked {
+		t.Errorf("workspace left locked after the context was cancelled, requests: %v", fake.requests)
+	}
+}
+
+func TestTFCWorkspaceErrors(t *testing.T) {
+	fake := &fakeTFC{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	workspace := &tfcWorkspace{baseURL: server.URL, organization: "acme", name: "prod", token: "wrong"}
+	if _, _, err := readTfStateTFC(context.Background(), workspace, false); err == nil ||
+		!strings.Contains(err.Error(), "401 Unauthorized") {
+		t.Errorf("expected an error with the status, got %v", err)
+	}
+
+	workspace = &tfcWorkspace{baseURL: server.URL, organization: "acme", name: "prod", token: "secret", id: "ws-123"}
+	err := workspace.post(context.Background(), server.URL+"/api/v2/workspaces/ws-123/state-versions", nil)
+	if err == nil || !strings.Contains(err.Error(), "workspace not locked") {
+		t.Errorf("expected the error detail, got %v", err)
+	}
+}
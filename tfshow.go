@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/terraform/terraform"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Write resourceState, whose key in the state is resourceID, in the style of
+// "terraform state show": a "# address:" comment and a resource block with
+// one aligned "key = value" line per attribute, sorted by key
+func writeTfShow(w io.Writer, resourceID string, resourceState *terraform.ResourceState) error {
+	// "type.name.0" is shown as "type.name[0]" with the block named "name"
+	parts := strings.SplitN(resourceID, ".", 3)
+	if len(parts) < 2 {
+		return fmt.Errorf("Invalid resource key \"%s\"", resourceID)
+	}
+	address := parts[0] + "." + parts[1]
+	if len(parts) == 3 {
+		address += "[" + parts[2] + "]"
+	}
+
+	attributes := resourceState.Primary.Attributes
+	keys := make([]string, 0, len(attributes))
+	width := 0
+	for key := range attributes {
+		keys = append(keys, key)
+		if len(key) > width {
+			width = len(key)
+		}
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s:\n", address)
+	fmt.Fprintf(&b, "resource %s %s {\n", strconv.Quote(parts[0]), strconv.Quote(parts[1]))
+	for _, key := range keys {
+		fmt.Fprintf(&b, "    %-*s = %s\n", width, key, tfShowValue(attributes[key]))
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Format a flatmapped attribute value as terraform shows it. Booleans such
+// as "force_detach" are unquoted; everything else is a quoted string.
+func tfShowValue(value string) string {
+	if value == "true" || value == "false" {
+		return value
+	}
+	return strconv.Quote(value)
+}
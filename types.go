@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/docopt/docopt-go"
+)
+
+// Resource types used to locate the instance and volume and to create the
+// attachment, for states where these are wrapped or renamed
+type resourceTypes struct {
+	instance   string
+	volume     string
+	attachment string
+}
+
+// The AWS provider's types, used for any field left empty
+var defaultResourceTypes = resourceTypes{
+	instance:   "aws_instance",
+	volume:     "aws_ebs_volume",
+	attachment: "aws_volume_attachment",
+}
+
+// Read "--instance-type", "--volume-type" and "--attachment-type" from opts
+func resourceTypesFromOpts(opts docopt.Opts) resourceTypes {
+	types := resourceTypes{}
+	types.instance, _ = opts.String("--instance-type")
+	types.volume, _ = opts.String("--volume-type")
+	types.attachment, _ = opts.String("--attachment-type")
+	return types.withDefaults()
+}
+
+// Fill in empty fields from defaultResourceTypes
+func (types resourceTypes) withDefaults() resourceTypes {
+	if types.instance == "" {
+		types.instance = defaultResourceTypes.instance
+	}
+	if types.volume == "" {
+		types.volume = defaultResourceTypes.volume
+	}
+	if types.attachment == "" {
+		types.attachment = defaultResourceTypes.attachment
+	}
+	return types
+}
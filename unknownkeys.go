@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/hashicorp/terraform/terraform"
+	"reflect"
+	"strings"
+)
+
+// A top-level key of a state file and its undecoded value
+type stateKey struct {
+	name  string
+	value json.RawMessage
+}
+
+// Find the top-level keys in the JSON object in data that terraform.State
+// doesn't have a field for, in the order they appear. These would be lost by
+// decoding into it, e.g. ones added by a newer terraform.
+func unknownStateKeys(data []byte) []stateKey {
+	known := make(map[string]bool)
+	stateType := reflect.TypeOf(terraform.State{})
+	for i := 0; i < stateType.NumField(); i++ {
+		if tag := stateType.Field(i).Tag.Get("json"); tag != "" && tag != "-" {
+			known[strings.Split(tag, ",")[0]] = true
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil
+	}
+	var unknown []stateKey
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return unknown
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return unknown
+		}
+		if name := token.(string); !known[name] {
+			unknown = append(unknown, stateKey{name, value})
+		}
+	}
+	return unknown
+}
+
+// Add keys to the end of the encoded JSON object in data, indented as
+// json.MarshalIndent with four spaces would unless compact
+func appendStateKeys(data []byte, keys []stateKey, compact bool) ([]byte, error) {
+	if len(keys) == 0 {
+		return data, nil
+	}
+	var output bytes.Buffer
+	output.Write(bytes.TrimSuffix(bytes.TrimSuffix(data, []byte("}")), []byte("\n")))
+	for _, key := range keys {
+		name, err := json.Marshal(key.name)
+		if err != nil {
+			return nil, err
+		}
+		output.WriteString(",")
+		if compact {
+			output.Write(name)
+			output.WriteString(":")
+			if err := json.Compact(&output, key.value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		output.WriteString("\n    ")
+		output.Write(name)
+		output.WriteString(": ")
+		if err := json.Indent(&output, key.value, "    ", "    "); err != nil {
+			return nil, err
+		}
+	}
+	if !compact {
+		output.WriteString("\n")
+	}
+	output.WriteString("}")
+	return output.Bytes(), nil
+}
+
+// The quoted names of keys, separated by commas
+func stateKeyNames(keys []stateKey) string {
+	var names []string
+	for _, key := range keys {
+		names = append(names, "\""+key.name+"\"")
+	}
+	return strings.Join(names, ", ")
+}
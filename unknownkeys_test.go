@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// testdata/single-module.tfstate with keys terraform.State doesn't have
+func stateWithUnknownKeys(t *testing.T) []byte {
+	data, err := ioutil.ReadFile("testdata/single-module.tfstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte(strings.TrimSuffix(string(data), "\n}\n") + `,
+    "check_results": {
+        "passed": [
+            "a",
+            "b"
+        ]
+    },
+    "future": 1
+}
+`)
+}
+
+func TestUnknownStateKeys(t *testing.T) {
+	keys := unknownStateKeys(stateWithUnknownKeys(t))
+	if got := stateKeyNames(keys); got != `"check_results", "future"` {
+		t.Errorf("got %s", got)
+	}
+	data, err := ioutil.ReadFile("testdata/single-module.tfstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := unknownStateKeys(data); len(keys) != 0 {
+		t.Errorf("got %s for a state without unknown keys", stateKeyNames(keys))
+	}
+}
+
+func TestWriteTfStateKeepsUnknownKeys(t *testing.T) {
+	input := stateWithUnknownKeys(t)
+	tfstate, inputData, err := readTfState(bytes.NewReader(input), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output bytes.Buffer
+	if err := writeTfState(&output, tfstate, detectStateFormat(inputData)); err != nil {
+		t.Fatal(err)
+	}
+	if output.String() != string(input) {
+		t.Errorf("round trip changed the state:\n%s", output.String())
+	}
+
+	format := detectStateFormat(inputData)
+	format.compact = true
+	output.Reset()
+	if err := writeTfState(&output, tfstate, format); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(output.String(), `,"check_results":{"passed":["a","b"]},"future":1}`+"\n") {
+		t.Errorf("unknown keys missing from compact output:\n%s", output.String())
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/terraform/terraform"
+	"io"
+	"os"
+	"runtime/debug"
+)
+
+// Build details set with -ldflags "-X main.buildVersion=...", used when the
+// binary carries no module or VCS information (e.g. a glide/GOPATH build)
+var (
+	buildVersion          string
+	buildCommit           string
+	buildDate             string
+	buildTerraformVersion string // the terraform revision in glide.lock
+)
+
+// Module path of the terraform library, whose version determines the state
+// format understood
+const terraformModulePath = "github.com/hashicorp/terraform"
+
+// Print the version, commit and build date of this binary and the terraform
+// library it was built with, and the state version that library writes
+func versionMode() {
+	info, _ := debug.ReadBuildInfo()
+	writeVersion(os.Stdout, info)
+}
+
+// Write version information from info, which may be nil, falling back to the
+// values set with -ldflags
+func writeVersion(w io.Writer, info *debug.BuildInfo) {
+	version, commit, date := buildVersion, buildCommit, buildDate
+	terraformVersion, goVersion := buildTerraformVersion, ""
+	modified := false
+	if info != nil {
+		goVersion = info.GoVersion
+		if info.Main.Version != "" && info.Main.Version != "(devel)" {
+			version = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && commit == "":
+				commit = setting.Value
+			case setting.Key == "vcs.time" && date == "":
+				date = setting.Value
+			case setting.Key == "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		for _, dep := range info.Deps {
+			if dep.Path != terraformModulePath {
+				continue
+			}
+			terraformVersion = dep.Version
+			if dep.Replace != nil {
+				terraformVersion += " => " + dep.Replace.Path
+				if dep.Replace.Version != "" {
+					terraformVersion += " " + dep.Replace.Version
+				}
+			}
+		}
+	}
+	if modified {
+		commit += " (modified)"
+	}
+
+	fmt.Fprintf(w, "tf-ebs-attach %s\n", orUnknown(version))
+	fmt.Fprintf(w, "commit:    %s\n", orUnknown(commit))
+	fmt.Fprintf(w, "built:     %s\n", orUnknown(date))
+	if goVersion != "" {
+		fmt.Fprintf(w, "go:        %s\n", goVersion)
+	}
+	fmt.Fprintf(w, "terraform: %s (state version %d)\n", orUnknown(terraformVersion), terraform.StateVersion)
+}
+
+func orUnknown(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"runtime/debug"
+	"testing"
+)
+
+func TestWriteVersion(t *testing.T) {
+	info := &debug.BuildInfo{
+		GoVersion: "go1.21.0",
+		Main:      debug.Module{Path: "github.com/ppar/tf-ebs-attach", Version: "(devel)"},
+		Deps: []*debug.Module{
+			{Path: "github.com/docopt/docopt-go", Version: "v0.0.0-20180111231733-ee0de3bc6815"},
+			{Path: "github.com/hashicorp/terraform", Version: "v0.11.7"},
+		},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs.revision", Value: "1b757f3"},
+			{Key: "vcs.time", Value: "2026-10-01T12:00:00Z"},
+			{Key: "vcs.modified", Value: "true"},
+		},
+	}
+	defer func(version string) { buildVersion = version }(buildVersion)
+	buildVersion = "v0.2"
+
+	var out bytes.Buffer
+	writeVersion(&out, info)
+	want := "tf-ebs-attach v0.2\n" +
+		"commit:    1b757f3 (modified)\n" +
+		"built:     2026-10-01T12:00:00Z\n" +
+		"go:        go1.21.0\n" +
+		"terraform: v0.11.7 (state version 3)\n"
+	if out.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	out.Reset()
+	buildVersion = ""
+	writeVersion(&out, nil)
+	want = "tf-ebs-attach unknown\n" +
+		"commit:    unknown\n" +
+		"built:     unknown\n" +
+		"terraform: unknown (state version 3)\n"
+	if out.String() != want {
+		t.Errorf("without build info, got:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	// A glide/GOPATH build has no module information, so the terraform
+	// version comes from -ldflags
+	defer func(version string) { buildTerraformVersion = version }(buildTerraformVersion)
+	buildTerraformVersion = "41e50bd32a8825a84535e353c3674af8ce799161"
+	out.Reset()
+	writeVersion(&out, &debug.BuildInfo{GoVersion: "go1.10"})
+	want = "tf-ebs-attach unknown\n" +
+		"commit:    unknown\n" +
+		"built:     unknown\n" +
+		"go:        go1.10\n" +
+		"terraform: 41e50bd32a8825a84535e353c3674af8ce799161 (state version 3)\n"
+	if out.String() != want {
+		t.Errorf("with -ldflags, got:\n%s\nwant:\n%s", out.String(), want)
+	}
+}